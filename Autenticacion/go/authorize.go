@@ -0,0 +1,227 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"html/template"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+var consentPage = template.Must(template.New("consent").Parse(`<!DOCTYPE html>
+<html>
+<head><title>Authorize {{.ClientName}}</title></head>
+<body>
+<h1>{{.ClientName}} wants to access your account</h1>
+<p>Requested scopes:</p>
+<ul>{{range .Scope}}<li>{{.}}</li>{{else}}<li>(none)</li>{{end}}</ul>
+{{if .Error}}<p role="alert">{{.Error}}</p>{{end}}
+<form method="post" action="/authorize">
+<input type="hidden" name="consent_id" value="{{.ConsentID}}">
+<label>Username <input name="username" value="{{.Username}}" autocomplete="username" required></label>
+<label>Password <input name="password" type="password" autocomplete="current-password" required></label>
+<button type="submit" name="decision" value="allow">Allow</button>
+<button type="submit" name="decision" value="deny" formnovalidate>Deny</button>
+</form>
+</body>
+</html>
+`))
+
+type consentView struct {
+	ClientName string
+	Scope      []string
+	ConsentID  string
+	Username   string
+	Error      string
+}
+
+// authorizeHandler godoc
+// @Summary OAuth2 authorization endpoint
+// @Description GET validates an authorization code request (PKCE with S256 is required) and shows a consent page. POST signs the user in with their username and password, records their decision and redirects back to the client with a code or an error.
+// @Tags oauth
+// @Produce html
+// @Param response_type query string true "Must be code"
+// @Param client_id query string true "Client id"
+// @Param redirect_uri query string false "Registered redirect URI; required when the client has several"
+// @Param scope query string false "Space-delimited scopes"
+// @Param state query string false "Opaque value echoed back to the client"
+// @Param nonce query string false "OpenID Connect nonce copied into the ID token"
+// @Param code_challenge query string true "PKCE code challenge"
+// @Param code_challenge_method query string true "Must be S256"
+// @Success 200 {string} string "Consent page"
+// @Success 302 {string} string "Redirect to the client"
+// @Failure 400 {string} string "Invalid client or redirect URI"
+// @Router /authorize [get]
+func authorizeHandler(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+		startAuthorization(w, r)
+	case http.MethodPost:
+		finishAuthorization(w, r)
+	default:
+		w.Header().Set("Allow", "GET, POST")
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+func startAuthorization(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+
+	// Until the client and redirect URI are known to be valid, errors must be
+	// shown to the user rather than redirected (RFC 6749 section 4.1.2.1).
+	client, ok := oauth.client(q.Get("client_id"))
+	if !ok {
+		http.Error(w, "Unknown client_id", http.StatusBadRequest)
+		return
+	}
+	redirectURI := q.Get("redirect_uri")
+	if redirectURI == "" && len(client.RedirectURIs) == 1 {
+		redirectURI = client.RedirectURIs[0]
+	}
+	if !containsString(client.RedirectURIs, redirectURI) {
+		http.Error(w, "redirect_uri is not registered for this client", http.StatusBadRequest)
+		return
+	}
+
+	state := q.Get("state")
+	if q.Get("response_type") != "code" {
+		redirectWithError(w, r, redirectURI, state, "unsupported_response_type", "Only response_type=code is supported")
+		return
+	}
+	if !client.allowsGrant(grantAuthorizationCode) {
+		redirectWithError(w, r, redirectURI, state, "unauthorized_client", "Client is not registered for authorization_code")
+		return
+	}
+	challenge := q.Get("code_challenge")
+	if challenge == "" || q.Get("code_challenge_method") != "S256" {
+		redirectWithError(w, r, redirectURI, state, "invalid_request", "PKCE with code_challenge_method=S256 is required")
+		return
+	}
+	scope, ok := resolveScope(q.Get("scope"), strings.Fields(client.Scope))
+	if !ok {
+		redirectWithError(w, r, redirectURI, state, "invalid_scope", "Requested scope is not allowed for this client")
+		return
+	}
+
+	consentID, err := randomToken(16)
+	if err != nil {
+		redirectWithError(w, r, redirectURI, state, "server_error", "")
+		return
+	}
+	oauth.addConsent(consentID, &authorizationRequest{
+		Client:              client,
+		RedirectURI:         redirectURI,
+		RedirectURISent:     q.Get("redirect_uri") != "",
+		Scope:               scope,
+		State:               state,
+		Nonce:               q.Get("nonce"),
+		CodeChallenge:       challenge,
+		CodeChallengeMethod: "S256",
+		ExpiresAt:           time.Now().Add(consentTTL),
+	})
+
+	writeConsentPage(w, consentView{Scope: scope, ConsentID: consentID}, client)
+}
+
+func writeConsentPage(w http.ResponseWriter, view consentView, client *OAuthClient) {
+	view.ClientName = client.ClientName
+	if view.ClientName == "" {
+		view.ClientName = client.ClientID
+	}
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.Header().Set("Cache-Control", "no-store")
+	w.Header().Set("X-Frame-Options", "DENY")
+	consentPage.Execute(w, view)
+}
+
+func finishAuthorization(w http.ResponseWriter, r *http.Request) {
+	if err := r.ParseForm(); err != nil {
+		http.Error(w, "Invalid form", http.StatusBadRequest)
+		return
+	}
+	consentID := r.PostForm.Get("consent_id")
+	ar, ok := oauth.consent(consentID)
+	if !ok {
+		http.Error(w, "Authorization request expired or already used", http.StatusBadRequest)
+		return
+	}
+	if r.PostForm.Get("decision") != "allow" {
+		oauth.takeConsent(consentID)
+		redirectWithError(w, r, ar.RedirectURI, ar.State, "access_denied", "The user denied the request")
+		return
+	}
+
+	// The code is issued to whoever signs in here, so the resource owner
+	// must prove who they are; a username alone is not enough.
+	username := strings.TrimSpace(r.PostForm.Get("username"))
+	err := authenticateUser(r.Context(), username, r.PostForm.Get("password"))
+	if errors.Is(err, errInvalidCredentials) {
+		writeConsentPage(w, consentView{Scope: ar.Scope, ConsentID: consentID, Username: username, Error: "Invalid username or password"}, ar.Client)
+		return
+	}
+	if _, ok := oauth.takeConsent(consentID); !ok {
+		http.Error(w, "Authorization request expired or already used", http.StatusBadRequest)
+		return
+	}
+	switch {
+	case errors.Is(err, errMFARequired):
+		redirectWithError(w, r, ar.RedirectURI, ar.State, "access_denied", "Accounts with two-factor authentication cannot sign in here")
+		return
+	case err != nil:
+		fmt.Println("authorize sign-in failed:", err)
+		redirectWithError(w, r, ar.RedirectURI, ar.State, "server_error", "")
+		return
+	}
+
+	code, err := randomToken(32)
+	if err != nil {
+		redirectWithError(w, r, ar.RedirectURI, ar.State, "server_error", "")
+		return
+	}
+	oauth.addCode(code, &authorizationCode{
+		ClientID:            ar.Client.ClientID,
+		RedirectURI:         ar.RedirectURI,
+		RedirectURISent:     ar.RedirectURISent,
+		Username:            username,
+		Scope:               ar.Scope,
+		CodeChallenge:       ar.CodeChallenge,
+		CodeChallengeMethod: ar.CodeChallengeMethod,
+		Nonce:               ar.Nonce,
+		AuthTime:            time.Now(),
+		ExpiresAt:           time.Now().Add(authCodeTTL),
+	})
+
+	params := url.Values{"code": {code}, "iss": {issuerURL()}}
+	if ar.State != "" {
+		params.Set("state", ar.State)
+	}
+	http.Redirect(w, r, appendQuery(ar.RedirectURI, params), http.StatusFound)
+}
+
+// redirectWithError sends an authorization error back to the client. The iss
+// parameter lets clients detect mix-up attacks (RFC 9207).
+func redirectWithError(w http.ResponseWriter, r *http.Request, redirectURI, state, code, description string) {
+	params := url.Values{"error": {code}, "iss": {issuerURL()}}
+	if description != "" {
+		params.Set("error_description", description)
+	}
+	if state != "" {
+		params.Set("state", state)
+	}
+	http.Redirect(w, r, appendQuery(redirectURI, params), http.StatusFound)
+}
+
+func appendQuery(rawURL string, params url.Values) string {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return rawURL
+	}
+	q := u.Query()
+	for k, v := range params {
+		q[k] = v
+	}
+	u.RawQuery = q.Encode()
+	return u.String()
+}
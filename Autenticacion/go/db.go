@@ -0,0 +1,31 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+
+	"github.com/jackc/pgx/v5/pgxpool"
+)
+
+// The users table is owned by the Encriptacion service; this service only
+// reads it, to sign users in at /authorize and to fill OpenID Connect
+// claims. Handlers share one connection pool, opened at startup from
+// DATABASE_URL (the pool_* parameters pgxpool accepts there tune it).
+// Without DATABASE_URL db stays nil and no user can sign in at /authorize.
+var db *pgxpool.Pool
+
+// openDB creates the pool, or returns nil when DATABASE_URL is not set.
+// Connections are made lazily, so a database that is down at startup does
+// not stop the server.
+func openDB(ctx context.Context) (*pgxpool.Pool, error) {
+	dbURL := os.Getenv("DATABASE_URL")
+	if dbURL == "" {
+		return nil, nil
+	}
+	pool, err := pgxpool.New(ctx, dbURL)
+	if err != nil {
+		return nil, fmt.Errorf("DATABASE_URL: %w", err)
+	}
+	return pool, nil
+}
@@ -0,0 +1,140 @@
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"flag"
+	"fmt"
+	"math/big"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// runDevCerts implements "go run . devcerts": it writes a throwaway CA, a
+// server certificate for localhost and a client certificate, enough to try
+// mTLS locally. Never use these outside development.
+//
+//	go run . devcerts -out certs -client aminespinoza
+func runDevCerts(args []string) error {
+	fs := flag.NewFlagSet("devcerts", flag.ContinueOnError)
+	out := fs.String("out", "certs", "directory to write the PEM files to")
+	client := fs.String("client", "aminespinoza", "client certificate common name (the mTLS username)")
+	email := fs.String("email", "", "optional email SAN for the client certificate")
+	hosts := fs.String("hosts", "localhost,127.0.0.1,::1", "comma-separated server DNS names and IPs")
+	validFor := fs.Duration("valid-for", 365*24*time.Hour, "certificate lifetime")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if err := os.MkdirAll(*out, 0o700); err != nil {
+		return err
+	}
+
+	now := time.Now()
+	caKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return err
+	}
+	caTemplate := &x509.Certificate{
+		Subject:               pkix.Name{CommonName: authRealm + " dev CA"},
+		NotBefore:             now.Add(-time.Hour),
+		NotAfter:              now.Add(*validFor),
+		KeyUsage:              x509.KeyUsageCertSign | x509.KeyUsageCRLSign,
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+		MaxPathLenZero:        true,
+	}
+	caCert, err := writeCertificate(*out, "ca", caTemplate, caKey, nil, nil)
+	if err != nil {
+		return err
+	}
+
+	serverTemplate := &x509.Certificate{
+		Subject:     pkix.Name{CommonName: "localhost"},
+		NotBefore:   now.Add(-time.Hour),
+		NotAfter:    now.Add(*validFor),
+		KeyUsage:    x509.KeyUsageDigitalSignature,
+		ExtKeyUsage: []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	}
+	for _, h := range strings.Split(*hosts, ",") {
+		h = strings.TrimSpace(h)
+		if h == "" {
+			continue
+		}
+		if ip := net.ParseIP(h); ip != nil {
+			serverTemplate.IPAddresses = append(serverTemplate.IPAddresses, ip)
+		} else {
+			serverTemplate.DNSNames = append(serverTemplate.DNSNames, h)
+		}
+	}
+	if _, err := writeCertificate(*out, "server", serverTemplate, nil, caCert, caKey); err != nil {
+		return err
+	}
+
+	clientTemplate := &x509.Certificate{
+		Subject:     pkix.Name{CommonName: *client},
+		NotBefore:   now.Add(-time.Hour),
+		NotAfter:    now.Add(*validFor),
+		KeyUsage:    x509.KeyUsageDigitalSignature,
+		ExtKeyUsage: []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	}
+	if *email != "" {
+		clientTemplate.EmailAddresses = []string{*email}
+	}
+	if _, err := writeCertificate(*out, "client", clientTemplate, nil, caCert, caKey); err != nil {
+		return err
+	}
+
+	fmt.Println("Wrote ca.pem, server.pem, server-key.pem, client.pem and client-key.pem to", *out)
+	fmt.Println("Start the server with:")
+	fmt.Printf("  TLS_CERT_FILE=%s TLS_KEY_FILE=%s MTLS_CLIENT_CA_FILE=%s MTLS_MODE=optional\n",
+		filepath.Join(*out, "server.pem"), filepath.Join(*out, "server-key.pem"), filepath.Join(*out, "ca.pem"))
+	fmt.Println("and call it with:")
+	fmt.Printf("  curl --cacert %s --cert %s --key %s https://localhost:8080/okCode\n",
+		filepath.Join(*out, "ca.pem"), filepath.Join(*out, "client.pem"), filepath.Join(*out, "client-key.pem"))
+	return nil
+}
+
+// writeCertificate signs template with parentKey (self-signed when parent is
+// nil), generating a key unless one is given, and writes <name>.pem and
+// <name>-key.pem.
+func writeCertificate(dir, name string, template *x509.Certificate, key *ecdsa.PrivateKey, parent *x509.Certificate, parentKey *ecdsa.PrivateKey) (*x509.Certificate, error) {
+	if key == nil {
+		var err error
+		if key, err = ecdsa.GenerateKey(elliptic.P256(), rand.Reader); err != nil {
+			return nil, err
+		}
+	}
+	serial, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+	if err != nil {
+		return nil, err
+	}
+	template.SerialNumber = serial
+	if parent == nil {
+		parent, parentKey = template, key
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, template, parent, &key.PublicKey, parentKey)
+	if err != nil {
+		return nil, err
+	}
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		return nil, err
+	}
+	certPEM := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})
+	keyPEM := pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER})
+	if err := os.WriteFile(filepath.Join(dir, name+".pem"), certPEM, 0o644); err != nil {
+		return nil, err
+	}
+	if err := os.WriteFile(filepath.Join(dir, name+"-key.pem"), keyPEM, 0o600); err != nil {
+		return nil, err
+	}
+	return x509.ParseCertificate(der)
+}
@@ -0,0 +1,313 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/md5"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"hash"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Basic (RFC 7617) and Digest (RFC 7616) authentication for testing legacy
+// clients. Users come from HTTP_AUTH_USERS, e.g. "aminespinoza:secret;marcela:pw".
+// Passwords are kept in clear because Digest needs them to compute its
+// hashes; this is meant for test setups only.
+const digestNonceTTL = 5 * time.Minute
+
+// httpAuthScheme says which header carries credentials and how to challenge.
+// A real authenticating proxy uses Proxy-Authorization and 407 instead of
+// Authorization and 401.
+type httpAuthScheme struct {
+	Header          string
+	ChallengeHeader string
+	Status          int
+	Basic           bool
+	Digest          bool
+}
+
+var (
+	schemeBasic  = httpAuthScheme{"Authorization", "WWW-Authenticate", http.StatusUnauthorized, true, false}
+	schemeDigest = httpAuthScheme{"Authorization", "WWW-Authenticate", http.StatusUnauthorized, false, true}
+	schemeHTTP   = httpAuthScheme{"Authorization", "WWW-Authenticate", http.StatusUnauthorized, true, true}
+	schemeProxy  = httpAuthScheme{"Proxy-Authorization", "Proxy-Authenticate", http.StatusProxyAuthRequired, true, true}
+)
+
+// digestAlgorithms are offered in order of preference.
+var digestAlgorithms = []struct {
+	Name string
+	New  func() hash.Hash
+}{
+	{"SHA-256", sha256.New},
+	{"MD5", md5.New},
+}
+
+var httpAuthUsers = map[string]string{}
+
+// digestNonceKey signs nonces and must never be sent to clients. opaque is
+// a separate random value, since RFC 7616 has clients echo it back verbatim.
+var (
+	digestNonceKey = randomBytes(32)
+	digestOpaque   = hex.EncodeToString(randomBytes(8))
+)
+
+// dummyBasicPassword is compared against for unknown Basic users.
+const dummyBasicPassword = "unknown-user-dummy-password"
+
+func randomBytes(n int) []byte {
+	b := make([]byte, n)
+	if _, err := rand.Read(b); err != nil {
+		panic(err)
+	}
+	return b
+}
+
+// digestCounts remembers the highest nonce count seen per nonce, so a
+// captured Authorization header cannot be replayed.
+var digestCounts = struct {
+	sync.Mutex
+	seen map[string]uint64
+}{seen: map[string]uint64{}}
+
+func loadHTTPAuthUsers() (map[string]string, error) {
+	users := map[string]string{}
+	v := os.Getenv("HTTP_AUTH_USERS")
+	for _, entry := range strings.Split(v, ";") {
+		if strings.TrimSpace(entry) == "" {
+			continue
+		}
+		username, password, ok := strings.Cut(entry, ":")
+		username = strings.TrimSpace(username)
+		if !ok || username == "" || password == "" {
+			return nil, fmt.Errorf("HTTP_AUTH_USERS: expected username:password but got %q", entry)
+		}
+		users[username] = password
+	}
+	return users, nil
+}
+
+// httpAuth authenticates with Basic and/or Digest credentials from the
+// scheme's header, answering with the scheme's status and challenges.
+func httpAuth(scheme httpAuthScheme, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		value := r.Header.Get(scheme.Header)
+		authScheme, credentials, _ := strings.Cut(value, " ")
+
+		var principal *Principal
+		stale := false
+		switch {
+		case scheme.Basic && strings.EqualFold(authScheme, "Basic"):
+			principal = checkBasic(credentials)
+		case scheme.Digest && strings.EqualFold(authScheme, "Digest"):
+			principal, stale = checkDigest(r, credentials)
+		}
+		if principal == nil {
+			writeHTTPAuthChallenge(w, scheme, stale)
+			return
+		}
+		next.ServeHTTP(w, r.WithContext(contextWithPrincipal(r.Context(), principal)))
+	})
+}
+
+func writeHTTPAuthChallenge(w http.ResponseWriter, scheme httpAuthScheme, stale bool) {
+	if scheme.Digest {
+		nonce := newDigestNonce()
+		for _, alg := range digestAlgorithms {
+			challenge := fmt.Sprintf("Digest realm=%q, qop=\"auth\", algorithm=%s, nonce=%q, opaque=%q", authRealm, alg.Name, nonce, digestOpaque)
+			if stale {
+				challenge += ", stale=true"
+			}
+			w.Header().Add(scheme.ChallengeHeader, challenge)
+		}
+	}
+	if scheme.Basic {
+		w.Header().Add(scheme.ChallengeHeader, fmt.Sprintf("Basic realm=%q, charset=\"UTF-8\"", authRealm))
+	}
+	http.Error(w, http.StatusText(scheme.Status), scheme.Status)
+}
+
+func httpAuthPrincipal(username string) *Principal {
+	return &Principal{Subject: username, Username: username, Roles: rolesFor(username)}
+}
+
+func checkBasic(credentials string) *Principal {
+	decoded, err := base64.StdEncoding.DecodeString(strings.TrimSpace(credentials))
+	if err != nil {
+		return nil
+	}
+	username, password, ok := strings.Cut(string(decoded), ":")
+	if !ok {
+		return nil
+	}
+	expected, known := httpAuthUsers[username]
+	if !known {
+		// Compare anyway so unknown users take as long as wrong passwords.
+		expected = dummyBasicPassword
+	}
+	if subtle.ConstantTimeCompare([]byte(password), []byte(expected)) != 1 || !known {
+		return nil
+	}
+	return httpAuthPrincipal(username)
+}
+
+// newDigestNonce returns base64(timestamp || HMAC(timestamp)), so nonces
+// need no server-side storage and their age can be checked.
+func newDigestNonce() string {
+	var ts [8]byte
+	binary.BigEndian.PutUint64(ts[:], uint64(time.Now().Unix()))
+	mac := hmac.New(sha256.New, digestNonceKey)
+	mac.Write(ts[:])
+	return base64.RawURLEncoding.EncodeToString(append(ts[:], mac.Sum(nil)...))
+}
+
+// checkDigestNonce reports whether the nonce was issued by this server and,
+// if so, whether it is too old to use.
+func checkDigestNonce(nonce string) (valid, stale bool) {
+	raw, err := base64.RawURLEncoding.DecodeString(nonce)
+	if err != nil || len(raw) != 8+sha256.Size {
+		return false, false
+	}
+	mac := hmac.New(sha256.New, digestNonceKey)
+	mac.Write(raw[:8])
+	if !hmac.Equal(mac.Sum(nil), raw[8:]) {
+		return false, false
+	}
+	issued := time.Unix(int64(binary.BigEndian.Uint64(raw[:8])), 0)
+	return true, time.Since(issued) > digestNonceTTL
+}
+
+// checkDigest verifies a Digest response. stale is true when the
+// credentials were right but the nonce expired, telling the client to retry
+// with the fresh nonce without asking the user again.
+func checkDigest(r *http.Request, credentials string) (principal *Principal, stale bool) {
+	params, err := parseAuthParams(credentials)
+	if err != nil {
+		return nil, false
+	}
+	username, nonce, uri := params["username"], params["nonce"], params["uri"]
+	nc, cnonce, qop := params["nc"], params["cnonce"], params["qop"]
+	// Through a proxy the request line holds an absolute URI, but clients
+	// usually sign only its path, so either form is accepted.
+	if uri != r.RequestURI && uri != r.URL.RequestURI() {
+		return nil, false
+	}
+	if params["realm"] != authRealm || qop != "auth" || nc == "" || cnonce == "" {
+		return nil, false
+	}
+	password, known := httpAuthUsers[username]
+	if !known {
+		return nil, false
+	}
+	valid, expired := checkDigestNonce(nonce)
+	if !valid {
+		return nil, false
+	}
+
+	algorithm := params["algorithm"]
+	if algorithm == "" {
+		algorithm = "MD5"
+	}
+	session := strings.HasSuffix(strings.ToUpper(algorithm), "-SESS")
+	var newHash func() hash.Hash
+	for _, alg := range digestAlgorithms {
+		if strings.EqualFold(strings.TrimSuffix(strings.ToUpper(algorithm), "-SESS"), alg.Name) {
+			newHash = alg.New
+		}
+	}
+	if newHash == nil {
+		return nil, false
+	}
+	h := func(parts ...string) string {
+		d := newHash()
+		d.Write([]byte(strings.Join(parts, ":")))
+		return hex.EncodeToString(d.Sum(nil))
+	}
+
+	ha1 := h(username, authRealm, password)
+	if session {
+		ha1 = h(ha1, nonce, cnonce)
+	}
+	ha2 := h(r.Method, uri)
+	expected := h(ha1, nonce, nc, cnonce, qop, ha2)
+	if subtle.ConstantTimeCompare([]byte(expected), []byte(strings.ToLower(params["response"]))) != 1 {
+		return nil, false
+	}
+	if expired {
+		return nil, true
+	}
+
+	var count uint64
+	if _, err := fmt.Sscanf(nc, "%x", &count); err != nil || !acceptDigestCount(nonce, count) {
+		return nil, false
+	}
+	return httpAuthPrincipal(username), false
+}
+
+func acceptDigestCount(nonce string, count uint64) bool {
+	digestCounts.Lock()
+	defer digestCounts.Unlock()
+	if count <= digestCounts.seen[nonce] {
+		return false
+	}
+	// Forget nonces that can no longer be used. A nonce's age is encoded in
+	// it, so expired entries can be found without extra bookkeeping.
+	if len(digestCounts.seen) > 1000 {
+		for n := range digestCounts.seen {
+			if _, stale := checkDigestNonce(n); stale {
+				delete(digestCounts.seen, n)
+			}
+		}
+	}
+	digestCounts.seen[nonce] = count
+	return true
+}
+
+// parseAuthParams parses the comma-separated key=value list of an
+// Authorization header, where values may be quoted strings with \ escapes.
+func parseAuthParams(s string) (map[string]string, error) {
+	params := map[string]string{}
+	for {
+		s = strings.TrimLeft(s, " \t,")
+		if s == "" {
+			return params, nil
+		}
+		eq := strings.IndexByte(s, '=')
+		if eq <= 0 {
+			return nil, fmt.Errorf("malformed auth parameter near %q", s)
+		}
+		key := strings.ToLower(strings.TrimSpace(s[:eq]))
+		s = strings.TrimLeft(s[eq+1:], " \t")
+
+		var value string
+		if strings.HasPrefix(s, `"`) {
+			var b strings.Builder
+			i := 1
+			for ; i < len(s) && s[i] != '"'; i++ {
+				if s[i] == '\\' && i+1 < len(s) {
+					i++
+				}
+				b.WriteByte(s[i])
+			}
+			if i >= len(s) {
+				return nil, fmt.Errorf("unterminated quoted string for %s", key)
+			}
+			value, s = b.String(), s[i+1:]
+		} else {
+			end := strings.IndexByte(s, ',')
+			if end < 0 {
+				end = len(s)
+			}
+			value, s = strings.TrimSpace(s[:end]), s[end:]
+		}
+		params[key] = value
+	}
+}
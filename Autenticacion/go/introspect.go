@@ -0,0 +1,178 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"strings"
+
+	"github.com/golang-jwt/jwt/v5"
+)
+
+// IntrospectionResponse is the RFC 7662 response. Inactive tokens only carry
+// active=false.
+type IntrospectionResponse struct {
+	Active    bool   `json:"active"`
+	Scope     string `json:"scope,omitempty"`
+	ClientID  string `json:"client_id,omitempty"`
+	Username  string `json:"username,omitempty"`
+	TokenType string `json:"token_type,omitempty"`
+	Exp       int64  `json:"exp,omitempty"`
+	Iat       int64  `json:"iat,omitempty"`
+	Nbf       int64  `json:"nbf,omitempty"`
+	Sub       string `json:"sub,omitempty"`
+	Aud       string `json:"aud,omitempty"`
+	Iss       string `json:"iss,omitempty"`
+	Jti       string `json:"jti,omitempty"`
+}
+
+// parseTokenForm handles what /introspect and /revoke share: a POST form with
+// a token, sent by an authenticated confidential client.
+func parseTokenForm(w http.ResponseWriter, r *http.Request) (*OAuthClient, string, bool) {
+	if r.Method != http.MethodPost {
+		w.Header().Set("Allow", http.MethodPost)
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return nil, "", false
+	}
+	if err := r.ParseForm(); err != nil {
+		writeOAuthError(w, http.StatusBadRequest, "invalid_request", "Body must be application/x-www-form-urlencoded")
+		return nil, "", false
+	}
+	client, ok := authenticateClient(w, r)
+	if !ok {
+		return nil, "", false
+	}
+	if client.isPublic() {
+		writeOAuthError(w, http.StatusUnauthorized, "invalid_client", "Public clients cannot call this endpoint")
+		return nil, "", false
+	}
+	token := r.PostForm.Get("token")
+	if token == "" {
+		writeOAuthError(w, http.StatusBadRequest, "invalid_request", "token is required")
+		return nil, "", false
+	}
+	return client, token, true
+}
+
+func claimUnix(get func() (*jwt.NumericDate, error)) int64 {
+	d, err := get()
+	if err != nil || d == nil {
+		return 0
+	}
+	return d.Unix()
+}
+
+func introspectAccessToken(token string) (IntrospectionResponse, bool) {
+	_, claims, err := parseJWT(token)
+	if err != nil {
+		return IntrospectionResponse{}, false
+	}
+	resp := IntrospectionResponse{
+		Active:    true,
+		TokenType: "Bearer",
+		Exp:       claimUnix(claims.GetExpirationTime),
+		Iat:       claimUnix(claims.GetIssuedAt),
+		Nbf:       claimUnix(claims.GetNotBefore),
+		Aud:       jwtOptions.Audience,
+	}
+	resp.Scope, _ = claims["scope"].(string)
+	resp.ClientID, _ = claims["client_id"].(string)
+	resp.Username, _ = claims["username"].(string)
+	resp.Sub, _ = claims.GetSubject()
+	resp.Iss, _ = claims.GetIssuer()
+	resp.Jti, _ = claims["jti"].(string)
+	return resp, true
+}
+
+func introspectRefreshToken(token string) (IntrospectionResponse, bool) {
+	rt, ok := oauth.peekRefreshToken(token)
+	if !ok {
+		return IntrospectionResponse{}, false
+	}
+	sub := rt.Username
+	if sub == "" {
+		sub = rt.ClientID
+	}
+	return IntrospectionResponse{
+		Active:    true,
+		Scope:     strings.Join(rt.Scope, " "),
+		ClientID:  rt.ClientID,
+		Username:  rt.Username,
+		TokenType: "refresh_token",
+		Exp:       rt.ExpiresAt.Unix(),
+		Sub:       sub,
+		Iss:       issuerURL(),
+	}, true
+}
+
+// introspectHandler godoc
+// @Summary Token introspection
+// @Description RFC 7662. Reports whether an access or refresh token is active, applying the same checks as jwtMiddleware. Requires confidential client authentication.
+// @Tags oauth
+// @Accept x-www-form-urlencoded
+// @Produce json
+// @Param token formData string true "Token to inspect"
+// @Param token_type_hint formData string false "access_token or refresh_token"
+// @Success 200 {object} IntrospectionResponse
+// @Failure 401 {object} OAuthError
+// @Router /introspect [post]
+func introspectHandler(w http.ResponseWriter, r *http.Request) {
+	_, token, ok := parseTokenForm(w, r)
+	if !ok {
+		return
+	}
+
+	lookups := []func(string) (IntrospectionResponse, bool){introspectAccessToken, introspectRefreshToken}
+	if r.PostForm.Get("token_type_hint") == "refresh_token" {
+		lookups[0], lookups[1] = lookups[1], lookups[0]
+	}
+	resp := IntrospectionResponse{Active: false}
+	for _, lookup := range lookups {
+		if found, ok := lookup(token); ok {
+			resp = found
+			break
+		}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	json.NewEncoder(w).Encode(resp)
+}
+
+// revokeHandler godoc
+// @Summary Token revocation
+// @Description RFC 7009. Revokes an access or refresh token issued to the calling client. Unknown or already invalid tokens are accepted silently.
+// @Tags oauth
+// @Accept x-www-form-urlencoded
+// @Param token formData string true "Token to revoke"
+// @Param token_type_hint formData string false "access_token or refresh_token"
+// @Success 200
+// @Failure 400 {object} OAuthError
+// @Failure 401 {object} OAuthError
+// @Router /revoke [post]
+func revokeHandler(w http.ResponseWriter, r *http.Request) {
+	client, token, ok := parseTokenForm(w, r)
+	if !ok {
+		return
+	}
+
+	if rt, ok := oauth.peekRefreshToken(token); ok {
+		if rt.ClientID != client.ClientID {
+			writeOAuthError(w, http.StatusBadRequest, "unauthorized_client", "Token was issued to another client")
+			return
+		}
+		oauth.revokeRefreshToken(token)
+	} else if _, claims, err := parseJWT(token); err == nil {
+		if clientID, _ := claims["client_id"].(string); clientID != client.ClientID {
+			writeOAuthError(w, http.StatusBadRequest, "unauthorized_client", "Token was issued to another client")
+			return
+		}
+		jti, _ := claims["jti"].(string)
+		exp, err := claims.GetExpirationTime()
+		if jti != "" && err == nil && exp != nil {
+			oauth.revokeAccessToken(jti, exp.Time.Add(jwtOptions.Leeway))
+		}
+	}
+
+	w.Header().Set("Cache-Control", "no-store")
+	w.WriteHeader(http.StatusOK)
+}
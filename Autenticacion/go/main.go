@@ -1,39 +1,16 @@
 package main
 
 import (
+	"context"
 	"fmt"
 	"net/http"
 	"os"
-	"strings"
 	_ "swagger/docs"
-	"time"
 
-	"github.com/golang-jwt/jwt/v5"
 	"github.com/joho/godotenv"
 	httpSwagger "github.com/swaggo/http-swagger"
 )
 
-var jwtSecret []byte
-
-func jwtMiddleware(next http.Handler) http.Handler {
-	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		authHeader := r.Header.Get("Authorization")
-		if !strings.HasPrefix(authHeader, "Bearer ") {
-			http.Error(w, "Unauthorized", http.StatusUnauthorized)
-			return
-		}
-		tokenString := strings.TrimPrefix(authHeader, "Bearer ")
-		token, err := jwt.Parse(tokenString, func(token *jwt.Token) (interface{}, error) {
-			return jwtSecret, nil
-		})
-		if err != nil || !token.Valid {
-			http.Error(w, "Unauthorized", http.StatusUnauthorized)
-			return
-		}
-		next.ServeHTTP(w, r)
-	})
-}
-
 // loginHandler godoc
 // @Summary Generate JWT token
 // @Description Returns a JWT token for a given username
@@ -57,14 +34,6 @@ func loginHandler(w http.ResponseWriter, r *http.Request) {
 	w.Write([]byte(token))
 }
 
-func generateJWT(username string) (string, error) {
-	token := jwt.NewWithClaims(jwt.SigningMethodHS256, jwt.MapClaims{
-		"username": username,
-		"exp":      time.Now().Add(time.Hour * 1).Unix(),
-	})
-	return token.SignedString(jwtSecret)
-}
-
 // okCodeHandler godoc
 // @Summary Returns OK status
 // @Description Responds with HTTP 200 and a message
@@ -132,17 +101,27 @@ func notFoundHandler(w http.ResponseWriter, r *http.Request) {
 }
 
 // proxyRequiredHandler godoc
-// @Summary Returns Proxy Authentication Required status
-// @Description Responds with HTTP 407 and a message
+// @Summary Behaves like an authenticating proxy
+// @Description Responds with HTTP 407 and Basic and Digest Proxy-Authenticate challenges until valid Proxy-Authorization credentials from HTTP_AUTH_USERS are sent, then with HTTP 200
 // @Tags codes
-// @Success 407 {string} string "Proxy authentication required."
+// @Param Proxy-Authorization header string false "Basic or Digest proxy credentials"
+// @Success 200 {string} string "Proxy authentication accepted."
+// @Failure 407 {string} string "Proxy Authentication Required"
 // @Router /proxyRequired [get]
 func proxyRequiredHandler(w http.ResponseWriter, r *http.Request) {
-	w.WriteHeader(http.StatusProxyAuthRequired)
-	fmt.Fprintln(w, "Proxy authentication required.")
+	w.WriteHeader(http.StatusOK)
+	fmt.Fprintln(w, "Proxy authentication accepted.")
 }
 
 func main() {
+	if len(os.Args) > 1 && os.Args[1] == "devcerts" {
+		if err := runDevCerts(os.Args[2:]); err != nil {
+			fmt.Println("devcerts:", err)
+			os.Exit(1)
+		}
+		return
+	}
+
 	err := godotenv.Load()
 	if err != nil {
 		fmt.Println(".env file not found or failed to load")
@@ -154,17 +133,88 @@ func main() {
 	}
 	jwtSecret = []byte(secret)
 
+	jwtOptions, err = loadJWTOptions()
+	if err != nil {
+		fmt.Println(err)
+		return
+	}
+	userRoles, err = loadUserRoles()
+	if err != nil {
+		fmt.Println(err)
+		return
+	}
+	oauthScopes = loadOAuthScopes()
+
+	emailKey, err = loadEmailKey()
+	if err != nil {
+		fmt.Println(err)
+		return
+	}
+	db, err = openDB(context.Background())
+	if err != nil {
+		fmt.Println(err)
+		return
+	}
+	if db != nil {
+		defer db.Close()
+	}
+	oidcSigningKey, err = loadOIDCSigningKey()
+	if err != nil {
+		fmt.Println(err)
+		return
+	}
+	oidcKeyID = jwkThumbprint(publicJWK(&oidcSigningKey.PublicKey))
+
+	tlsConfig, err = loadTLSSettings()
+	if err != nil {
+		fmt.Println(err)
+		return
+	}
+	httpAuthUsers, err = loadHTTPAuthUsers()
+	if err != nil {
+		fmt.Println(err)
+		return
+	}
+	routeAuth, err = loadRouteAuth()
+	if err != nil {
+		fmt.Println(err)
+		return
+	}
+	serverTLS, err := serverTLSConfig(tlsConfig)
+	if err != nil {
+		fmt.Println(err)
+		return
+	}
+
 	http.Handle("/login", http.HandlerFunc(loginHandler))
-	http.Handle("/okCode", jwtMiddleware(http.HandlerFunc(okCodeHandler)))
-	http.Handle("/continueCode", jwtMiddleware(http.HandlerFunc(continueCodeHandler)))
-	http.Handle("/movedPermanently", jwtMiddleware(http.HandlerFunc(movedPemanentlyHandler)))
-	http.Handle("/badRequest", jwtMiddleware(http.HandlerFunc(badRequestHandler)))
-	http.Handle("/forbidden", jwtMiddleware(http.HandlerFunc(forbiddenHandler)))
-	http.Handle("/notFound", jwtMiddleware(http.HandlerFunc(notFoundHandler)))
-	http.Handle("/proxyRequired", jwtMiddleware(http.HandlerFunc(proxyRequiredHandler)))
+	http.HandleFunc("/register", registerClientHandler)
+	http.HandleFunc("/authorize", authorizeHandler)
+	http.HandleFunc("/token", tokenHandler)
+	http.HandleFunc("/introspect", introspectHandler)
+	http.HandleFunc("/revoke", revokeHandler)
+	http.HandleFunc("/.well-known/oauth-authorization-server", oauthMetadataHandler)
+	http.HandleFunc("/.well-known/openid-configuration", openIDConfigurationHandler)
+	http.HandleFunc("/.well-known/jwks.json", jwksHandler)
+	http.Handle("/userinfo", jwtMiddleware(http.HandlerFunc(userInfoHandler)))
+	http.Handle("/okCode", authenticate("/okCode", http.HandlerFunc(okCodeHandler)))
+	http.Handle("/continueCode", authenticate("/continueCode", http.HandlerFunc(continueCodeHandler)))
+	http.Handle("/movedPermanently", authenticate("/movedPermanently", http.HandlerFunc(movedPemanentlyHandler)))
+	http.Handle("/badRequest", authenticate("/badRequest", http.HandlerFunc(badRequestHandler)))
+	http.Handle("/forbidden", authenticate("/forbidden", http.HandlerFunc(forbiddenHandler)))
+	http.Handle("/notFound", authenticate("/notFound", http.HandlerFunc(notFoundHandler)))
+	http.Handle("/proxyRequired", authenticate("/proxyRequired", http.HandlerFunc(proxyRequiredHandler)))
 
 	http.HandleFunc("/swagger/", httpSwagger.WrapHandler)
 
+	if serverTLS != nil {
+		server := &http.Server{Addr: ":8080", TLSConfig: serverTLS}
+		fmt.Printf("Starting HTTPS server at :8080 (client certificates: %s)...\n", tlsConfig.MTLSMode)
+		if err := server.ListenAndServeTLS(tlsConfig.CertFile, tlsConfig.KeyFile); err != nil {
+			fmt.Println("Server failed:", err)
+		}
+		return
+	}
+
 	fmt.Println("Starting server at :8080...")
 	if err := http.ListenAndServe(":8080", nil); err != nil {
 		fmt.Println("Server failed:", err)
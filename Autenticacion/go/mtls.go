@@ -0,0 +1,153 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"strings"
+)
+
+// The server speaks HTTPS when TLS_CERT_FILE and TLS_KEY_FILE are set. Client
+// certificates are then controlled by MTLS_MODE:
+//
+//	off       never asked for (the default)
+//	optional  verified against MTLS_CLIENT_CA_FILE when the client sends one
+//	require   the handshake fails without a valid certificate
+//
+// A verified certificate maps to a Principal through MTLS_IDENTITY (cn,
+// dns, email or uri: the subject common name or the first SAN of that type)
+// and gets roles from USER_ROLES like any other username.
+const (
+	mtlsOff      = "off"
+	mtlsOptional = "optional"
+	mtlsRequire  = "require"
+)
+
+type tlsSettings struct {
+	CertFile     string
+	KeyFile      string
+	ClientCAFile string
+	MTLSMode     string
+	Identity     string
+}
+
+var tlsConfig = tlsSettings{MTLSMode: mtlsOff, Identity: "cn"}
+
+var errNoIdentity = errors.New("client certificate has no usable identity")
+
+func loadTLSSettings() (tlsSettings, error) {
+	s := tlsSettings{
+		CertFile:     os.Getenv("TLS_CERT_FILE"),
+		KeyFile:      os.Getenv("TLS_KEY_FILE"),
+		ClientCAFile: os.Getenv("MTLS_CLIENT_CA_FILE"),
+		MTLSMode:     os.Getenv("MTLS_MODE"),
+		Identity:     strings.ToLower(os.Getenv("MTLS_IDENTITY")),
+	}
+	if s.MTLSMode == "" {
+		s.MTLSMode = mtlsOff
+	}
+	if s.Identity == "" {
+		s.Identity = "cn"
+	}
+	if (s.CertFile == "") != (s.KeyFile == "") {
+		return s, fmt.Errorf("TLS_CERT_FILE and TLS_KEY_FILE must be set together")
+	}
+	switch s.MTLSMode {
+	case mtlsOff:
+	case mtlsOptional, mtlsRequire:
+		if s.CertFile == "" {
+			return s, fmt.Errorf("MTLS_MODE=%s needs TLS_CERT_FILE and TLS_KEY_FILE", s.MTLSMode)
+		}
+		if s.ClientCAFile == "" {
+			return s, fmt.Errorf("MTLS_MODE=%s needs MTLS_CLIENT_CA_FILE", s.MTLSMode)
+		}
+	default:
+		return s, fmt.Errorf("MTLS_MODE must be off, optional or require, got %q", s.MTLSMode)
+	}
+	switch s.Identity {
+	case "cn", "dns", "email", "uri":
+	default:
+		return s, fmt.Errorf("MTLS_IDENTITY must be cn, dns, email or uri, got %q", s.Identity)
+	}
+	return s, nil
+}
+
+// serverTLSConfig builds the listener's TLS configuration, or returns nil
+// when the server should speak plain HTTP.
+func serverTLSConfig(s tlsSettings) (*tls.Config, error) {
+	if s.CertFile == "" {
+		return nil, nil
+	}
+	cfg := &tls.Config{MinVersion: tls.VersionTLS12}
+	if s.MTLSMode == mtlsOff {
+		return cfg, nil
+	}
+
+	pem, err := os.ReadFile(s.ClientCAFile)
+	if err != nil {
+		return nil, fmt.Errorf("MTLS_CLIENT_CA_FILE: %w", err)
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(pem) {
+		return nil, fmt.Errorf("MTLS_CLIENT_CA_FILE: no PEM certificates found")
+	}
+	cfg.ClientCAs = pool
+	cfg.ClientAuth = tls.VerifyClientCertIfGiven
+	if s.MTLSMode == mtlsRequire {
+		cfg.ClientAuth = tls.RequireAndVerifyClientCert
+	}
+	return cfg, nil
+}
+
+// certificateIdentity picks the username a client certificate stands for.
+func certificateIdentity(cert *x509.Certificate) (string, error) {
+	var id string
+	switch tlsConfig.Identity {
+	case "cn":
+		id = cert.Subject.CommonName
+	case "dns":
+		if len(cert.DNSNames) > 0 {
+			id = cert.DNSNames[0]
+		}
+	case "email":
+		if len(cert.EmailAddresses) > 0 {
+			id = cert.EmailAddresses[0]
+		}
+	case "uri":
+		if len(cert.URIs) > 0 {
+			id = cert.URIs[0].String()
+		}
+	}
+	if strings.TrimSpace(id) == "" {
+		return "", errNoIdentity
+	}
+	return id, nil
+}
+
+// principalFromCertificate returns the principal for the request's verified
+// client certificate, or nil when there is none. The handshake has already
+// checked the chain against MTLS_CLIENT_CA_FILE, so only verified chains are
+// considered.
+func principalFromCertificate(r *http.Request) (*Principal, error) {
+	if r.TLS == nil || len(r.TLS.VerifiedChains) == 0 || len(r.TLS.VerifiedChains[0]) == 0 {
+		return nil, nil
+	}
+	cert := r.TLS.VerifiedChains[0][0]
+	username, err := certificateIdentity(cert)
+	if err != nil {
+		return nil, err
+	}
+	return &Principal{
+		Subject:           cert.Subject.String(),
+		Username:          username,
+		Roles:             rolesFor(username),
+		ClientCertificate: cert,
+	}, nil
+}
+
+func writeCertificateRequired(w http.ResponseWriter, description string) {
+	http.Error(w, "Unauthorized: "+description, http.StatusUnauthorized)
+}
@@ -0,0 +1,518 @@
+package main
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// The OAuth2 authorization server keeps clients, codes and refresh tokens in
+// memory. It is meant for exercising OAuth client libraries locally, so
+// everything is lost on restart.
+
+const (
+	authCodeTTL     = 10 * time.Minute
+	consentTTL      = 10 * time.Minute
+	refreshTokenTTL = 30 * 24 * time.Hour
+
+	grantAuthorizationCode = "authorization_code"
+	grantClientCredentials = "client_credentials"
+	grantRefreshToken      = "refresh_token"
+
+	authMethodBasic = "client_secret_basic"
+	authMethodPost  = "client_secret_post"
+	authMethodNone  = "none"
+)
+
+// oauthScopes are the scopes clients may register for and request. Override
+// with OAUTH_SCOPES (space-delimited).
+var oauthScopes = []string{scopeOpenID, scopeProfile, scopeEmail, "codes:read"}
+
+var oauth = newOAuthStore()
+
+// OAuthClient is a registered client. SecretHash is the SHA-256 of the
+// client secret; public clients have none.
+type OAuthClient struct {
+	ClientID                string   `json:"client_id"`
+	ClientName              string   `json:"client_name,omitempty"`
+	RedirectURIs            []string `json:"redirect_uris,omitempty"`
+	GrantTypes              []string `json:"grant_types"`
+	ResponseTypes           []string `json:"response_types,omitempty"`
+	TokenEndpointAuthMethod string   `json:"token_endpoint_auth_method"`
+	Scope                   string   `json:"scope,omitempty"`
+	ClientIDIssuedAt        int64    `json:"client_id_issued_at"`
+	SecretHash              string   `json:"-"`
+}
+
+func (c *OAuthClient) allowsGrant(grant string) bool {
+	return containsString(c.GrantTypes, grant)
+}
+
+func (c *OAuthClient) isPublic() bool {
+	return c.TokenEndpointAuthMethod == authMethodNone
+}
+
+// ClientRegistration is an RFC 7591 registration request.
+type ClientRegistration struct {
+	ClientName              string   `json:"client_name"`
+	RedirectURIs            []string `json:"redirect_uris"`
+	GrantTypes              []string `json:"grant_types"`
+	ResponseTypes           []string `json:"response_types"`
+	TokenEndpointAuthMethod string   `json:"token_endpoint_auth_method"`
+	Scope                   string   `json:"scope"`
+}
+
+// RegisteredClient is the RFC 7591 registration response. ClientSecret is
+// only ever returned here.
+type RegisteredClient struct {
+	OAuthClient
+	ClientSecret          string `json:"client_secret,omitempty"`
+	ClientSecretExpiresAt int64  `json:"client_secret_expires_at"`
+}
+
+// OAuthError is the error body defined by RFC 6749 section 5.2.
+type OAuthError struct {
+	Error            string `json:"error"`
+	ErrorDescription string `json:"error_description,omitempty"`
+}
+
+// authorizationCode is an issued code awaiting exchange at /token.
+// RedirectURISent records that /authorize was given redirect_uri explicitly,
+// so /token must be given the same one (RFC 6749 section 4.1.3).
+type authorizationCode struct {
+	ClientID            string
+	RedirectURI         string
+	RedirectURISent     bool
+	Username            string
+	Scope               []string
+	CodeChallenge       string
+	CodeChallengeMethod string
+	Nonce               string
+	AuthTime            time.Time
+	ExpiresAt           time.Time
+}
+
+type refreshToken struct {
+	ClientID  string
+	Username  string
+	Scope     []string
+	AuthTime  time.Time
+	ExpiresAt time.Time
+}
+
+// authorizationRequest is a validated /authorize request waiting for the
+// user's consent.
+type authorizationRequest struct {
+	Client              *OAuthClient
+	RedirectURI         string
+	RedirectURISent     bool
+	Scope               []string
+	State               string
+	Nonce               string
+	CodeChallenge       string
+	CodeChallengeMethod string
+	ExpiresAt           time.Time
+}
+
+type oauthStore struct {
+	mu       sync.Mutex
+	clients  map[string]*OAuthClient
+	codes    map[string]*authorizationCode
+	refresh  map[string]*refreshToken
+	consents map[string]*authorizationRequest
+	// revoked maps the jti of a revoked access token to its expiry, after
+	// which it no longer needs tracking.
+	revoked map[string]time.Time
+}
+
+func newOAuthStore() *oauthStore {
+	return &oauthStore{
+		clients:  map[string]*OAuthClient{},
+		codes:    map[string]*authorizationCode{},
+		refresh:  map[string]*refreshToken{},
+		consents: map[string]*authorizationRequest{},
+		revoked:  map[string]time.Time{},
+	}
+}
+
+func (s *oauthStore) client(id string) (*OAuthClient, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	c, ok := s.clients[id]
+	return c, ok
+}
+
+func (s *oauthStore) addClient(c *OAuthClient) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.clients[c.ClientID] = c
+}
+
+func (s *oauthStore) addCode(code string, ac *authorizationCode) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.codes[code] = ac
+}
+
+// takeCode removes and returns a code so it can only be redeemed once.
+func (s *oauthStore) takeCode(code string) (*authorizationCode, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	ac, ok := s.codes[code]
+	delete(s.codes, code)
+	if !ok || time.Now().After(ac.ExpiresAt) {
+		return nil, false
+	}
+	return ac, true
+}
+
+func (s *oauthStore) addRefreshToken(token string, rt *refreshToken) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.refresh[token] = rt
+}
+
+// takeRefreshToken removes and returns a refresh token; the caller issues a
+// replacement, so refresh tokens rotate on every use.
+func (s *oauthStore) takeRefreshToken(token string) (*refreshToken, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	rt, ok := s.refresh[token]
+	delete(s.refresh, token)
+	if !ok || time.Now().After(rt.ExpiresAt) {
+		return nil, false
+	}
+	return rt, true
+}
+
+// peekRefreshToken returns a live refresh token without consuming it.
+func (s *oauthStore) peekRefreshToken(token string) (*refreshToken, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	rt, ok := s.refresh[token]
+	if !ok || time.Now().After(rt.ExpiresAt) {
+		return nil, false
+	}
+	return rt, true
+}
+
+func (s *oauthStore) revokeRefreshToken(token string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.refresh, token)
+}
+
+func (s *oauthStore) revokeAccessToken(jti string, expiresAt time.Time) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	now := time.Now()
+	for id, exp := range s.revoked {
+		if now.After(exp) {
+			delete(s.revoked, id)
+		}
+	}
+	s.revoked[jti] = expiresAt
+}
+
+func (s *oauthStore) isRevoked(jti string) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	_, ok := s.revoked[jti]
+	return ok
+}
+
+func (s *oauthStore) addConsent(id string, ar *authorizationRequest) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.consents[id] = ar
+}
+
+// consent returns a pending request without using it up, so a mistyped
+// password can be retried.
+func (s *oauthStore) consent(id string) (*authorizationRequest, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	ar, ok := s.consents[id]
+	if !ok || time.Now().After(ar.ExpiresAt) {
+		return nil, false
+	}
+	return ar, true
+}
+
+func (s *oauthStore) takeConsent(id string) (*authorizationRequest, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	ar, ok := s.consents[id]
+	delete(s.consents, id)
+	if !ok || time.Now().After(ar.ExpiresAt) {
+		return nil, false
+	}
+	return ar, true
+}
+
+func loadOAuthScopes() []string {
+	if v := os.Getenv("OAUTH_SCOPES"); v != "" {
+		return strings.Fields(v)
+	}
+	return oauthScopes
+}
+
+// issuerURL is the authorization server's issuer identifier. RFC 8414
+// requires it to be the URL the metadata is served under, so it doubles as
+// the base for every endpoint.
+func issuerURL() string {
+	return strings.TrimSuffix(jwtOptions.Issuer, "/")
+}
+
+func randomToken(n int) (string, error) {
+	b := make([]byte, n)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(b), nil
+}
+
+func hashSecret(secret string) string {
+	sum := sha256.Sum256([]byte(secret))
+	return hex.EncodeToString(sum[:])
+}
+
+func writeOAuthError(w http.ResponseWriter, status int, code, description string) {
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(OAuthError{Error: code, ErrorDescription: description})
+}
+
+func containsString(list []string, s string) bool {
+	for _, v := range list {
+		if v == s {
+			return true
+		}
+	}
+	return false
+}
+
+// resolveScope checks a requested space-delimited scope against the scopes
+// allowed for a client. An empty request gets everything allowed.
+func resolveScope(requested string, allowed []string) ([]string, bool) {
+	if strings.TrimSpace(requested) == "" {
+		return allowed, true
+	}
+	scopes := strings.Fields(requested)
+	for _, s := range scopes {
+		if !containsString(allowed, s) {
+			return nil, false
+		}
+	}
+	return scopes, true
+}
+
+// validRedirectURI accepts absolute URIs without a fragment, per RFC 6749
+// section 3.1.2.
+func validRedirectURI(raw string) bool {
+	u, err := url.Parse(raw)
+	return err == nil && u.IsAbs() && u.Host != "" && u.Fragment == ""
+}
+
+// registerClientHandler godoc
+// @Summary Register an OAuth2 client
+// @Description RFC 7591 dynamic client registration. Public clients use token_endpoint_auth_method "none" and must use PKCE.
+// @Tags oauth
+// @Accept json
+// @Produce json
+// @Param client body ClientRegistration true "Client metadata"
+// @Success 201 {object} RegisteredClient
+// @Failure 400 {object} OAuthError
+// @Router /register [post]
+func registerClientHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		w.Header().Set("Allow", http.MethodPost)
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	var reg ClientRegistration
+	if err := json.NewDecoder(r.Body).Decode(&reg); err != nil {
+		writeOAuthError(w, http.StatusBadRequest, "invalid_client_metadata", "Body must be a JSON object")
+		return
+	}
+
+	if len(reg.GrantTypes) == 0 {
+		reg.GrantTypes = []string{grantAuthorizationCode}
+	}
+	if reg.TokenEndpointAuthMethod == "" {
+		reg.TokenEndpointAuthMethod = authMethodBasic
+	}
+	switch reg.TokenEndpointAuthMethod {
+	case authMethodBasic, authMethodPost, authMethodNone:
+	default:
+		writeOAuthError(w, http.StatusBadRequest, "invalid_client_metadata", "Unsupported token_endpoint_auth_method")
+		return
+	}
+
+	for _, g := range reg.GrantTypes {
+		switch g {
+		case grantAuthorizationCode, grantRefreshToken:
+		case grantClientCredentials:
+			if reg.TokenEndpointAuthMethod == authMethodNone {
+				writeOAuthError(w, http.StatusBadRequest, "invalid_client_metadata", "Public clients cannot use client_credentials")
+				return
+			}
+		default:
+			writeOAuthError(w, http.StatusBadRequest, "invalid_client_metadata", "Unsupported grant type "+g)
+			return
+		}
+	}
+
+	if containsString(reg.GrantTypes, grantAuthorizationCode) {
+		if len(reg.RedirectURIs) == 0 {
+			writeOAuthError(w, http.StatusBadRequest, "invalid_redirect_uri", "redirect_uris is required for authorization_code")
+			return
+		}
+		reg.ResponseTypes = []string{"code"}
+	}
+	for _, uri := range reg.RedirectURIs {
+		if !validRedirectURI(uri) {
+			writeOAuthError(w, http.StatusBadRequest, "invalid_redirect_uri", "Redirect URIs must be absolute and have no fragment: "+uri)
+			return
+		}
+	}
+
+	scope := strings.Join(oauthScopes, " ")
+	if reg.Scope != "" {
+		scopes, ok := resolveScope(reg.Scope, oauthScopes)
+		if !ok {
+			writeOAuthError(w, http.StatusBadRequest, "invalid_client_metadata", "Unsupported scope")
+			return
+		}
+		scope = strings.Join(scopes, " ")
+	}
+
+	clientID, err := randomToken(16)
+	if err != nil {
+		writeOAuthError(w, http.StatusInternalServerError, "server_error", "Could not generate client id")
+		return
+	}
+	client := &OAuthClient{
+		ClientID:                clientID,
+		ClientName:              reg.ClientName,
+		RedirectURIs:            reg.RedirectURIs,
+		GrantTypes:              reg.GrantTypes,
+		ResponseTypes:           reg.ResponseTypes,
+		TokenEndpointAuthMethod: reg.TokenEndpointAuthMethod,
+		Scope:                   scope,
+		ClientIDIssuedAt:        time.Now().Unix(),
+	}
+	resp := RegisteredClient{OAuthClient: *client}
+	if !client.isPublic() {
+		secret, err := randomToken(32)
+		if err != nil {
+			writeOAuthError(w, http.StatusInternalServerError, "server_error", "Could not generate client secret")
+			return
+		}
+		client.SecretHash = hashSecret(secret)
+		resp.ClientSecret = secret
+	}
+	oauth.addClient(client)
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(resp)
+}
+
+// AuthorizationServerMetadata is the RFC 8414 discovery document.
+type AuthorizationServerMetadata struct {
+	Issuer                            string   `json:"issuer"`
+	AuthorizationEndpoint             string   `json:"authorization_endpoint"`
+	TokenEndpoint                     string   `json:"token_endpoint"`
+	RegistrationEndpoint              string   `json:"registration_endpoint"`
+	ScopesSupported                   []string `json:"scopes_supported"`
+	ResponseTypesSupported            []string `json:"response_types_supported"`
+	ResponseModesSupported            []string `json:"response_modes_supported"`
+	GrantTypesSupported               []string `json:"grant_types_supported"`
+	TokenEndpointAuthMethodsSupported []string `json:"token_endpoint_auth_methods_supported"`
+	CodeChallengeMethodsSupported     []string `json:"code_challenge_methods_supported"`
+	IntrospectionEndpoint             string   `json:"introspection_endpoint"`
+	RevocationEndpoint                string   `json:"revocation_endpoint"`
+}
+
+func authorizationServerMetadata() AuthorizationServerMetadata {
+	base := issuerURL()
+	return AuthorizationServerMetadata{
+		Issuer:                            base,
+		AuthorizationEndpoint:             base + "/authorize",
+		TokenEndpoint:                     base + "/token",
+		RegistrationEndpoint:              base + "/register",
+		ScopesSupported:                   oauthScopes,
+		ResponseTypesSupported:            []string{"code"},
+		ResponseModesSupported:            []string{"query"},
+		GrantTypesSupported:               []string{grantAuthorizationCode, grantClientCredentials, grantRefreshToken},
+		TokenEndpointAuthMethodsSupported: []string{authMethodBasic, authMethodPost, authMethodNone},
+		CodeChallengeMethodsSupported:     []string{"S256"},
+		IntrospectionEndpoint:             base + "/introspect",
+		RevocationEndpoint:                base + "/revoke",
+	}
+}
+
+// oauthMetadataHandler godoc
+// @Summary OAuth2 authorization server metadata
+// @Description RFC 8414 discovery document
+// @Tags oauth
+// @Produce json
+// @Success 200 {object} AuthorizationServerMetadata
+// @Router /.well-known/oauth-authorization-server [get]
+func oauthMetadataHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(authorizationServerMetadata())
+}
+
+// authenticateClient identifies the client calling the token endpoint using
+// client_secret_basic, client_secret_post or, for public clients, none.
+func authenticateClient(w http.ResponseWriter, r *http.Request) (*OAuthClient, bool) {
+	clientID, secret, basic := r.BasicAuth()
+	if basic {
+		// RFC 6749 section 2.3.1: both parts are form-encoded first.
+		var err1, err2 error
+		clientID, err1 = url.QueryUnescape(clientID)
+		secret, err2 = url.QueryUnescape(secret)
+		if err1 != nil || err2 != nil {
+			basic = false
+			clientID = ""
+		}
+	} else {
+		clientID = r.PostForm.Get("client_id")
+		secret = r.PostForm.Get("client_secret")
+	}
+
+	client, ok := oauth.client(clientID)
+	if ok {
+		switch client.TokenEndpointAuthMethod {
+		case authMethodNone:
+			ok = !basic && secret == ""
+		case authMethodBasic:
+			ok = basic && subtle.ConstantTimeCompare([]byte(hashSecret(secret)), []byte(client.SecretHash)) == 1
+		case authMethodPost:
+			ok = !basic && subtle.ConstantTimeCompare([]byte(hashSecret(secret)), []byte(client.SecretHash)) == 1
+		}
+	}
+	if !ok {
+		if basic {
+			w.Header().Set("WWW-Authenticate", fmt.Sprintf("Basic realm=%q", authRealm))
+		}
+		writeOAuthError(w, http.StatusUnauthorized, "invalid_client", "Client authentication failed")
+		return nil, false
+	}
+	return client, true
+}
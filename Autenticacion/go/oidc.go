@@ -0,0 +1,248 @@
+package main
+
+import (
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"math/big"
+	"net/http"
+	"os"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+)
+
+const (
+	scopeOpenID  = "openid"
+	scopeProfile = "profile"
+	scopeEmail   = "email"
+)
+
+// ID tokens are signed with RS256 so relying parties can verify them through
+// the JWKS document without sharing JWT_SECRET. Access tokens keep using
+// JWT_SECRET.
+var oidcSigningKey *rsa.PrivateKey
+var oidcKeyID string
+
+// loadOIDCSigningKey reads the PEM private key named by OIDC_SIGNING_KEY_FILE.
+// Without it a throwaway key is generated, so ID tokens issued before a
+// restart stop validating.
+func loadOIDCSigningKey() (*rsa.PrivateKey, error) {
+	path := os.Getenv("OIDC_SIGNING_KEY_FILE")
+	if path == "" {
+		fmt.Println("OIDC_SIGNING_KEY_FILE not set, generating a temporary ID token signing key")
+		return rsa.GenerateKey(rand.Reader, 2048)
+	}
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("OIDC_SIGNING_KEY_FILE: %w", err)
+	}
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return nil, errors.New("OIDC_SIGNING_KEY_FILE does not contain a PEM block")
+	}
+	if key, err := x509.ParsePKCS1PrivateKey(block.Bytes); err == nil {
+		return key, nil
+	}
+	parsed, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+	if err != nil {
+		return nil, fmt.Errorf("OIDC_SIGNING_KEY_FILE: %w", err)
+	}
+	key, ok := parsed.(*rsa.PrivateKey)
+	if !ok {
+		return nil, errors.New("OIDC_SIGNING_KEY_FILE must hold an RSA private key")
+	}
+	return key, nil
+}
+
+// JSONWebKey is the public half of the ID token signing key (RFC 7517).
+type JSONWebKey struct {
+	Kty string `json:"kty"`
+	Use string `json:"use"`
+	Alg string `json:"alg"`
+	Kid string `json:"kid"`
+	N   string `json:"n"`
+	E   string `json:"e"`
+}
+
+type JSONWebKeySet struct {
+	Keys []JSONWebKey `json:"keys"`
+}
+
+func publicJWK(key *rsa.PublicKey) JSONWebKey {
+	return JSONWebKey{
+		Kty: "RSA",
+		Use: "sig",
+		Alg: "RS256",
+		N:   base64.RawURLEncoding.EncodeToString(key.N.Bytes()),
+		E:   base64.RawURLEncoding.EncodeToString(big.NewInt(int64(key.E)).Bytes()),
+	}
+}
+
+// jwkThumbprint computes the RFC 7638 thumbprint used as the key id.
+func jwkThumbprint(jwk JSONWebKey) string {
+	canonical := fmt.Sprintf(`{"e":%q,"kty":%q,"n":%q}`, jwk.E, jwk.Kty, jwk.N)
+	sum := sha256.Sum256([]byte(canonical))
+	return base64.RawURLEncoding.EncodeToString(sum[:])
+}
+
+// jwksHandler godoc
+// @Summary JSON Web Key Set
+// @Description Public keys for verifying ID tokens
+// @Tags oidc
+// @Produce json
+// @Success 200 {object} JSONWebKeySet
+// @Router /.well-known/jwks.json [get]
+func jwksHandler(w http.ResponseWriter, r *http.Request) {
+	jwk := publicJWK(&oidcSigningKey.PublicKey)
+	jwk.Kid = oidcKeyID
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(JSONWebKeySet{Keys: []JSONWebKey{jwk}})
+}
+
+// OpenIDConfiguration is the OpenID Connect Discovery 1.0 document.
+type OpenIDConfiguration struct {
+	AuthorizationServerMetadata
+	UserinfoEndpoint                 string   `json:"userinfo_endpoint"`
+	JwksURI                          string   `json:"jwks_uri"`
+	SubjectTypesSupported            []string `json:"subject_types_supported"`
+	IDTokenSigningAlgValuesSupported []string `json:"id_token_signing_alg_values_supported"`
+	ClaimsSupported                  []string `json:"claims_supported"`
+}
+
+// openIDConfigurationHandler godoc
+// @Summary OpenID Connect discovery
+// @Description OpenID Provider configuration document
+// @Tags oidc
+// @Produce json
+// @Success 200 {object} OpenIDConfiguration
+// @Router /.well-known/openid-configuration [get]
+func openIDConfigurationHandler(w http.ResponseWriter, r *http.Request) {
+	base := issuerURL()
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(OpenIDConfiguration{
+		AuthorizationServerMetadata:      authorizationServerMetadata(),
+		UserinfoEndpoint:                 base + "/userinfo",
+		JwksURI:                          base + "/.well-known/jwks.json",
+		SubjectTypesSupported:            []string{"public"},
+		IDTokenSigningAlgValuesSupported: []string{"RS256"},
+		ClaimsSupported:                  []string{"sub", "iss", "aud", "exp", "iat", "auth_time", "nonce", "at_hash", "azp", "name", "preferred_username", "email"},
+	})
+}
+
+// UserInfo carries the standard claims released for the granted scopes.
+type UserInfo struct {
+	Subject           string `json:"sub"`
+	Name              string `json:"name,omitempty"`
+	PreferredUsername string `json:"preferred_username,omitempty"`
+	Email             string `json:"email,omitempty"`
+}
+
+func userInfoFor(profile userProfile, scope []string) UserInfo {
+	info := UserInfo{Subject: profile.Username}
+	if containsString(scope, scopeProfile) {
+		info.Name = profile.Name
+		info.PreferredUsername = profile.Username
+	}
+	if containsString(scope, scopeEmail) {
+		info.Email = profile.Email
+	}
+	return info
+}
+
+// userInfoHandler godoc
+// @Summary OpenID Connect userinfo
+// @Description Returns claims about the user the access token was issued to. Requires the openid scope.
+// @Tags oidc
+// @Produce json
+// @Success 200 {object} UserInfo
+// @Failure 401 {string} string "Unauthorized"
+// @Failure 403 {string} string "insufficient_scope"
+// @Router /userinfo [get]
+func userInfoHandler(w http.ResponseWriter, r *http.Request) {
+	principal, ok := principalFromContext(r.Context())
+	if !ok {
+		writeUnauthorized(w, "")
+		return
+	}
+	if !principal.HasScope(scopeOpenID) || principal.Username == "" {
+		w.Header().Set("WWW-Authenticate", fmt.Sprintf("Bearer realm=%q, error=\"insufficient_scope\", scope=%q", authRealm, scopeOpenID))
+		http.Error(w, "insufficient_scope", http.StatusForbidden)
+		return
+	}
+
+	profile, err := lookupUserProfile(r.Context(), principal.Username)
+	if errors.Is(err, errUserDeleted) {
+		writeUnauthorized(w, "The user no longer exists")
+		return
+	}
+	if err != nil {
+		fmt.Println("userinfo lookup failed:", err)
+		http.Error(w, "Could not load user", http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	json.NewEncoder(w).Encode(userInfoFor(profile, principal.Scopes))
+}
+
+// idTokenRequest carries what generateIDToken needs from the grant.
+type idTokenRequest struct {
+	Username    string
+	ClientID    string
+	Scope       []string
+	Nonce       string
+	AuthTime    time.Time
+	AccessToken string
+}
+
+// generateIDToken issues an OpenID Connect ID token (Core 1.0 section 2).
+func generateIDToken(r *http.Request, req idTokenRequest) (string, error) {
+	profile, err := lookupUserProfile(r.Context(), req.Username)
+	if err != nil {
+		return "", err
+	}
+	info := userInfoFor(profile, req.Scope)
+
+	now := time.Now()
+	claims := jwt.MapClaims{
+		"iss":       issuerURL(),
+		"sub":       info.Subject,
+		"aud":       req.ClientID,
+		"azp":       req.ClientID,
+		"iat":       now.Unix(),
+		"exp":       now.Add(jwtOptions.TTL).Unix(),
+		"auth_time": req.AuthTime.Unix(),
+		"at_hash":   accessTokenHash(req.AccessToken),
+	}
+	if req.Nonce != "" {
+		claims["nonce"] = req.Nonce
+	}
+	if info.Name != "" {
+		claims["name"] = info.Name
+	}
+	if info.PreferredUsername != "" {
+		claims["preferred_username"] = info.PreferredUsername
+	}
+	if info.Email != "" {
+		claims["email"] = info.Email
+	}
+
+	token := jwt.NewWithClaims(jwt.SigningMethodRS256, claims)
+	token.Header["kid"] = oidcKeyID
+	return token.SignedString(oidcSigningKey)
+}
+
+// accessTokenHash is the at_hash claim: the left half of the SHA-256 of the
+// access token, base64url encoded.
+func accessTokenHash(accessToken string) string {
+	sum := sha256.Sum256([]byte(accessToken))
+	return base64.RawURLEncoding.EncodeToString(sum[:len(sum)/2])
+}
@@ -0,0 +1,118 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/x509"
+	"encoding/hex"
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/golang-jwt/jwt/v5"
+)
+
+var defaultRoles = []string{"user"}
+
+// userRoles maps a username to the roles stamped into its tokens. Users
+// without an entry get defaultRoles.
+var userRoles map[string][]string
+
+// Principal is the authenticated identity behind a request, as established
+// by jwtMiddleware.
+type Principal struct {
+	Subject  string
+	Username string
+	Roles    []string
+	Scopes   []string
+	TokenID  string
+	// ClientCertificate is the verified mTLS certificate, if one was used.
+	ClientCertificate *x509.Certificate
+}
+
+func (p *Principal) HasScope(scope string) bool {
+	for _, s := range p.Scopes {
+		if s == scope {
+			return true
+		}
+	}
+	return false
+}
+
+type principalContextKey struct{}
+
+func contextWithPrincipal(ctx context.Context, p *Principal) context.Context {
+	return context.WithValue(ctx, principalContextKey{}, p)
+}
+
+// principalFromContext returns the principal stored by jwtMiddleware. The
+// boolean is false on routes that are not behind the middleware.
+func principalFromContext(ctx context.Context) (*Principal, bool) {
+	p, ok := ctx.Value(principalContextKey{}).(*Principal)
+	return p, ok && p != nil
+}
+
+// principalFromClaims builds a Principal from validated token claims.
+// Roles are a JSON array and scopes a space-delimited string, as in RFC 9068.
+func principalFromClaims(claims jwt.MapClaims) *Principal {
+	p := &Principal{}
+	p.Subject, _ = claims.GetSubject()
+	p.Username, _ = claims["username"].(string)
+	if p.Username == "" {
+		p.Username = p.Subject
+	}
+	if p.Subject == "" {
+		p.Subject = p.Username
+	}
+	p.TokenID, _ = claims["jti"].(string)
+
+	if roles, ok := claims["roles"].([]interface{}); ok {
+		for _, r := range roles {
+			if s, ok := r.(string); ok && s != "" {
+				p.Roles = append(p.Roles, s)
+			}
+		}
+	}
+	if scope, ok := claims["scope"].(string); ok {
+		p.Scopes = strings.Fields(scope)
+	}
+	return p
+}
+
+// loadUserRoles parses USER_ROLES, e.g. "aminespinoza=admin,user;marcela=user".
+func loadUserRoles() (map[string][]string, error) {
+	roles := map[string][]string{}
+	v := os.Getenv("USER_ROLES")
+	for _, entry := range strings.Split(v, ";") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+		username, list, ok := strings.Cut(entry, "=")
+		username = strings.TrimSpace(username)
+		if !ok || username == "" {
+			return nil, fmt.Errorf("USER_ROLES: expected username=role[,role] but got %q", entry)
+		}
+		for _, role := range strings.Split(list, ",") {
+			if role = strings.TrimSpace(role); role != "" {
+				roles[username] = append(roles[username], role)
+			}
+		}
+	}
+	return roles, nil
+}
+
+func rolesFor(username string) []string {
+	if roles, ok := userRoles[username]; ok {
+		return roles
+	}
+	return defaultRoles
+}
+
+func newTokenID() (string, error) {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(b), nil
+}
@@ -0,0 +1,128 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"os"
+	"strings"
+)
+
+// authMode is how a route authenticates its callers, set per route with
+// ROUTE_AUTH, e.g. "/okCode=mtls;/notFound=both;/badRequest=digest".
+//
+//	jwt     Bearer JWT (the default)
+//	mtls    verified client certificate
+//	either  client certificate, or a JWT when an Authorization header is sent
+//	both    client certificate and JWT; the JWT names the caller
+//	basic   HTTP Basic
+//	digest  HTTP Digest, SHA-256 or MD5
+//	http    HTTP Basic or Digest
+//	proxy   HTTP Basic or Digest in Proxy-Authorization, challenged with 407
+type authMode string
+
+const (
+	authJWT    authMode = "jwt"
+	authMTLS   authMode = "mtls"
+	authEither authMode = "either"
+	authBoth   authMode = "both"
+	authBasic  authMode = "basic"
+	authDigest authMode = "digest"
+	authHTTP   authMode = "http"
+	authProxy  authMode = "proxy"
+)
+
+// defaultRouteAuth applies unless ROUTE_AUTH overrides it.
+var defaultRouteAuth = map[string]authMode{
+	"/proxyRequired": authProxy,
+}
+
+var routeAuth = map[string]authMode{}
+
+// loadRouteAuth parses ROUTE_AUTH on top of defaultRouteAuth.
+func loadRouteAuth() (map[string]authMode, error) {
+	modes := map[string]authMode{}
+	for path, m := range defaultRouteAuth {
+		modes[path] = m
+	}
+	v := os.Getenv("ROUTE_AUTH")
+	for _, entry := range strings.Split(v, ";") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+		path, mode, ok := strings.Cut(entry, "=")
+		path, mode = strings.TrimSpace(path), strings.TrimSpace(mode)
+		if !ok || !strings.HasPrefix(path, "/") {
+			return nil, fmt.Errorf("ROUTE_AUTH: expected /path=mode but got %q", entry)
+		}
+		switch m := authMode(mode); m {
+		case authJWT, authMTLS, authEither, authBoth, authBasic, authDigest, authHTTP, authProxy:
+			modes[path] = m
+		default:
+			return nil, fmt.Errorf("ROUTE_AUTH: %s: mode must be jwt, mtls, either, both, basic, digest, http or proxy, got %q", path, mode)
+		}
+	}
+	if tlsConfig.MTLSMode == mtlsOff {
+		for path, m := range modes {
+			if m == authMTLS || m == authEither || m == authBoth {
+				return nil, fmt.Errorf("ROUTE_AUTH: %s uses %s but MTLS_MODE is off", path, m)
+			}
+		}
+	}
+	return modes, nil
+}
+
+// authenticate applies the route's authMode. With "both" the JWT identifies
+// the caller and the certificate is kept on the principal, so a route can
+// require that a user's token is presented from a trusted machine.
+func authenticate(path string, next http.Handler) http.Handler {
+	mode, ok := routeAuth[path]
+	if !ok {
+		mode = authJWT
+	}
+	switch mode {
+	case authJWT:
+		return jwtMiddleware(next)
+	case authBasic:
+		return httpAuth(schemeBasic, next)
+	case authDigest:
+		return httpAuth(schemeDigest, next)
+	case authHTTP:
+		return httpAuth(schemeHTTP, next)
+	case authProxy:
+		return httpAuth(schemeProxy, next)
+	}
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		certPrincipal, err := principalFromCertificate(r)
+		if err != nil {
+			writeCertificateRequired(w, err.Error())
+			return
+		}
+
+		switch mode {
+		case authMTLS:
+			if certPrincipal == nil {
+				writeCertificateRequired(w, "client certificate required")
+				return
+			}
+			next.ServeHTTP(w, r.WithContext(contextWithPrincipal(r.Context(), certPrincipal)))
+		case authEither:
+			if certPrincipal != nil && r.Header.Get("Authorization") == "" {
+				next.ServeHTTP(w, r.WithContext(contextWithPrincipal(r.Context(), certPrincipal)))
+				return
+			}
+			jwtMiddleware(next).ServeHTTP(w, r)
+		case authBoth:
+			if certPrincipal == nil {
+				writeCertificateRequired(w, "client certificate required")
+				return
+			}
+			jwtMiddleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				principal, _ := principalFromContext(r.Context())
+				principal.ClientCertificate = certPrincipal.ClientCertificate
+				next.ServeHTTP(w, r)
+			})).ServeHTTP(w, r)
+		}
+	})
+}
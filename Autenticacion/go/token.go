@@ -0,0 +1,236 @@
+package main
+
+import (
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// TokenResponse is the successful token endpoint response (RFC 6749
+// section 5.1).
+type TokenResponse struct {
+	AccessToken  string `json:"access_token"`
+	TokenType    string `json:"token_type"`
+	ExpiresIn    int64  `json:"expires_in"`
+	RefreshToken string `json:"refresh_token,omitempty"`
+	Scope        string `json:"scope,omitempty"`
+	IDToken      string `json:"id_token,omitempty"`
+}
+
+// tokenGrant describes what a token response is issued for. An empty
+// Username means the client is acting for itself.
+type tokenGrant struct {
+	Username    string
+	Scope       []string
+	Nonce       string
+	AuthTime    time.Time
+	WithRefresh bool
+}
+
+// tokenHandler godoc
+// @Summary OAuth2 token endpoint
+// @Description Exchanges an authorization code (with PKCE verifier), client credentials or a refresh token for an access token. Clients authenticate with client_secret_basic, client_secret_post or, for public clients, just client_id.
+// @Tags oauth
+// @Accept x-www-form-urlencoded
+// @Produce json
+// @Param grant_type formData string true "authorization_code, client_credentials or refresh_token"
+// @Param code formData string false "Authorization code"
+// @Param redirect_uri formData string false "Redirect URI used in the authorization request; required when that request included one"
+// @Param code_verifier formData string false "PKCE code verifier"
+// @Param refresh_token formData string false "Refresh token"
+// @Param scope formData string false "Space-delimited scopes"
+// @Param client_id formData string false "Client id for client_secret_post and public clients"
+// @Param client_secret formData string false "Client secret for client_secret_post"
+// @Success 200 {object} TokenResponse
+// @Failure 400 {object} OAuthError
+// @Failure 401 {object} OAuthError
+// @Router /token [post]
+func tokenHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		w.Header().Set("Allow", http.MethodPost)
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if err := r.ParseForm(); err != nil {
+		writeOAuthError(w, http.StatusBadRequest, "invalid_request", "Body must be application/x-www-form-urlencoded")
+		return
+	}
+
+	client, ok := authenticateClient(w, r)
+	if !ok {
+		return
+	}
+
+	grant := r.PostForm.Get("grant_type")
+	if grant == "" {
+		writeOAuthError(w, http.StatusBadRequest, "invalid_request", "grant_type is required")
+		return
+	}
+	if !client.allowsGrant(grant) {
+		writeOAuthError(w, http.StatusBadRequest, "unauthorized_client", "Client is not registered for "+grant)
+		return
+	}
+
+	switch grant {
+	case grantAuthorizationCode:
+		exchangeAuthorizationCode(w, r, client)
+	case grantClientCredentials:
+		exchangeClientCredentials(w, r, client)
+	case grantRefreshToken:
+		exchangeRefreshToken(w, r, client)
+	default:
+		writeOAuthError(w, http.StatusBadRequest, "unsupported_grant_type", "Unsupported grant_type "+grant)
+	}
+}
+
+func exchangeAuthorizationCode(w http.ResponseWriter, r *http.Request, client *OAuthClient) {
+	ac, ok := oauth.takeCode(r.PostForm.Get("code"))
+	if !ok || ac.ClientID != client.ClientID {
+		writeOAuthError(w, http.StatusBadRequest, "invalid_grant", "Authorization code is invalid, expired or already used")
+		return
+	}
+	redirectURI := r.PostForm.Get("redirect_uri")
+	if redirectURI == "" && ac.RedirectURISent {
+		writeOAuthError(w, http.StatusBadRequest, "invalid_grant", "redirect_uri is required because the authorization request included it")
+		return
+	}
+	if redirectURI != "" && redirectURI != ac.RedirectURI {
+		writeOAuthError(w, http.StatusBadRequest, "invalid_grant", "redirect_uri does not match the authorization request")
+		return
+	}
+	if !verifyPKCE(r.PostForm.Get("code_verifier"), ac.CodeChallenge) {
+		writeOAuthError(w, http.StatusBadRequest, "invalid_grant", "code_verifier does not match the code challenge")
+		return
+	}
+
+	issueTokens(w, r, client, tokenGrant{
+		Username:    ac.Username,
+		Scope:       ac.Scope,
+		Nonce:       ac.Nonce,
+		AuthTime:    ac.AuthTime,
+		WithRefresh: client.allowsGrant(grantRefreshToken),
+	})
+}
+
+func exchangeClientCredentials(w http.ResponseWriter, r *http.Request, client *OAuthClient) {
+	if client.isPublic() {
+		writeOAuthError(w, http.StatusBadRequest, "unauthorized_client", "Public clients cannot use client_credentials")
+		return
+	}
+	scope, ok := resolveScope(r.PostForm.Get("scope"), strings.Fields(client.Scope))
+	if !ok {
+		writeOAuthError(w, http.StatusBadRequest, "invalid_scope", "Requested scope is not allowed for this client")
+		return
+	}
+	// The client acts on its own behalf, so it is the subject.
+	issueTokens(w, r, client, tokenGrant{Scope: scope})
+}
+
+func exchangeRefreshToken(w http.ResponseWriter, r *http.Request, client *OAuthClient) {
+	rt, ok := oauth.takeRefreshToken(r.PostForm.Get("refresh_token"))
+	if !ok || rt.ClientID != client.ClientID {
+		writeOAuthError(w, http.StatusBadRequest, "invalid_grant", "Refresh token is invalid or expired")
+		return
+	}
+	// A refresh may narrow the original scope but never widen it.
+	scope, ok := resolveScope(r.PostForm.Get("scope"), rt.Scope)
+	if !ok {
+		writeOAuthError(w, http.StatusBadRequest, "invalid_scope", "Requested scope exceeds the original grant")
+		return
+	}
+	issueTokens(w, r, client, tokenGrant{
+		Username:    rt.Username,
+		Scope:       scope,
+		AuthTime:    rt.AuthTime,
+		WithRefresh: true,
+	})
+}
+
+// verifyPKCE checks an S256 code verifier (RFC 7636 section 4.6).
+func verifyPKCE(verifier, challenge string) bool {
+	if len(verifier) < 43 || len(verifier) > 128 {
+		return false
+	}
+	sum := sha256.Sum256([]byte(verifier))
+	computed := base64.RawURLEncoding.EncodeToString(sum[:])
+	return subtle.ConstantTimeCompare([]byte(computed), []byte(challenge)) == 1
+}
+
+// issueTokens writes a token response, adding an ID token when a user granted
+// the openid scope.
+func issueTokens(w http.ResponseWriter, r *http.Request, client *OAuthClient, grant tokenGrant) {
+	username, scope := grant.Username, grant.Scope
+	subject := username
+	if subject == "" {
+		subject = client.ClientID
+	}
+	claims, err := newJWTClaims(subject)
+	if err != nil {
+		writeOAuthError(w, http.StatusInternalServerError, "server_error", "Could not generate token")
+		return
+	}
+	if username == "" {
+		delete(claims, "username")
+		delete(claims, "roles")
+	}
+	claims["client_id"] = client.ClientID
+	claims["scope"] = strings.Join(scope, " ")
+
+	accessToken, err := signJWT(claims)
+	if err != nil {
+		writeOAuthError(w, http.StatusInternalServerError, "server_error", "Could not generate token")
+		return
+	}
+
+	resp := TokenResponse{
+		AccessToken: accessToken,
+		TokenType:   "Bearer",
+		ExpiresIn:   int64(jwtOptions.TTL.Seconds()),
+		Scope:       strings.Join(scope, " "),
+	}
+	if username != "" && containsString(scope, scopeOpenID) {
+		resp.IDToken, err = generateIDToken(r, idTokenRequest{
+			Username:    username,
+			ClientID:    client.ClientID,
+			Scope:       scope,
+			Nonce:       grant.Nonce,
+			AuthTime:    grant.AuthTime,
+			AccessToken: accessToken,
+		})
+		if errors.Is(err, errUserDeleted) {
+			writeOAuthError(w, http.StatusBadRequest, "invalid_grant", "The user no longer exists")
+			return
+		}
+		if err != nil {
+			fmt.Println("generateIDToken failed:", err)
+			writeOAuthError(w, http.StatusInternalServerError, "server_error", "Could not generate ID token")
+			return
+		}
+	}
+	if grant.WithRefresh {
+		refresh, err := randomToken(32)
+		if err != nil {
+			writeOAuthError(w, http.StatusInternalServerError, "server_error", "Could not generate refresh token")
+			return
+		}
+		oauth.addRefreshToken(refresh, &refreshToken{
+			ClientID:  client.ClientID,
+			Username:  username,
+			Scope:     scope,
+			AuthTime:  grant.AuthTime,
+			ExpiresAt: time.Now().Add(refreshTokenTTL),
+		})
+		resp.RefreshToken = refresh
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	w.Header().Set("Pragma", "no-cache")
+	json.NewEncoder(w).Encode(resp)
+}
@@ -0,0 +1,160 @@
+package main
+
+import (
+	"context"
+	"crypto/aes"
+	"crypto/cipher"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/jackc/pgx/v5"
+	"golang.org/x/crypto/bcrypt"
+)
+
+// emailKey decrypts the email column written by the Encriptacion service.
+// Both DATABASE_URL and EMAIL_ENC_KEY are optional here: without them the
+// OpenID Connect claims only carry the username.
+var emailKey []byte
+
+// userProfile holds the standard claims we can source from the users table.
+type userProfile struct {
+	Username string
+	Name     string
+	Email    string
+}
+
+func loadEmailKey() ([]byte, error) {
+	encKeyB64 := os.Getenv("EMAIL_ENC_KEY")
+	if encKeyB64 == "" {
+		return nil, nil
+	}
+	key, err := base64.StdEncoding.DecodeString(encKeyB64)
+	if err != nil {
+		return nil, fmt.Errorf("EMAIL_ENC_KEY must be base64-encoded: %w", err)
+	}
+	if l := len(key); l != 16 && l != 24 && l != 32 {
+		return nil, errors.New("EMAIL_ENC_KEY must decode to 16, 24, or 32 bytes (AES-128/192/256)")
+	}
+	return key, nil
+}
+
+var (
+	// errUserDeleted means the user was soft-deleted in the Encriptacion
+	// service and must not get claims or ID tokens anymore.
+	errUserDeleted = errors.New("user is deleted")
+
+	errInvalidCredentials = errors.New("invalid username or password")
+	// errMFARequired means the user has TOTP enabled, which /authorize
+	// cannot check, so a password alone must not sign them in.
+	errMFARequired       = errors.New("two-factor authentication required")
+	errDatabaseURLNotSet = errors.New("DATABASE_URL not set")
+)
+
+var dummyPasswordHash, _ = bcrypt.GenerateFromPassword([]byte("not a real password"), bcrypt.DefaultCost)
+
+// authenticateUser checks username and password against the users table.
+func authenticateUser(ctx context.Context, username, password string) error {
+	if db == nil {
+		return errDatabaseURLNotSet
+	}
+	var hash string
+	var totpEnabled, deleted bool
+	err := db.QueryRow(ctx, "SELECT password, totp_enabled, deleted_at IS NOT NULL FROM users WHERE username = $1",
+		username).Scan(&hash, &totpEnabled, &deleted)
+	if errors.Is(err, pgx.ErrNoRows) {
+		// Compare against a dummy hash anyway so unknown usernames take as
+		// long as wrong passwords.
+		bcrypt.CompareHashAndPassword(dummyPasswordHash, []byte(password))
+		return errInvalidCredentials
+	}
+	if err != nil {
+		return err
+	}
+	if bcrypt.CompareHashAndPassword([]byte(hash), []byte(password)) != nil || deleted {
+		return errInvalidCredentials
+	}
+	if totpEnabled {
+		return errMFARequired
+	}
+	return nil
+}
+
+// lookupUserProfile reads name and email for username. A missing database or
+// user is not an error; the profile then only has the username. A deleted
+// user is errUserDeleted.
+func lookupUserProfile(ctx context.Context, username string) (userProfile, error) {
+	profile := userProfile{Username: username}
+	if db == nil {
+		return profile, nil
+	}
+
+	var encEmail, wrappedKey string
+	var deleted bool
+	err := db.QueryRow(ctx, `SELECT users.name, COALESCE(users.email, ''), COALESCE(user_keys.wrapped_key, ''), users.deleted_at IS NOT NULL
+		FROM users LEFT JOIN user_keys ON user_keys.user_id = users.id
+		WHERE users.username = $1 LIMIT 1`, username).Scan(&profile.Name, &encEmail, &wrappedKey, &deleted)
+	if errors.Is(err, pgx.ErrNoRows) {
+		return profile, nil
+	}
+	if err != nil {
+		return profile, err
+	}
+	if deleted {
+		return userProfile{}, errUserDeleted
+	}
+
+	if strings.TrimSpace(encEmail) != "" && emailKey != nil {
+		profile.Email, err = decryptEmail(encEmail, wrappedKey)
+		if err != nil {
+			return profile, fmt.Errorf("decryptEmail failed: %w", err)
+		}
+	}
+	return profile, nil
+}
+
+// decryptEmail opens an email the way the Encriptacion service sealed it:
+// with the user's own data key, stored in user_keys wrapped with
+// EMAIL_ENC_KEY, or with EMAIL_ENC_KEY itself for users created before data
+// keys existed (wrappedKey empty).
+func decryptEmail(b64, wrappedKey string) (string, error) {
+	key := emailKey
+	if wrappedKey != "" {
+		keyB64, err := openString(emailKey, wrappedKey)
+		if err != nil {
+			return "", fmt.Errorf("unwrapping data key: %w", err)
+		}
+		if key, err = base64.StdEncoding.DecodeString(keyB64); err != nil {
+			return "", fmt.Errorf("unwrapping data key: %w", err)
+		}
+	}
+	return openString(key, b64)
+}
+
+// openString decrypts AES-GCM ciphertext laid out as base64(nonce ||
+// ciphertext).
+func openString(key []byte, b64 string) (string, error) {
+	data, err := base64.StdEncoding.DecodeString(b64)
+	if err != nil {
+		return "", err
+	}
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return "", err
+	}
+	gcm, err := cipher.NewGCM(block)
+	if err != nil {
+		return "", err
+	}
+	if len(data) < gcm.NonceSize() {
+		return "", fmt.Errorf("ciphertext too short")
+	}
+	nonce, ciphertext := data[:gcm.NonceSize()], data[gcm.NonceSize():]
+	plain, err := gcm.Open(nil, nonce, ciphertext, nil)
+	if err != nil {
+		return "", err
+	}
+	return string(plain), nil
+}
@@ -3,25 +3,28 @@ package main
 import (
 	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"net/http"
 	"os"
+	"slices"
+	"strconv"
 	"strings"
 	_ "swagger/docs"
 	"time"
 
-	"github.com/golang-jwt/jwt/v5"
-	"github.com/jackc/pgx/v5"
 	"github.com/joho/godotenv"
 	httpSwagger "github.com/swaggo/http-swagger"
+	"golang.org/x/crypto/bcrypt"
 )
 
-var jwtSecret []byte
-
 type User struct {
-	ID       int    `json:"id"`
-	Name     string `json:"name"`
-	Username string `json:"username"`
+	ID        int        `json:"id"`
+	Name      string     `json:"name"`
+	Username  string     `json:"username"`
+	Version   int64      `json:"version"`
+	UpdatedAt time.Time  `json:"updatedAt"`
+	DeletedAt *time.Time `json:"deletedAt,omitempty"`
 }
 
 type CreateUser struct {
@@ -30,56 +33,64 @@ type CreateUser struct {
 	Password string `json:"password"`
 }
 
-func jwtMiddleware(next http.Handler) http.Handler {
-	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		authHeader := r.Header.Get("Authorization")
-		if !strings.HasPrefix(authHeader, "Bearer ") {
-			http.Error(w, "Unauthorized", http.StatusUnauthorized)
-			return
-		}
-		tokenString := strings.TrimPrefix(authHeader, "Bearer ")
-		token, err := jwt.Parse(tokenString, func(token *jwt.Token) (interface{}, error) {
-			return jwtSecret, nil
-		})
-		if err != nil || !token.Valid {
-			http.Error(w, "Unauthorized", http.StatusUnauthorized)
-			return
-		}
-		next.ServeHTTP(w, r)
-	})
+type LoginRequest struct {
+	Username string `json:"username"`
+	Password string `json:"password"`
 }
 
+var dummyPasswordHash, _ = bcrypt.GenerateFromPassword([]byte("not a real password"), bcrypt.DefaultCost)
+
 // loginHandler godoc
-// @Summary Generate JWT token
-// @Description Returns a JWT token for a given username
+// @Summary Log in
+// @Description Checks the username and password of a stored user and returns a JWT carrying the roles USER_ROLES assigns to it
 // @Tags auth
-// @Param username query string true "Username"
+// @Accept json
+// @Param credentials body LoginRequest true "Credentials"
 // @Success 200 {string} string "JWT token"
-// @Failure 400 {string} string "Username required"
+// @Failure 400 {string} string "Username and password required"
+// @Failure 401 {string} string "Invalid username or password"
 // @Failure 500 {string} string "Could not generate token"
-// @Router /login [get]
+// @Failure 504 {string} string "Database timed out"
+// @Router /login [post]
 func loginHandler(w http.ResponseWriter, r *http.Request) {
-	username := r.URL.Query().Get("username")
-	if username == "" {
-		http.Error(w, "Username required", http.StatusBadRequest)
+	var lr LoginRequest
+	if err := json.NewDecoder(r.Body).Decode(&lr); err != nil {
+		http.Error(w, "Invalid input", http.StatusBadRequest)
+		return
+	}
+	if strings.TrimSpace(lr.Username) == "" || lr.Password == "" {
+		http.Error(w, "Username and password required", http.StatusBadRequest)
 		return
 	}
-	token, err := generateJWT(username)
+
+	ctx, cancel := readContext(r)
+	defer cancel()
+
+	user, err := userStore.FindByUsername(ctx, lr.Username)
+	found := err == nil
+	hash := user.PasswordHash
+	if errors.Is(err, errUserNotFound) {
+		// Compare against a dummy hash anyway so unknown usernames take as
+		// long as wrong passwords.
+		hash = string(dummyPasswordHash)
+	} else if err != nil {
+		writeDBError(w, r, err, "DB error")
+		return
+	}
+	if bcrypt.CompareHashAndPassword([]byte(hash), []byte(lr.Password)) != nil || !found {
+		http.Error(w, "Invalid username or password", http.StatusUnauthorized)
+		return
+	}
+
+	token, err := generateJWT(user.Username)
 	if err != nil {
 		http.Error(w, "Could not generate token", http.StatusInternalServerError)
 		return
 	}
+	w.Header().Set("Cache-Control", "no-store")
 	w.Write([]byte(token))
 }
 
-func generateJWT(username string) (string, error) {
-	token := jwt.NewWithClaims(jwt.SigningMethodHS256, jwt.MapClaims{
-		"username": username,
-		"exp":      time.Now().Add(time.Hour * 1).Unix(),
-	})
-	return token.SignedString(jwtSecret)
-}
-
 // okCodeHandler godoc
 // @Summary Returns OK status
 // @Description Responds with HTTP 200 and a message
@@ -92,42 +103,121 @@ func okCodeHandler(w http.ResponseWriter, r *http.Request) {
 }
 
 // usersHandler godoc
-// @Summary Get all users
-// @Description Returns a list of users from the database
+// @Summary List users
+// @Description Returns one page of users. Pages are keyset-paginated with opaque cursors by default, or offset-paginated when offset is given; follow the next and prev URLs in the Link header. limit defaults to 20 and is capped at 100. With Accept: text/csv or application/x-ndjson every matching user is exported instead, streamed in the requested order; limit, cursor and offset are then ignored.
 // @Tags users
+// @Produce json
+// @Produce text/csv
+// @Produce application/x-ndjson
+// @Param limit query int false "Page size (default 20, max 100)"
+// @Param sort query string false "id, name or username, prefixed with - for descending" default(id)
+// @Param cursor query string false "Opaque cursor from a Link header"
+// @Param offset query int false "Rows to skip; cannot be combined with cursor"
+// @Param name query string false "Exact name"
+// @Param namePrefix query string false "Case-insensitive name prefix"
+// @Param nameContains query string false "Case-insensitive name substring"
+// @Param username query string false "Exact username"
+// @Param usernamePrefix query string false "Case-insensitive username prefix"
+// @Param usernameContains query string false "Case-insensitive username substring"
+// @Param includeTotal query bool false "Return the number of matching users in X-Total-Count"
+// @Param includeDeleted query bool false "List soft-deleted users too; requires users:admin"
 // @Success 200 {array} User
-// @Failure 500 {string} string "Failed to connect to database" or "Query failed" or "Row scan failed"
+// @Header 200 {string} Link "next and prev page URLs"
+// @Header 200 {int} X-Total-Count "Matching users, when includeTotal is true"
+// @Failure 400 {string} string "Invalid query parameter"
+// @Failure 403 {string} string "includeDeleted requires users:admin"
+// @Failure 500 {string} string "Query failed"
+// @Failure 504 {string} string "Database timed out"
 // @Router /getUsers [get]
+// @Router /users [get]
 func usersHandler(w http.ResponseWriter, r *http.Request) {
-	dbURL := os.Getenv("DATABASE_URL")
-	if dbURL == "" {
-		http.Error(w, "DATABASE_URL not set", http.StatusInternalServerError)
+	q, cursor, includeTotal, err := parseUserListQuery(r.URL.Query())
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
 		return
 	}
-
-	ctx := context.Background()
-	conn, err := pgx.Connect(ctx, dbURL)
-	if err != nil {
-		http.Error(w, "Failed to connect to database", http.StatusInternalServerError)
+	if q.IncludeDeleted && !canSeeDeleted(w, r) {
 		return
 	}
-	defer conn.Close(ctx)
+	if format := exportFormat(r.Header.Get("Accept")); format != "" {
+		writeUserExport(w, r, q, format)
+		return
+	}
+
+	ctx, cancel := readContext(r)
+	defer cancel()
 
-	rows, err := conn.Query(ctx, "SELECT id, name, username FROM users")
+	// Fetch one extra row to learn whether another page follows. A prev
+	// cursor walks the opposite direction and the page is flipped back.
+	page := q
+	page.Limit = q.Limit + 1
+	backwards := cursor != nil && cursor.Prev
+	if cursor != nil {
+		page.After = &cursor.Key
+		page.Desc = q.Desc != backwards
+	}
+	records, err := userStore.List(ctx, page)
 	if err != nil {
-		http.Error(w, "Query failed", http.StatusInternalServerError)
+		writeDBError(w, r, err, "Query failed")
 		return
 	}
-	defer rows.Close()
+	more := len(records) > q.Limit
+	if more {
+		records = records[:q.Limit]
+	}
+	if backwards {
+		slices.Reverse(records)
+	}
 
-	users := []User{}
-	for rows.Next() {
-		var u User
-		if err := rows.Scan(&u.ID, &u.Name, &u.Username); err != nil {
-			http.Error(w, "Row scan failed", http.StatusInternalServerError)
+	var links []string
+	link := func(rel string, set map[string]string) {
+		u := *r.URL
+		values := u.Query()
+		values.Del("cursor")
+		values.Del("offset")
+		for k, v := range set {
+			values.Set(k, v)
+		}
+		u.RawQuery = values.Encode()
+		links = append(links, fmt.Sprintf("<%s>; rel=%q", u.RequestURI(), rel))
+	}
+	if r.URL.Query().Has("offset") {
+		if more {
+			link("next", map[string]string{"offset": strconv.Itoa(q.Offset + q.Limit)})
+		}
+		if q.Offset > 0 {
+			link("prev", map[string]string{"offset": strconv.Itoa(max(q.Offset-q.Limit, 0))})
+		}
+	} else if len(records) > 0 {
+		next := userCursor{Sort: q.Sort, Desc: q.Desc, Key: userKeyOf(records[len(records)-1], q.Sort)}
+		prev := userCursor{Sort: q.Sort, Desc: q.Desc, Prev: true, Key: userKeyOf(records[0], q.Sort)}
+		hasNext, hasPrev := more, cursor != nil
+		if backwards {
+			hasNext, hasPrev = true, more
+		}
+		if hasNext {
+			link("next", map[string]string{"cursor": encodeUserCursor(next)})
+		}
+		if hasPrev {
+			link("prev", map[string]string{"cursor": encodeUserCursor(prev)})
+		}
+	}
+	if len(links) > 0 {
+		w.Header().Set("Link", strings.Join(links, ", "))
+	}
+
+	if includeTotal {
+		total, err := userStore.Count(ctx, q)
+		if err != nil {
+			writeDBError(w, r, err, "Query failed")
 			return
 		}
-		users = append(users, u)
+		w.Header().Set("X-Total-Count", strconv.Itoa(total))
+	}
+
+	users := make([]User, 0, len(records))
+	for _, u := range records {
+		users = append(users, userResponse(u))
 	}
 
 	w.Header().Set("Content-Type", "application/json")
@@ -136,47 +226,53 @@ func usersHandler(w http.ResponseWriter, r *http.Request) {
 
 // createUserHandler godoc
 // @Summary Create a new user
-// @Description Create a new user and return the created record
+// @Description Create a new user and return the created record. Name is required; username needs 3 to 32 letters, digits, '.', '_' or '-'. The password is checked against the password policy and stored as a bcrypt hash. Every broken rule is listed in the 422 response.
 // @Tags users
 // @Accept json
 // @Produce json
 // @Param user body CreateUser true "New user"
 // @Success 201 {object} User
+// @Header 201 {string} Location "URL of the new user"
+// @Header 201 {string} ETag "Version of the new user, for If-Match"
 // @Failure 400 {string} string "Invalid input"
+// @Failure 409 {string} string "Username already taken"
+// @Failure 422 {object} ValidationError
 // @Failure 500 {string} string "DB error"
+// @Failure 504 {string} string "Database timed out"
 // @Router /createUser [post]
+// @Router /users [post]
 func createUserHandler(w http.ResponseWriter, r *http.Request) {
 	var cu CreateUser
 	if err := json.NewDecoder(r.Body).Decode(&cu); err != nil {
 		http.Error(w, "Invalid input", http.StatusBadRequest)
 		return
 	}
-
-	dbURL := os.Getenv("DATABASE_URL")
-	if dbURL == "" {
-		http.Error(w, "DATABASE_URL not set", http.StatusInternalServerError)
+	if errs := cu.validate(); errs != nil {
+		writeValidationError(w, "User is invalid", errs)
 		return
 	}
 
-	ctx := context.Background()
-	conn, err := pgx.Connect(ctx, dbURL)
+	hashedPw, err := bcrypt.GenerateFromPassword([]byte(cu.Password), bcrypt.DefaultCost)
 	if err != nil {
-		http.Error(w, "Failed to connect to database", http.StatusInternalServerError)
+		http.Error(w, "Failed to hash password", http.StatusInternalServerError)
 		return
 	}
-	defer conn.Close(ctx)
 
-	var id int
-	err = conn.QueryRow(ctx, "INSERT INTO users (name, username, password) VALUES ($1, $2, $3) RETURNING id", cu.Name, cu.Username, cu.Password).Scan(&id)
+	ctx, cancel := writeContext(r)
+	defer cancel()
+
+	u, err := userStore.Create(ctx, UserRecord{Name: cu.Name, Username: cu.Username, PasswordHash: string(hashedPw)})
+	if errors.Is(err, errUsernameTaken) {
+		http.Error(w, "Username already taken", http.StatusConflict)
+		return
+	}
 	if err != nil {
-		http.Error(w, "DB error", http.StatusInternalServerError)
+		writeDBError(w, r, err, "DB error")
 		return
 	}
 
-	user := User{ID: id, Name: cu.Name, Username: cu.Username}
-	w.Header().Set("Content-Type", "application/json")
-	w.WriteHeader(http.StatusCreated)
-	json.NewEncoder(w).Encode(user)
+	w.Header().Set("Location", userLocation(u.ID))
+	writeUser(w, http.StatusCreated, u)
 }
 
 func main() {
@@ -184,6 +280,24 @@ func main() {
 	if err != nil {
 		fmt.Println(".env file not found or failed to load")
 	}
+	if len(os.Args) > 1 && os.Args[1] == "migrate" {
+		if err := runMigrate(os.Args[2:]); err != nil {
+			fmt.Println("migrate:", err)
+			os.Exit(1)
+		}
+		return
+	}
+	if len(os.Args) > 1 && (os.Args[1] == "import" || os.Args[1] == "export") {
+		run := runImport
+		if os.Args[1] == "export" {
+			run = runExport
+		}
+		if err := run(os.Args[2:]); err != nil {
+			fmt.Println(os.Args[1]+":", err)
+			os.Exit(1)
+		}
+		return
+	}
 	secret := os.Getenv("JWT_SECRET")
 	if secret == "" {
 		fmt.Println("JWT_SECRET environment variable not set!")
@@ -191,10 +305,76 @@ func main() {
 	}
 	jwtSecret = []byte(secret)
 
-	http.Handle("/login", http.HandlerFunc(loginHandler))
-	http.Handle("/okCode", jwtMiddleware(http.HandlerFunc(okCodeHandler)))
-	http.Handle("/getUsers", jwtMiddleware(http.HandlerFunc(usersHandler)))
-	http.Handle("/createUser", jwtMiddleware(http.HandlerFunc(createUserHandler)))
+	jwtOptions, err = loadJWTOptions()
+	if err != nil {
+		fmt.Println(err)
+		return
+	}
+	userRoles, err = loadUserRoles()
+	if err != nil {
+		fmt.Println(err)
+		return
+	}
+	roleScopes, err = loadRoleScopes()
+	if err != nil {
+		fmt.Println(err)
+		return
+	}
+	passwordRules, err = loadPasswordPolicy()
+	if err != nil {
+		fmt.Println(err)
+		return
+	}
+	queryTimeouts, err = loadQueryTimeouts()
+	if err != nil {
+		fmt.Println(err)
+		return
+	}
+	purgeSettings, err = loadPurgeSettings()
+	if err != nil {
+		fmt.Println(err)
+		return
+	}
+
+	db, err = openDB(context.Background())
+	if err != nil {
+		fmt.Println(err)
+		return
+	}
+	if db != nil {
+		defer db.Close()
+		if err := db.Ping(context.Background()); err != nil {
+			fmt.Println("Database not reachable yet:", err)
+		}
+	}
+	if err := autoMigrate(context.Background()); err != nil {
+		fmt.Println(err)
+		return
+	}
+	userStore, err = loadUserStore()
+	if err != nil {
+		fmt.Println(err)
+		return
+	}
+	go runUserPurge(context.Background(), purgeSettings)
+
+	http.Handle("POST /login", http.HandlerFunc(loginHandler))
+	http.Handle("/okCode", jwtMiddleware(authorize("/okCode", http.HandlerFunc(okCodeHandler))))
+	http.Handle("/getUsers", jwtMiddleware(authorize("/getUsers", http.HandlerFunc(usersHandler))))
+	http.Handle("/createUser", jwtMiddleware(authorize("/createUser", http.HandlerFunc(createUserHandler))))
+	http.Handle("GET /users", jwtMiddleware(authorize("GET /users", http.HandlerFunc(usersHandler))))
+	http.Handle("POST /users", jwtMiddleware(authorize("POST /users", http.HandlerFunc(createUserHandler))))
+	http.Handle("GET /users/{id}", jwtMiddleware(authorize("GET /users/{id}", http.HandlerFunc(getUserHandler))))
+	http.Handle("PUT /users/{id}", jwtMiddleware(authorize("PUT /users/{id}", http.HandlerFunc(replaceUserHandler))))
+	http.Handle("PATCH /users/{id}", jwtMiddleware(authorize("PATCH /users/{id}", http.HandlerFunc(patchUserHandler))))
+	http.Handle("DELETE /users/{id}", jwtMiddleware(authorize("DELETE /users/{id}", http.HandlerFunc(deleteUserHandler))))
+	http.Handle("POST /users/import", jwtMiddleware(authorize("POST /users/import", http.HandlerFunc(importUsersHandler))))
+	http.Handle("POST /users/{id}/restore", jwtMiddleware(authorize("POST /users/{id}/restore", http.HandlerFunc(restoreUserHandler))))
+	http.Handle("/policy", jwtMiddleware(authorize("/policy", http.HandlerFunc(policyHandler))))
+	http.Handle("/dbStats", requireDB(jwtMiddleware(authorize("/dbStats", http.HandlerFunc(dbStatsHandler)))))
+	http.Handle("/createApiKey", requireDB(jwtMiddleware(authorize("/createApiKey", http.HandlerFunc(createAPIKeyHandler)))))
+	http.Handle("/getApiKeys", requireDB(jwtMiddleware(authorize("/getApiKeys", http.HandlerFunc(apiKeysHandler)))))
+	http.Handle("POST /revokeApiKey", requireDB(jwtMiddleware(authorize("POST /revokeApiKey", http.HandlerFunc(revokeAPIKeyHandler)))))
 
 	http.HandleFunc("/swagger/", httpSwagger.WrapHandler)
 
@@ -0,0 +1,8 @@
+-- Deployments from before migrations already have this table, so this step
+-- only creates what is missing.
+CREATE TABLE IF NOT EXISTS users (
+    id       BIGINT GENERATED BY DEFAULT AS IDENTITY PRIMARY KEY,
+    name     TEXT NOT NULL,
+    username TEXT NOT NULL UNIQUE,
+    password TEXT NOT NULL
+);
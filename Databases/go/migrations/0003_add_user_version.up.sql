@@ -0,0 +1,4 @@
+-- version is bumped on every update and backs the ETag of /users/{id}.
+ALTER TABLE users
+    ADD COLUMN version    BIGINT NOT NULL DEFAULT 1,
+    ADD COLUMN updated_at TIMESTAMPTZ NOT NULL DEFAULT now();
@@ -0,0 +1,5 @@
+-- deleted_at marks a soft-deleted user; the purge job removes the row once
+-- USER_RETENTION has passed.
+ALTER TABLE users ADD COLUMN deleted_at TIMESTAMPTZ;
+
+CREATE INDEX users_deleted_at_idx ON users (deleted_at) WHERE deleted_at IS NOT NULL;
@@ -0,0 +1,181 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"sort"
+	"strings"
+)
+
+const (
+	scopeUsersRead  = "users:read"
+	scopeUsersWrite = "users:write"
+	scopeUsersAdmin = "users:admin"
+	scopePolicyRead = "policy:read"
+	scopeAPIKeys    = "apikeys:manage"
+	scopeDBStats    = "db:stats"
+)
+
+// roleScopes maps a role to the scopes granted to tokens carrying it. It can
+// be overridden with ROLE_SCOPES using the same syntax as USER_ROLES.
+var roleScopes = map[string][]string{
+	roleAdmin: {scopeUsersRead, scopeUsersWrite, scopeUsersAdmin, scopePolicyRead, scopeAPIKeys, scopeDBStats},
+	"user":    {scopeUsersRead},
+}
+
+// routePolicy declares who may call a route. Path is the pattern the route is
+// registered under, including its method when it has one (GET /users/{id}).
+// A request is allowed when the principal holds any of AnyScope, or when
+// OwnerParam is set and the query parameter it names is empty or matches the
+// principal's username. An empty AnyScope with no OwnerParam only requires a
+// valid token.
+type routePolicy struct {
+	Path        string   `json:"path"`
+	AnyScope    []string `json:"anyScope,omitempty"`
+	OwnerParam  string   `json:"ownerParam,omitempty"`
+	Description string   `json:"description"`
+	Roles       []string `json:"roles"`
+}
+
+var routePolicies = []routePolicy{
+	{Path: "/okCode", Description: "Any authenticated user"},
+	{Path: "/getUsers", AnyScope: []string{scopeUsersRead}, Description: "List users"},
+	{Path: "/createUser", AnyScope: []string{scopeUsersWrite}, Description: "Create users"},
+	{Path: "GET /users", AnyScope: []string{scopeUsersRead}, Description: "List users"},
+	{Path: "POST /users", AnyScope: []string{scopeUsersWrite}, Description: "Create users"},
+	{Path: "GET /users/{id}", AnyScope: []string{scopeUsersRead}, Description: "Read a user"},
+	{Path: "PUT /users/{id}", AnyScope: []string{scopeUsersWrite}, Description: "Replace a user"},
+	{Path: "PATCH /users/{id}", AnyScope: []string{scopeUsersWrite}, Description: "Edit a user"},
+	{Path: "DELETE /users/{id}", AnyScope: []string{scopeUsersWrite}, Description: "Delete a user"},
+	{Path: "POST /users/import", AnyScope: []string{scopeUsersWrite}, Description: "Import users in bulk"},
+	{Path: "POST /users/{id}/restore", AnyScope: []string{scopeUsersAdmin}, Description: "Restore a deleted user"},
+	{Path: "/policy", AnyScope: []string{scopePolicyRead}, Description: "Audit the authorization policy"},
+	{Path: "/dbStats", AnyScope: []string{scopeDBStats}, Description: "Monitor the database connection pool"},
+	{Path: "/createApiKey", AnyScope: []string{scopeAPIKeys}, Description: "Issue API keys"},
+	{Path: "/getApiKeys", AnyScope: []string{scopeAPIKeys}, Description: "List API keys"},
+	{Path: "POST /revokeApiKey", AnyScope: []string{scopeAPIKeys}, Description: "Revoke API keys"},
+}
+
+func loadRoleScopes() (map[string][]string, error) {
+	v := os.Getenv("ROLE_SCOPES")
+	if v == "" {
+		return roleScopes, nil
+	}
+	return parseAssignments("ROLE_SCOPES", v)
+}
+
+// scopesFor returns the de-duplicated scopes granted by a set of roles.
+func scopesFor(roles []string) []string {
+	seen := map[string]bool{}
+	scopes := []string{}
+	for _, role := range roles {
+		for _, scope := range roleScopes[role] {
+			if !seen[scope] {
+				seen[scope] = true
+				scopes = append(scopes, scope)
+			}
+		}
+	}
+	return scopes
+}
+
+func policyFor(path string) (routePolicy, bool) {
+	for _, p := range routePolicies {
+		if p.Path == path {
+			return p, true
+		}
+	}
+	return routePolicy{}, false
+}
+
+// authorize enforces the routePolicies entry for path. It must wrap a handler
+// that is already behind jwtMiddleware. Registering a route without a policy
+// is a programming error, so it panics at startup rather than failing open.
+func authorize(path string, next http.Handler) http.Handler {
+	policy, ok := policyFor(path)
+	if !ok {
+		panic("no authorization policy for " + path)
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		principal, ok := principalFromContext(r.Context())
+		if !ok {
+			writeUnauthorized(w, "")
+			return
+		}
+		if len(policy.AnyScope) == 0 && policy.OwnerParam == "" {
+			next.ServeHTTP(w, r)
+			return
+		}
+		for _, scope := range policy.AnyScope {
+			if principal.HasScope(scope) {
+				next.ServeHTTP(w, r)
+				return
+			}
+		}
+		if policy.OwnerParam != "" {
+			owner := strings.TrimSpace(r.URL.Query().Get(policy.OwnerParam))
+			if owner == "" || owner == principal.Username {
+				next.ServeHTTP(w, r)
+				return
+			}
+		}
+
+		reason := fmt.Sprintf("%s requires scope %s", path, strings.Join(policy.AnyScope, " or "))
+		if policy.OwnerParam != "" {
+			reason += fmt.Sprintf(", or %s to be your own username", policy.OwnerParam)
+		}
+		w.Header().Set("WWW-Authenticate", fmt.Sprintf("Bearer realm=%q, error=\"insufficient_scope\", scope=%q, error_description=%q",
+			authRealm, strings.Join(policy.AnyScope, " "), reason))
+		http.Error(w, "Forbidden: "+reason, http.StatusForbidden)
+	})
+}
+
+// policyHandler godoc
+// @Summary Authorization policy
+// @Description Lists every protected route with the scopes it requires and the roles that currently grant them
+// @Tags auth
+// @Produce json
+// @Success 200 {array} routePolicy
+// @Failure 401 {string} string "Unauthorized"
+// @Failure 403 {string} string "Forbidden"
+// @Router /policy [get]
+func policyHandler(w http.ResponseWriter, r *http.Request) {
+	policies := make([]routePolicy, 0, len(routePolicies))
+	for _, p := range routePolicies {
+		p.Roles = rolesGranting(p.AnyScope)
+		policies = append(policies, p)
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(policies)
+}
+
+// rolesGranting lists the roles holding at least one of scopes. With no
+// scopes every configured role qualifies.
+func rolesGranting(scopes []string) []string {
+	roles := []string{}
+	for role, granted := range roleScopes {
+		if len(scopes) == 0 {
+			roles = append(roles, role)
+			continue
+		}
+		for _, s := range granted {
+			if containsString(scopes, s) {
+				roles = append(roles, role)
+				break
+			}
+		}
+	}
+	sort.Strings(roles)
+	return roles
+}
+
+func containsString(list []string, s string) bool {
+	for _, v := range list {
+		if v == s {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,69 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"time"
+)
+
+// Deleted users are only marked as deleted. A background job removes them
+// for good once they have been deleted for longer than USER_RETENTION
+// (default 720h, 30 days; 0 keeps them forever), checking every
+// USER_PURGE_INTERVAL (default 1h). Until then an admin can restore them.
+type PurgeSettings struct {
+	Retention time.Duration
+	Interval  time.Duration
+}
+
+var purgeSettings = PurgeSettings{Retention: 30 * 24 * time.Hour, Interval: time.Hour}
+
+func loadPurgeSettings() (PurgeSettings, error) {
+	s := purgeSettings
+	if v := os.Getenv("USER_RETENTION"); v != "" {
+		d, err := time.ParseDuration(v)
+		if err != nil || d < 0 {
+			return s, fmt.Errorf("USER_RETENTION must be a duration such as 720h, or 0 to keep deleted users")
+		}
+		s.Retention = d
+	}
+	if v := os.Getenv("USER_PURGE_INTERVAL"); v != "" {
+		d, err := time.ParseDuration(v)
+		if err != nil || d <= 0 {
+			return s, fmt.Errorf("USER_PURGE_INTERVAL must be a positive duration such as 1h")
+		}
+		s.Interval = d
+	}
+	return s, nil
+}
+
+// runUserPurge purges expired users now and then every s.Interval until ctx
+// is done. Running it on several instances at once is harmless.
+func runUserPurge(ctx context.Context, s PurgeSettings) {
+	if s.Retention == 0 {
+		return
+	}
+	ticker := time.NewTicker(s.Interval)
+	defer ticker.Stop()
+	for {
+		purgeDeletedUsers(ctx, s.Retention)
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+func purgeDeletedUsers(ctx context.Context, retention time.Duration) {
+	ctx, cancel := context.WithTimeout(ctx, queryTimeouts.Write)
+	defer cancel()
+	n, err := userStore.Purge(ctx, time.Now().Add(-retention))
+	if err != nil {
+		fmt.Println("Purging deleted users failed:", err)
+		return
+	}
+	if n > 0 {
+		fmt.Printf("Purged %d users deleted more than %s ago\n", n, retention)
+	}
+}
@@ -0,0 +1,291 @@
+package main
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"net/url"
+	"strconv"
+	"strings"
+)
+
+// The users list is returned one page at a time. Its query parameters are
+//
+//	limit                            page size, default 20 and capped at 100
+//	sort                             id, name or username; prefix with - to sort descending
+//	cursor                           opaque position taken from a Link header (keyset pagination)
+//	offset                           rows to skip (offset pagination), not combined with cursor
+//	name, username                   exact match
+//	namePrefix, usernamePrefix       case-insensitive prefix match
+//	nameContains, usernameContains   case-insensitive substring match
+//	includeTotal                     true to return the number of matching users in X-Total-Count
+//	includeDeleted                   true to list soft-deleted users too (needs users:admin)
+//
+// Keyset pagination is the default: it stays fast on large tables and does
+// not skip or repeat rows when users are added between pages. Responses carry
+// a Link header with the next and prev pages in whichever mode was used.
+const (
+	defaultUserPageSize = 20
+	maxUserPageSize     = 100
+)
+
+const (
+	filterEquals   = "eq"
+	filterPrefix   = "prefix"
+	filterContains = "contains"
+)
+
+var userSortFields = []string{"id", "name", "username"}
+
+type UserFilter struct {
+	Field string
+	Op    string
+	Value string
+}
+
+// userKey is a position in a sorted list: the sort field's value and the
+// ID that breaks ties. Value is unused when sorting by ID.
+type userKey struct {
+	Value string `json:"v,omitempty"`
+	ID    int    `json:"id"`
+}
+
+// UserQuery selects a page of users. After, when set, starts the page just
+// past that position in the requested order. Soft-deleted users are left
+// out unless IncludeDeleted is set.
+type UserQuery struct {
+	Sort           string
+	Desc           bool
+	Filters        []UserFilter
+	IncludeDeleted bool
+	After          *userKey
+	Offset         int
+	Limit          int
+}
+
+// userCursor is what an opaque cursor encodes. Prev marks a cursor that
+// walks backwards from Key to build the previous page.
+type userCursor struct {
+	Sort string  `json:"s"`
+	Desc bool    `json:"d,omitempty"`
+	Prev bool    `json:"p,omitempty"`
+	Key  userKey `json:"k"`
+}
+
+func encodeUserCursor(c userCursor) string {
+	b, _ := json.Marshal(c)
+	return base64.RawURLEncoding.EncodeToString(b)
+}
+
+func decodeUserCursor(s string) (userCursor, error) {
+	var c userCursor
+	b, err := base64.RawURLEncoding.DecodeString(s)
+	if err != nil || json.Unmarshal(b, &c) != nil {
+		return userCursor{}, fmt.Errorf("cursor is invalid")
+	}
+	return c, nil
+}
+
+func userSortValue(u UserRecord, field string) string {
+	switch field {
+	case "name":
+		return u.Name
+	case "username":
+		return u.Username
+	}
+	return ""
+}
+
+func userKeyOf(u UserRecord, field string) userKey {
+	return userKey{Value: userSortValue(u, field), ID: u.ID}
+}
+
+// parseUserListQuery reads the list parameters. Its errors are meant for the
+// client.
+func parseUserListQuery(values url.Values) (q UserQuery, cursor *userCursor, includeTotal bool, err error) {
+	q = UserQuery{Sort: "id", Limit: defaultUserPageSize}
+
+	if v := values.Get("limit"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 1 {
+			return q, nil, false, fmt.Errorf("limit must be a positive integer")
+		}
+		q.Limit = min(n, maxUserPageSize)
+	}
+
+	if v := values.Get("sort"); v != "" {
+		q.Desc = strings.HasPrefix(v, "-")
+		q.Sort = strings.TrimPrefix(v, "-")
+		if !containsString(userSortFields, q.Sort) {
+			return q, nil, false, fmt.Errorf("sort must be one of %s, optionally prefixed with -", strings.Join(userSortFields, ", "))
+		}
+	}
+
+	for _, field := range []string{"name", "username"} {
+		for _, f := range []struct{ param, op string }{
+			{field, filterEquals},
+			{field + "Prefix", filterPrefix},
+			{field + "Contains", filterContains},
+		} {
+			if values.Has(f.param) {
+				q.Filters = append(q.Filters, UserFilter{Field: field, Op: f.op, Value: values.Get(f.param)})
+			}
+		}
+	}
+
+	if v := values.Get("offset"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 0 {
+			return q, nil, false, fmt.Errorf("offset must be a non-negative integer")
+		}
+		q.Offset = n
+	}
+
+	if v := values.Get("cursor"); v != "" {
+		if values.Has("offset") {
+			return q, nil, false, fmt.Errorf("use either cursor or offset, not both")
+		}
+		c, err := decodeUserCursor(v)
+		if err != nil {
+			return q, nil, false, err
+		}
+		if c.Sort != q.Sort || c.Desc != q.Desc {
+			return q, nil, false, fmt.Errorf("cursor was issued for a different sort")
+		}
+		cursor = &c
+	}
+
+	if v := values.Get("includeTotal"); v != "" {
+		includeTotal, err = strconv.ParseBool(v)
+		if err != nil {
+			return q, nil, false, fmt.Errorf("includeTotal must be true or false")
+		}
+	}
+	q.IncludeDeleted, err = parseIncludeDeleted(values)
+	if err != nil {
+		return q, nil, false, err
+	}
+	return q, cursor, includeTotal, nil
+}
+
+func parseIncludeDeleted(values url.Values) (bool, error) {
+	v := values.Get("includeDeleted")
+	if v == "" {
+		return false, nil
+	}
+	b, err := strconv.ParseBool(v)
+	if err != nil {
+		return false, fmt.Errorf("includeDeleted must be true or false")
+	}
+	return b, nil
+}
+
+// escapeLike escapes the LIKE wildcards in s so it matches literally with
+// ESCAPE '\'.
+func escapeLike(s string) string {
+	return strings.NewReplacer(`\`, `\\`, `%`, `\%`, `_`, `\_`).Replace(s)
+}
+
+// userFilterSQL renders filters as WHERE conditions. placeholder returns the
+// bind parameter syntax for the n-th argument ($n for Postgres, ? for
+// SQLite). Field names come from a fixed list, never from the request.
+func userFilterSQL(filters []UserFilter, placeholder func(int) string, args []any) ([]string, []any) {
+	var where []string
+	for _, f := range filters {
+		switch f.Op {
+		case filterEquals:
+			args = append(args, f.Value)
+			where = append(where, fmt.Sprintf("%s = %s", f.Field, placeholder(len(args))))
+		case filterPrefix:
+			args = append(args, escapeLike(f.Value)+"%")
+			where = append(where, fmt.Sprintf(`lower(%s) LIKE lower(%s) ESCAPE '\'`, f.Field, placeholder(len(args))))
+		case filterContains:
+			args = append(args, "%"+escapeLike(f.Value)+"%")
+			where = append(where, fmt.Sprintf(`lower(%s) LIKE lower(%s) ESCAPE '\'`, f.Field, placeholder(len(args))))
+		}
+	}
+	return where, args
+}
+
+// userConditionsSQL renders q's filters, and the exclusion of soft-deleted
+// users, as WHERE conditions.
+func userConditionsSQL(q UserQuery, placeholder func(int) string) ([]string, []any) {
+	where, args := userFilterSQL(q.Filters, placeholder, nil)
+	if !q.IncludeDeleted {
+		where = append(where, "deleted_at IS NULL")
+	}
+	return where, args
+}
+
+func whereClause(where []string) string {
+	if len(where) == 0 {
+		return ""
+	}
+	return " WHERE " + strings.Join(where, " AND ")
+}
+
+// userListSQL renders q as the WHERE, ORDER BY and LIMIT part of a SELECT
+// on users.
+func userListSQL(q UserQuery, placeholder func(int) string) (string, []any) {
+	where, args := userConditionsSQL(q, placeholder)
+	dir, cmp := "ASC", ">"
+	if q.Desc {
+		dir, cmp = "DESC", "<"
+	}
+	if q.After != nil {
+		if q.Sort == "id" {
+			args = append(args, q.After.ID)
+			where = append(where, fmt.Sprintf("id %s %s", cmp, placeholder(len(args))))
+		} else {
+			args = append(args, q.After.Value, q.After.ID)
+			where = append(where, fmt.Sprintf("(%s, id) %s (%s, %s)", q.Sort, cmp, placeholder(len(args)-1), placeholder(len(args))))
+		}
+	}
+
+	order := "id " + dir
+	if q.Sort != "id" {
+		order = q.Sort + " " + dir + ", " + order
+	}
+	args = append(args, q.Limit, q.Offset)
+	return fmt.Sprintf("%s ORDER BY %s LIMIT %s OFFSET %s",
+		whereClause(where), order, placeholder(len(args)-1), placeholder(len(args))), args
+}
+
+// matchesUserFilters applies filters in Go with the same rules as the SQL
+// stores.
+func matchesUserFilters(u UserRecord, filters []UserFilter) bool {
+	for _, f := range filters {
+		v := userSortValue(u, f.Field)
+		switch f.Op {
+		case filterEquals:
+			if v != f.Value {
+				return false
+			}
+		case filterPrefix:
+			if !strings.HasPrefix(strings.ToLower(v), strings.ToLower(f.Value)) {
+				return false
+			}
+		case filterContains:
+			if !strings.Contains(strings.ToLower(v), strings.ToLower(f.Value)) {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+// matchesUserQuery reports whether u is among the users q selects, ignoring
+// its paging.
+func matchesUserQuery(u UserRecord, q UserQuery) bool {
+	return (q.IncludeDeleted || u.DeletedAt == nil) && matchesUserFilters(u, q.Filters)
+}
+
+// compareUserKeys orders a and b by the sort field and then by ID.
+func compareUserKeys(a, b userKey, sort string) int {
+	if sort != "id" {
+		if c := strings.Compare(a.Value, b.Value); c != 0 {
+			return c
+		}
+	}
+	return a.ID - b.ID
+}
@@ -0,0 +1,441 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"mime"
+	"net/http"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+// Users are also exposed as REST resources: /users for the collection and
+// /users/{id} for one user. /getUsers and /createUser remain for existing
+// clients and share their handlers with GET and POST /users.
+//
+// DELETE only soft-deletes: the user disappears from every route but can be
+// brought back with POST /users/{id}/restore until the purge job removes it
+// (see PurgeSettings). Principals with users:admin can see deleted users by
+// passing includeDeleted=true.
+//
+// A user's ETag is its version. PUT, PATCH and DELETE on /users/{id} must
+// send it back in If-Match, so an edit based on a stale read fails with 412
+// instead of silently overwriting someone else's change.
+
+// UpdateUser is the body of PUT /users/{id}. Password is optional; when it
+// is left out the current password is kept.
+type UpdateUser struct {
+	Name     string `json:"name"`
+	Username string `json:"username"`
+	Password string `json:"password,omitempty"`
+}
+
+const acceptPatch = mergePatchType + ", " + jsonPatchType
+
+func userLocation(id int) string {
+	return fmt.Sprintf("/users/%d", id)
+}
+
+// userFromPath loads the user named by the {id} path segment. Soft-deleted
+// users are not found unless includeDeleted is set. When it returns false
+// the error response has already been written.
+func userFromPath(w http.ResponseWriter, r *http.Request, includeDeleted bool) (UserRecord, bool) {
+	id, err := strconv.Atoi(r.PathValue("id"))
+	if err != nil || id < 1 {
+		http.Error(w, "Invalid user id", http.StatusBadRequest)
+		return UserRecord{}, false
+	}
+	ctx, cancel := readContext(r)
+	defer cancel()
+	u, err := userStore.Get(ctx, id)
+	if errors.Is(err, errUserNotFound) || (err == nil && u.DeletedAt != nil && !includeDeleted) {
+		http.Error(w, "User not found", http.StatusNotFound)
+		return UserRecord{}, false
+	}
+	if err != nil {
+		writeDBError(w, r, err, "DB error")
+		return UserRecord{}, false
+	}
+	return u, true
+}
+
+// canSeeDeleted reports whether the caller may see soft-deleted users,
+// answering 403 when not.
+func canSeeDeleted(w http.ResponseWriter, r *http.Request) bool {
+	principal, ok := principalFromContext(r.Context())
+	if ok && principal.HasScope(scopeUsersAdmin) {
+		return true
+	}
+	http.Error(w, "Forbidden: includeDeleted requires scope "+scopeUsersAdmin, http.StatusForbidden)
+	return false
+}
+
+func userResponse(u UserRecord) User {
+	return User{ID: u.ID, Name: u.Name, Username: u.Username, Version: u.Version, UpdatedAt: u.UpdatedAt, DeletedAt: u.DeletedAt}
+}
+
+func userETag(u UserRecord) string {
+	return fmt.Sprintf(`"%d"`, u.Version)
+}
+
+func writeUser(w http.ResponseWriter, status int, u UserRecord) {
+	w.Header().Set("ETag", userETag(u))
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(userResponse(u))
+}
+
+// checkIfMatch compares the If-Match header with u's ETag and returns the
+// version the write must still find, or 0 for "If-Match: *". Weak ETags never
+// match. When it returns false the response has already been written.
+func checkIfMatch(w http.ResponseWriter, r *http.Request, u UserRecord) (int64, bool) {
+	values := r.Header.Values("If-Match")
+	if len(values) == 0 {
+		http.Error(w, "If-Match header required; send the ETag from GET "+userLocation(u.ID), http.StatusPreconditionRequired)
+		return 0, false
+	}
+	for _, tag := range strings.Split(strings.Join(values, ","), ",") {
+		switch strings.TrimSpace(tag) {
+		case "*":
+			return 0, true
+		case userETag(u):
+			return u.Version, true
+		}
+	}
+	writeVersionConflict(w, u)
+	return 0, false
+}
+
+// writeVersionConflict answers 412, with the current ETag when it is known.
+func writeVersionConflict(w http.ResponseWriter, u UserRecord) {
+	if u.Version != 0 {
+		w.Header().Set("ETag", userETag(u))
+	}
+	http.Error(w, "User was modified since it was read; fetch it again", http.StatusPreconditionFailed)
+}
+
+// saveUser stores u with the given fields after validating them, provided
+// it is still at version. A nil password keeps the current hash.
+func saveUser(w http.ResponseWriter, r *http.Request, u UserRecord, version int64, name, username string, password *string) {
+	errs := validateUserFields(name, username)
+	if password != nil {
+		errs = append(errs, passwordRules.check(username, *password)...)
+	}
+	if len(errs) > 0 {
+		writeValidationError(w, "User is invalid", errs)
+		return
+	}
+
+	u.Name, u.Username, u.Version = name, username, version
+	if password != nil {
+		hashedPw, err := bcrypt.GenerateFromPassword([]byte(*password), bcrypt.DefaultCost)
+		if err != nil {
+			http.Error(w, "Failed to hash password", http.StatusInternalServerError)
+			return
+		}
+		u.PasswordHash = string(hashedPw)
+	}
+
+	ctx, cancel := writeContext(r)
+	defer cancel()
+	u, err := userStore.Update(ctx, u)
+	switch {
+	case errors.Is(err, errUserNotFound):
+		http.Error(w, "User not found", http.StatusNotFound)
+	case errors.Is(err, errUsernameTaken):
+		http.Error(w, "Username already taken", http.StatusConflict)
+	case errors.Is(err, errVersionConflict):
+		writeVersionConflict(w, UserRecord{})
+	case err != nil:
+		writeDBError(w, r, err, "DB error")
+	default:
+		writeUser(w, http.StatusOK, u)
+	}
+}
+
+// getUserHandler godoc
+// @Summary Get a user
+// @Description Returns one user. The Accept-Patch header lists the PATCH formats the resource takes. Soft-deleted users are only returned with includeDeleted=true.
+// @Tags users
+// @Produce json
+// @Param id path int true "User ID"
+// @Param includeDeleted query bool false "Return the user even if it is soft-deleted; requires users:admin"
+// @Success 200 {object} User
+// @Header 200 {string} ETag "Version of the user, for If-Match"
+// @Header 200 {string} Accept-Patch "Supported PATCH media types"
+// @Failure 400 {string} string "Invalid user id"
+// @Failure 403 {string} string "includeDeleted requires users:admin"
+// @Failure 404 {string} string "User not found"
+// @Failure 500 {string} string "DB error"
+// @Failure 504 {string} string "Database timed out"
+// @Router /users/{id} [get]
+func getUserHandler(w http.ResponseWriter, r *http.Request) {
+	includeDeleted, err := parseIncludeDeleted(r.URL.Query())
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if includeDeleted && !canSeeDeleted(w, r) {
+		return
+	}
+	u, ok := userFromPath(w, r, includeDeleted)
+	if !ok {
+		return
+	}
+	w.Header().Set("Accept-Patch", acceptPatch)
+	writeUser(w, http.StatusOK, u)
+}
+
+// replaceUserHandler godoc
+// @Summary Replace a user
+// @Description Replaces a user's name and username. A password, when given, is checked against the password policy and stored as a bcrypt hash; without one the current password is kept.
+// @Tags users
+// @Accept json
+// @Produce json
+// @Param id path int true "User ID"
+// @Param If-Match header string true "ETag from GET /users/{id}, or *"
+// @Param user body UpdateUser true "New user fields"
+// @Success 200 {object} User
+// @Header 200 {string} ETag "New version of the user"
+// @Failure 400 {string} string "Invalid input"
+// @Failure 404 {string} string "User not found"
+// @Failure 409 {string} string "Username already taken"
+// @Failure 412 {string} string "User was modified since it was read"
+// @Failure 422 {object} ValidationError
+// @Failure 428 {string} string "If-Match header required"
+// @Failure 500 {string} string "DB error"
+// @Failure 504 {string} string "Database timed out"
+// @Router /users/{id} [put]
+func replaceUserHandler(w http.ResponseWriter, r *http.Request) {
+	u, ok := userFromPath(w, r, false)
+	if !ok {
+		return
+	}
+	version, ok := checkIfMatch(w, r, u)
+	if !ok {
+		return
+	}
+	var uu UpdateUser
+	if err := json.NewDecoder(r.Body).Decode(&uu); err != nil {
+		http.Error(w, "Invalid input", http.StatusBadRequest)
+		return
+	}
+	var password *string
+	if uu.Password != "" {
+		password = &uu.Password
+	}
+	saveUser(w, r, u, version, uu.Name, uu.Username, password)
+}
+
+// patchUserHandler godoc
+// @Summary Edit a user
+// @Description Applies a JSON Merge Patch (RFC 7396, application/merge-patch+json) or a JSON Patch (RFC 6902, application/json-patch+json) to the user's JSON representation. name and username can be changed; id, version and updatedAt are read-only. The password is write-only: set it with {"password": "..."} or an add operation on /password.
+// @Tags users
+// @Accept application/merge-patch+json,application/json-patch+json
+// @Produce json
+// @Param id path int true "User ID"
+// @Param If-Match header string true "ETag from GET /users/{id}, or *"
+// @Param patch body object true "Merge patch object or array of JSON Patch operations"
+// @Success 200 {object} User
+// @Header 200 {string} ETag "New version of the user"
+// @Failure 400 {string} string "Invalid patch"
+// @Failure 404 {string} string "User not found"
+// @Failure 409 {string} string "Patch does not apply, or username already taken"
+// @Failure 412 {string} string "User was modified since it was read"
+// @Failure 415 {string} string "Unsupported patch format"
+// @Failure 422 {object} ValidationError
+// @Failure 428 {string} string "If-Match header required"
+// @Failure 500 {string} string "DB error"
+// @Failure 504 {string} string "Database timed out"
+// @Router /users/{id} [patch]
+func patchUserHandler(w http.ResponseWriter, r *http.Request) {
+	u, ok := userFromPath(w, r, false)
+	if !ok {
+		return
+	}
+	version, ok := checkIfMatch(w, r, u)
+	if !ok {
+		return
+	}
+	original, err := userDoc(u)
+	if err != nil {
+		http.Error(w, "Could not encode user", http.StatusInternalServerError)
+		return
+	}
+	doc := deepCopyJSON(original)
+
+	var patched interface{}
+	mediaType, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	switch mediaType {
+	case mergePatchType:
+		var patch interface{}
+		if err := json.NewDecoder(r.Body).Decode(&patch); err != nil {
+			http.Error(w, "Invalid patch", http.StatusBadRequest)
+			return
+		}
+		patched = applyMergePatch(doc, patch)
+	case jsonPatchType:
+		var ops []PatchOperation
+		if err := json.NewDecoder(r.Body).Decode(&ops); err != nil {
+			http.Error(w, "Invalid patch", http.StatusBadRequest)
+			return
+		}
+		patched, err = applyJSONPatch(doc, ops)
+		if errors.Is(err, errPatchConflict) {
+			http.Error(w, err.Error(), http.StatusConflict)
+			return
+		}
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+	default:
+		w.Header().Set("Accept-Patch", acceptPatch)
+		http.Error(w, "Unsupported patch format, use "+acceptPatch, http.StatusUnsupportedMediaType)
+		return
+	}
+
+	name, username, password, errs := userFieldsFromDoc(patched, original)
+	if len(errs) > 0 {
+		writeValidationError(w, "Patched user is invalid", errs)
+		return
+	}
+	saveUser(w, r, u, version, name, username, password)
+}
+
+// userDoc returns u's JSON representation as a generic document for
+// patching.
+func userDoc(u UserRecord) (map[string]interface{}, error) {
+	b, err := json.Marshal(userResponse(u))
+	if err != nil {
+		return nil, err
+	}
+	var doc map[string]interface{}
+	return doc, json.Unmarshal(b, &doc)
+}
+
+// userFieldsFromDoc reads the editable fields back out of a patched user
+// document, reporting members that are unknown, of the wrong type, or
+// read-only and changed from original.
+func userFieldsFromDoc(doc interface{}, original map[string]interface{}) (name, username string, password *string, errs []FieldError) {
+	obj, ok := doc.(map[string]interface{})
+	if !ok {
+		errs = append(errs, FieldError{Field: "", Rule: "type", Message: "must be a JSON object"})
+		return
+	}
+	keys := make([]string, 0, len(obj))
+	for k := range obj {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	for _, k := range keys {
+		v := obj[k]
+		switch k {
+		case "id", "version", "updatedAt":
+			if !reflect.DeepEqual(v, original[k]) {
+				errs = append(errs, FieldError{Field: k, Rule: "read_only", Message: "cannot be changed"})
+			}
+		case "name", "username", "password":
+			s, ok := v.(string)
+			if !ok {
+				errs = append(errs, FieldError{Field: k, Rule: "type", Message: "must be a string"})
+				continue
+			}
+			switch k {
+			case "name":
+				name = s
+			case "username":
+				username = s
+			case "password":
+				password = &s
+			}
+		default:
+			errs = append(errs, FieldError{Field: k, Rule: "unknown", Message: "is not a user field"})
+		}
+	}
+	return
+}
+
+// deleteUserHandler godoc
+// @Summary Delete a user
+// @Description Soft-deletes a user. It is hidden from every route and can be restored until it is purged, USER_RETENTION after deletion.
+// @Tags users
+// @Param id path int true "User ID"
+// @Param If-Match header string true "ETag from GET /users/{id}, or *"
+// @Success 204
+// @Failure 400 {string} string "Invalid user id"
+// @Failure 404 {string} string "User not found"
+// @Failure 412 {string} string "User was modified since it was read"
+// @Failure 428 {string} string "If-Match header required"
+// @Failure 500 {string} string "DB error"
+// @Failure 504 {string} string "Database timed out"
+// @Router /users/{id} [delete]
+func deleteUserHandler(w http.ResponseWriter, r *http.Request) {
+	u, ok := userFromPath(w, r, false)
+	if !ok {
+		return
+	}
+	version, ok := checkIfMatch(w, r, u)
+	if !ok {
+		return
+	}
+	ctx, cancel := writeContext(r)
+	defer cancel()
+	err := userStore.Delete(ctx, u.ID, version)
+	if errors.Is(err, errUserNotFound) {
+		http.Error(w, "User not found", http.StatusNotFound)
+		return
+	}
+	if errors.Is(err, errVersionConflict) {
+		writeVersionConflict(w, UserRecord{})
+		return
+	}
+	if err != nil {
+		writeDBError(w, r, err, "DB error")
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// restoreUserHandler godoc
+// @Summary Restore a deleted user
+// @Description Brings back a soft-deleted user that has not been purged yet
+// @Tags users
+// @Produce json
+// @Param id path int true "User ID"
+// @Success 200 {object} User
+// @Header 200 {string} ETag "New version of the user"
+// @Failure 400 {string} string "Invalid user id"
+// @Failure 404 {string} string "User not found"
+// @Failure 409 {string} string "User is not deleted"
+// @Failure 500 {string} string "DB error"
+// @Failure 504 {string} string "Database timed out"
+// @Router /users/{id}/restore [post]
+func restoreUserHandler(w http.ResponseWriter, r *http.Request) {
+	u, ok := userFromPath(w, r, true)
+	if !ok {
+		return
+	}
+	if u.DeletedAt == nil {
+		http.Error(w, "User is not deleted", http.StatusConflict)
+		return
+	}
+	ctx, cancel := writeContext(r)
+	defer cancel()
+	u, err := userStore.Restore(ctx, u.ID)
+	if errors.Is(err, errUserNotFound) {
+		http.Error(w, "User not found", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		writeDBError(w, r, err, "DB error")
+		return
+	}
+	writeUser(w, http.StatusOK, u)
+}
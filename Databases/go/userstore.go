@@ -0,0 +1,443 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgconn"
+)
+
+// Users are kept in a UserStore chosen with USER_STORE:
+//
+//	postgres  the users table in DATABASE_URL (the default)
+//	sqlite    a local file at SQLITE_PATH (default users.db), created on first use
+//	memory    kept in the process and lost on restart, for tests and demos
+//
+// Only the postgres store needs a database server. API keys still live in
+// Postgres, so without DATABASE_URL their routes answer 503.
+// Version starts at 1 and is bumped by every Update; UpdatedAt is the time
+// of the last change.
+//
+// Deleting a user only sets DeletedAt. Soft-deleted users keep their
+// username, are left out of lists unless asked for, and are removed for good
+// by Purge once the retention period has passed.
+type UserRecord struct {
+	ID           int
+	Name         string
+	Username     string
+	PasswordHash string
+	Version      int64
+	UpdatedAt    time.Time
+	DeletedAt    *time.Time
+}
+
+var (
+	errUserNotFound  = errors.New("user not found")
+	errUsernameTaken = errors.New("username already taken")
+	// errVersionConflict means the user changed since the caller read it.
+	errVersionConflict = errors.New("user was modified concurrently")
+)
+
+type UserStore interface {
+	// Create stores u and returns it with its new ID.
+	Create(ctx context.Context, u UserRecord) (UserRecord, error)
+	// CreateBatch stores users all at once: either every one of them or,
+	// on error, none. It returns errUsernameTaken like Create.
+	CreateBatch(ctx context.Context, users []UserRecord) error
+	// UsernamesTaken reports which of usernames belong to a user, deleted
+	// or not.
+	UsernamesTaken(ctx context.Context, usernames []string) (map[string]bool, error)
+	// Get and FindByUsername return errUserNotFound for unknown users. Get
+	// also returns soft-deleted users; FindByUsername does not.
+	Get(ctx context.Context, id int) (UserRecord, error)
+	FindByUsername(ctx context.Context, username string) (UserRecord, error)
+	// List returns the page of users q selects, in q's order.
+	List(ctx context.Context, q UserQuery) ([]UserRecord, error)
+	// Count returns how many users match q's filters, ignoring its paging.
+	Count(ctx context.Context, q UserQuery) (int, error)
+	// Update replaces the stored user with u.ID if it is still at
+	// u.Version and not deleted, returning it with its new version, or
+	// errVersionConflict if not. Version 0 skips the version check.
+	// Create and Update return errUsernameTaken when another user already
+	// has u.Username.
+	Update(ctx context.Context, u UserRecord) (UserRecord, error)
+	// Delete soft-deletes the user with id if it is at version, with the
+	// same rules as Update. It bumps the version like an update.
+	Delete(ctx context.Context, id int, version int64) error
+	// Restore undoes Delete and returns the restored user, or
+	// errUserNotFound when no soft-deleted user has id.
+	Restore(ctx context.Context, id int) (UserRecord, error)
+	// Purge removes the users soft-deleted before cutoff and returns how
+	// many there were.
+	Purge(ctx context.Context, cutoff time.Time) (int, error)
+}
+
+var userStore UserStore
+
+func loadUserStore() (UserStore, error) {
+	switch v := os.Getenv("USER_STORE"); v {
+	case "", "postgres":
+		if db == nil {
+			return nil, fmt.Errorf("USER_STORE=postgres needs DATABASE_URL")
+		}
+		return postgresUserStore{}, nil
+	case "sqlite":
+		path := os.Getenv("SQLITE_PATH")
+		if path == "" {
+			path = "users.db"
+		}
+		return openSQLiteUserStore(path)
+	case "memory":
+		return newMemoryUserStore(), nil
+	default:
+		return nil, fmt.Errorf("USER_STORE must be postgres, sqlite or memory, got %q", v)
+	}
+}
+
+type postgresUserStore struct{}
+
+// isPostgresUniqueViolation reports whether err is Postgres rejecting a
+// duplicate key (SQLSTATE 23505 unique_violation). username is the only
+// unique column a client can set.
+func isPostgresUniqueViolation(err error) bool {
+	var pgErr *pgconn.PgError
+	return errors.As(err, &pgErr) && pgErr.Code == "23505"
+}
+
+const postgresUserColumns = "id, name, username, password, version, updated_at, deleted_at"
+
+func scanPostgresUser(row pgx.Row) (UserRecord, error) {
+	var u UserRecord
+	err := row.Scan(&u.ID, &u.Name, &u.Username, &u.PasswordHash, &u.Version, &u.UpdatedAt, &u.DeletedAt)
+	if errors.Is(err, pgx.ErrNoRows) {
+		return UserRecord{}, errUserNotFound
+	}
+	return u, err
+}
+
+func (postgresUserStore) Create(ctx context.Context, u UserRecord) (UserRecord, error) {
+	err := db.QueryRow(ctx, "INSERT INTO users (name, username, password) VALUES ($1, $2, $3) RETURNING id, version, updated_at",
+		u.Name, u.Username, u.PasswordHash).Scan(&u.ID, &u.Version, &u.UpdatedAt)
+	if isPostgresUniqueViolation(err) {
+		return UserRecord{}, errUsernameTaken
+	}
+	return u, err
+}
+
+// CreateBatch streams users in with COPY, which is a single statement and so
+// stores all rows or none.
+func (postgresUserStore) CreateBatch(ctx context.Context, users []UserRecord) error {
+	_, err := db.CopyFrom(ctx, pgx.Identifier{"users"}, []string{"name", "username", "password"},
+		pgx.CopyFromSlice(len(users), func(i int) ([]any, error) {
+			return []any{users[i].Name, users[i].Username, users[i].PasswordHash}, nil
+		}))
+	if isPostgresUniqueViolation(err) {
+		return errUsernameTaken
+	}
+	return err
+}
+
+func (postgresUserStore) UsernamesTaken(ctx context.Context, usernames []string) (map[string]bool, error) {
+	rows, err := db.Query(ctx, "SELECT username FROM users WHERE username = ANY($1)", usernames)
+	if err != nil {
+		return nil, err
+	}
+	taken, err := pgx.CollectRows(rows, pgx.RowTo[string])
+	if err != nil {
+		return nil, err
+	}
+	set := make(map[string]bool, len(taken))
+	for _, username := range taken {
+		set[username] = true
+	}
+	return set, nil
+}
+
+func (postgresUserStore) Get(ctx context.Context, id int) (UserRecord, error) {
+	return scanPostgresUser(db.QueryRow(ctx, "SELECT "+postgresUserColumns+" FROM users WHERE id = $1", id))
+}
+
+func (postgresUserStore) FindByUsername(ctx context.Context, username string) (UserRecord, error) {
+	return scanPostgresUser(db.QueryRow(ctx, "SELECT "+postgresUserColumns+" FROM users WHERE username = $1 AND deleted_at IS NULL", username))
+}
+
+func postgresPlaceholder(n int) string {
+	return "$" + strconv.Itoa(n)
+}
+
+func (postgresUserStore) List(ctx context.Context, q UserQuery) ([]UserRecord, error) {
+	clauses, args := userListSQL(q, postgresPlaceholder)
+	rows, err := db.Query(ctx, "SELECT "+postgresUserColumns+" FROM users"+clauses, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	users := []UserRecord{}
+	for rows.Next() {
+		u, err := scanPostgresUser(rows)
+		if err != nil {
+			return nil, err
+		}
+		users = append(users, u)
+	}
+	return users, rows.Err()
+}
+
+func (postgresUserStore) Count(ctx context.Context, q UserQuery) (int, error) {
+	where, args := userConditionsSQL(q, postgresPlaceholder)
+	var n int
+	err := db.QueryRow(ctx, "SELECT count(*) FROM users"+whereClause(where), args...).Scan(&n)
+	return n, err
+}
+
+func (postgresUserStore) Update(ctx context.Context, u UserRecord) (UserRecord, error) {
+	err := db.QueryRow(ctx, `UPDATE users SET name = $2, username = $3, password = $4, version = version + 1, updated_at = now()
+		WHERE id = $1 AND deleted_at IS NULL AND ($5::bigint = 0 OR version = $5) RETURNING version, updated_at`,
+		u.ID, u.Name, u.Username, u.PasswordHash, u.Version).Scan(&u.Version, &u.UpdatedAt)
+	if errors.Is(err, pgx.ErrNoRows) {
+		return UserRecord{}, postgresMissedUser(ctx, u.ID)
+	}
+	if isPostgresUniqueViolation(err) {
+		return UserRecord{}, errUsernameTaken
+	}
+	if err != nil {
+		return UserRecord{}, err
+	}
+	return u, nil
+}
+
+func (postgresUserStore) Delete(ctx context.Context, id int, version int64) error {
+	tag, err := db.Exec(ctx, `UPDATE users SET deleted_at = now(), version = version + 1, updated_at = now()
+		WHERE id = $1 AND deleted_at IS NULL AND ($2::bigint = 0 OR version = $2)`, id, version)
+	if err != nil {
+		return err
+	}
+	if tag.RowsAffected() == 0 {
+		return postgresMissedUser(ctx, id)
+	}
+	return nil
+}
+
+func (postgresUserStore) Restore(ctx context.Context, id int) (UserRecord, error) {
+	return scanPostgresUser(db.QueryRow(ctx, `UPDATE users SET deleted_at = NULL, version = version + 1, updated_at = now()
+		WHERE id = $1 AND deleted_at IS NOT NULL RETURNING `+postgresUserColumns, id))
+}
+
+func (postgresUserStore) Purge(ctx context.Context, cutoff time.Time) (int, error) {
+	tag, err := db.Exec(ctx, "DELETE FROM users WHERE deleted_at < $1", cutoff)
+	if err != nil {
+		return 0, err
+	}
+	return int(tag.RowsAffected()), nil
+}
+
+// postgresMissedUser explains why a versioned write matched no row: the user
+// is gone, or it is at another version.
+func postgresMissedUser(ctx context.Context, id int) error {
+	var exists bool
+	if err := db.QueryRow(ctx, "SELECT EXISTS (SELECT 1 FROM users WHERE id = $1)", id).Scan(&exists); err != nil {
+		return err
+	}
+	if exists {
+		return errVersionConflict
+	}
+	return errUserNotFound
+}
+
+type memoryUserStore struct {
+	mu     sync.Mutex
+	nextID int
+	users  map[int]UserRecord
+}
+
+func newMemoryUserStore() *memoryUserStore {
+	return &memoryUserStore{nextID: 1, users: map[int]UserRecord{}}
+}
+
+// usernameTaken reports whether another user than id has username. Callers
+// hold m.mu.
+func (m *memoryUserStore) usernameTaken(username string, id int) bool {
+	for _, u := range m.users {
+		if u.ID != id && u.Username == username {
+			return true
+		}
+	}
+	return false
+}
+
+func (m *memoryUserStore) Create(ctx context.Context, u UserRecord) (UserRecord, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.usernameTaken(u.Username, 0) {
+		return UserRecord{}, errUsernameTaken
+	}
+	u.ID = m.nextID
+	m.nextID++
+	u.Version, u.UpdatedAt = 1, time.Now().UTC()
+	m.users[u.ID] = u
+	return u, nil
+}
+
+func (m *memoryUserStore) CreateBatch(ctx context.Context, users []UserRecord) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	seen := map[string]bool{}
+	for _, u := range users {
+		if seen[u.Username] || m.usernameTaken(u.Username, 0) {
+			return errUsernameTaken
+		}
+		seen[u.Username] = true
+	}
+	now := time.Now().UTC()
+	for _, u := range users {
+		u.ID = m.nextID
+		m.nextID++
+		u.Version, u.UpdatedAt = 1, now
+		m.users[u.ID] = u
+	}
+	return nil
+}
+
+func (m *memoryUserStore) UsernamesTaken(ctx context.Context, usernames []string) (map[string]bool, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	wanted := map[string]bool{}
+	for _, username := range usernames {
+		wanted[username] = true
+	}
+	taken := map[string]bool{}
+	for _, u := range m.users {
+		if wanted[u.Username] {
+			taken[u.Username] = true
+		}
+	}
+	return taken, nil
+}
+
+func (m *memoryUserStore) Get(ctx context.Context, id int) (UserRecord, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	u, ok := m.users[id]
+	if !ok {
+		return UserRecord{}, errUserNotFound
+	}
+	return u, nil
+}
+
+func (m *memoryUserStore) FindByUsername(ctx context.Context, username string) (UserRecord, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for _, u := range m.users {
+		if u.Username == username && u.DeletedAt == nil {
+			return u, nil
+		}
+	}
+	return UserRecord{}, errUserNotFound
+}
+
+func (m *memoryUserStore) List(ctx context.Context, q UserQuery) ([]UserRecord, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	users := []UserRecord{}
+	for _, u := range m.users {
+		if matchesUserQuery(u, q) {
+			users = append(users, u)
+		}
+	}
+	// order is -1 when walking descending, so compareUserKeys*order > 0
+	// means "after" in the requested direction.
+	order := 1
+	if q.Desc {
+		order = -1
+	}
+	sort.Slice(users, func(i, j int) bool {
+		return compareUserKeys(userKeyOf(users[i], q.Sort), userKeyOf(users[j], q.Sort), q.Sort)*order < 0
+	})
+	if q.After != nil {
+		i := sort.Search(len(users), func(i int) bool {
+			return compareUserKeys(userKeyOf(users[i], q.Sort), *q.After, q.Sort)*order > 0
+		})
+		users = users[i:]
+	}
+	users = users[min(q.Offset, len(users)):]
+	return users[:min(q.Limit, len(users))], nil
+}
+
+func (m *memoryUserStore) Count(ctx context.Context, q UserQuery) (int, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	n := 0
+	for _, u := range m.users {
+		if matchesUserQuery(u, q) {
+			n++
+		}
+	}
+	return n, nil
+}
+
+func (m *memoryUserStore) Update(ctx context.Context, u UserRecord) (UserRecord, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	current, ok := m.users[u.ID]
+	if !ok {
+		return UserRecord{}, errUserNotFound
+	}
+	if current.DeletedAt != nil || (u.Version != 0 && u.Version != current.Version) {
+		return UserRecord{}, errVersionConflict
+	}
+	if m.usernameTaken(u.Username, u.ID) {
+		return UserRecord{}, errUsernameTaken
+	}
+	u.Version, u.UpdatedAt = current.Version+1, time.Now().UTC()
+	m.users[u.ID] = u
+	return u, nil
+}
+
+func (m *memoryUserStore) Delete(ctx context.Context, id int, version int64) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	u, ok := m.users[id]
+	if !ok {
+		return errUserNotFound
+	}
+	if u.DeletedAt != nil || (version != 0 && version != u.Version) {
+		return errVersionConflict
+	}
+	now := time.Now().UTC()
+	u.Version, u.UpdatedAt, u.DeletedAt = u.Version+1, now, &now
+	m.users[id] = u
+	return nil
+}
+
+func (m *memoryUserStore) Restore(ctx context.Context, id int) (UserRecord, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	u, ok := m.users[id]
+	if !ok || u.DeletedAt == nil {
+		return UserRecord{}, errUserNotFound
+	}
+	u.Version, u.UpdatedAt, u.DeletedAt = u.Version+1, time.Now().UTC(), nil
+	m.users[id] = u
+	return u, nil
+}
+
+func (m *memoryUserStore) Purge(ctx context.Context, cutoff time.Time) (int, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	n := 0
+	for id, u := range m.users {
+		if u.DeletedAt != nil && u.DeletedAt.Before(cutoff) {
+			delete(m.users, id)
+			n++
+		}
+	}
+	return n, nil
+}
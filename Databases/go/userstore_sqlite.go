@@ -0,0 +1,275 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"modernc.org/sqlite"
+	sqlite3 "modernc.org/sqlite/lib"
+)
+
+// sqliteUserStore keeps users in a local SQLite file through a pure-Go
+// driver, so the service runs without cgo or a database server.
+type sqliteUserStore struct {
+	db *sql.DB
+}
+
+func openSQLiteUserStore(path string) (*sqliteUserStore, error) {
+	conn, err := sql.Open("sqlite", path)
+	if err != nil {
+		return nil, fmt.Errorf("SQLITE_PATH: %w", err)
+	}
+	// SQLite allows a single writer; one connection avoids SQLITE_BUSY.
+	conn.SetMaxOpenConns(1)
+	_, err = conn.Exec(`CREATE TABLE IF NOT EXISTS users (
+		id         INTEGER PRIMARY KEY AUTOINCREMENT,
+		name       TEXT NOT NULL,
+		username   TEXT NOT NULL UNIQUE,
+		password   TEXT NOT NULL,
+		version    INTEGER NOT NULL DEFAULT 1,
+		updated_at DATETIME,
+		deleted_at DATETIME
+	)`)
+	if err == nil {
+		err = upgradeSQLiteUsers(conn)
+	}
+	if err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("SQLITE_PATH: %w", err)
+	}
+	return &sqliteUserStore{db: conn}, nil
+}
+
+// upgradeSQLiteUsers adds the version, updated_at and deleted_at columns to
+// files created before they existed. SQLite cannot add a column defaulting
+// to the current time, so updated_at is backfilled instead.
+func upgradeSQLiteUsers(conn *sql.DB) error {
+	rows, err := conn.Query("SELECT name FROM pragma_table_info('users')")
+	if err != nil {
+		return err
+	}
+	columns := map[string]bool{}
+	for rows.Next() {
+		var name string
+		if err := rows.Scan(&name); err != nil {
+			rows.Close()
+			return err
+		}
+		columns[name] = true
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return err
+	}
+
+	if !columns["version"] {
+		if _, err := conn.Exec("ALTER TABLE users ADD COLUMN version INTEGER NOT NULL DEFAULT 1"); err != nil {
+			return err
+		}
+	}
+	if !columns["updated_at"] {
+		if _, err := conn.Exec("ALTER TABLE users ADD COLUMN updated_at DATETIME"); err != nil {
+			return err
+		}
+	}
+	if !columns["deleted_at"] {
+		if _, err := conn.Exec("ALTER TABLE users ADD COLUMN deleted_at DATETIME"); err != nil {
+			return err
+		}
+	}
+	_, err = conn.Exec("UPDATE users SET updated_at = ? WHERE updated_at IS NULL", time.Now().UTC())
+	return err
+}
+
+// isSQLiteUniqueViolation reports whether err is SQLite rejecting a
+// duplicate value in a UNIQUE column.
+func isSQLiteUniqueViolation(err error) bool {
+	var sqliteErr *sqlite.Error
+	return errors.As(err, &sqliteErr) && sqliteErr.Code() == sqlite3.SQLITE_CONSTRAINT_UNIQUE
+}
+
+const sqliteUserColumns = "id, name, username, password, version, updated_at, deleted_at"
+
+type sqliteScanner interface {
+	Scan(dest ...any) error
+}
+
+func scanSQLiteUser(row sqliteScanner) (UserRecord, error) {
+	var u UserRecord
+	err := row.Scan(&u.ID, &u.Name, &u.Username, &u.PasswordHash, &u.Version, &u.UpdatedAt, &u.DeletedAt)
+	if errors.Is(err, sql.ErrNoRows) {
+		return UserRecord{}, errUserNotFound
+	}
+	return u, err
+}
+
+func (s *sqliteUserStore) Create(ctx context.Context, u UserRecord) (UserRecord, error) {
+	u.Version, u.UpdatedAt = 1, time.Now().UTC()
+	res, err := s.db.ExecContext(ctx, "INSERT INTO users (name, username, password, version, updated_at) VALUES (?, ?, ?, ?, ?)",
+		u.Name, u.Username, u.PasswordHash, u.Version, u.UpdatedAt)
+	if isSQLiteUniqueViolation(err) {
+		return UserRecord{}, errUsernameTaken
+	}
+	if err != nil {
+		return UserRecord{}, err
+	}
+	id, err := res.LastInsertId()
+	if err != nil {
+		return UserRecord{}, err
+	}
+	u.ID = int(id)
+	return u, nil
+}
+
+func (s *sqliteUserStore) CreateBatch(ctx context.Context, users []UserRecord) error {
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	stmt, err := tx.PrepareContext(ctx, "INSERT INTO users (name, username, password, version, updated_at) VALUES (?, ?, ?, 1, ?)")
+	if err != nil {
+		return err
+	}
+	defer stmt.Close()
+	now := time.Now().UTC()
+	for _, u := range users {
+		_, err := stmt.ExecContext(ctx, u.Name, u.Username, u.PasswordHash, now)
+		if isSQLiteUniqueViolation(err) {
+			return errUsernameTaken
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+func (s *sqliteUserStore) UsernamesTaken(ctx context.Context, usernames []string) (map[string]bool, error) {
+	taken := map[string]bool{}
+	if len(usernames) == 0 {
+		return taken, nil
+	}
+	args := make([]any, len(usernames))
+	for i, username := range usernames {
+		args[i] = username
+	}
+	placeholders := strings.Repeat(", ?", len(usernames))[2:]
+	rows, err := s.db.QueryContext(ctx, "SELECT username FROM users WHERE username IN ("+placeholders+")", args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var username string
+		if err := rows.Scan(&username); err != nil {
+			return nil, err
+		}
+		taken[username] = true
+	}
+	return taken, rows.Err()
+}
+
+func (s *sqliteUserStore) Get(ctx context.Context, id int) (UserRecord, error) {
+	return scanSQLiteUser(s.db.QueryRowContext(ctx, "SELECT "+sqliteUserColumns+" FROM users WHERE id = ?", id))
+}
+
+func (s *sqliteUserStore) FindByUsername(ctx context.Context, username string) (UserRecord, error) {
+	return scanSQLiteUser(s.db.QueryRowContext(ctx, "SELECT "+sqliteUserColumns+" FROM users WHERE username = ? AND deleted_at IS NULL", username))
+}
+
+func sqlitePlaceholder(int) string {
+	return "?"
+}
+
+func (s *sqliteUserStore) List(ctx context.Context, q UserQuery) ([]UserRecord, error) {
+	clauses, args := userListSQL(q, sqlitePlaceholder)
+	rows, err := s.db.QueryContext(ctx, "SELECT "+sqliteUserColumns+" FROM users"+clauses, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	users := []UserRecord{}
+	for rows.Next() {
+		u, err := scanSQLiteUser(rows)
+		if err != nil {
+			return nil, err
+		}
+		users = append(users, u)
+	}
+	return users, rows.Err()
+}
+
+func (s *sqliteUserStore) Count(ctx context.Context, q UserQuery) (int, error) {
+	where, args := userConditionsSQL(q, sqlitePlaceholder)
+	var n int
+	err := s.db.QueryRowContext(ctx, "SELECT count(*) FROM users"+whereClause(where), args...).Scan(&n)
+	return n, err
+}
+
+func (s *sqliteUserStore) Update(ctx context.Context, u UserRecord) (UserRecord, error) {
+	now := time.Now().UTC()
+	err := s.db.QueryRowContext(ctx, `UPDATE users SET name = ?, username = ?, password = ?, version = version + 1, updated_at = ?
+		WHERE id = ? AND deleted_at IS NULL AND (? = 0 OR version = ?) RETURNING version`,
+		u.Name, u.Username, u.PasswordHash, now, u.ID, u.Version, u.Version).Scan(&u.Version)
+	if errors.Is(err, sql.ErrNoRows) {
+		return UserRecord{}, s.missedUser(ctx, u.ID)
+	}
+	if isSQLiteUniqueViolation(err) {
+		return UserRecord{}, errUsernameTaken
+	}
+	if err != nil {
+		return UserRecord{}, err
+	}
+	u.UpdatedAt = now
+	return u, nil
+}
+
+func (s *sqliteUserStore) Delete(ctx context.Context, id int, version int64) error {
+	now := time.Now().UTC()
+	res, err := s.db.ExecContext(ctx, `UPDATE users SET deleted_at = ?, version = version + 1, updated_at = ?
+		WHERE id = ? AND deleted_at IS NULL AND (? = 0 OR version = ?)`, now, now, id, version, version)
+	if err != nil {
+		return err
+	}
+	n, err := res.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if n == 0 {
+		return s.missedUser(ctx, id)
+	}
+	return nil
+}
+
+func (s *sqliteUserStore) Restore(ctx context.Context, id int) (UserRecord, error) {
+	return scanSQLiteUser(s.db.QueryRowContext(ctx, `UPDATE users SET deleted_at = NULL, version = version + 1, updated_at = ?
+		WHERE id = ? AND deleted_at IS NOT NULL RETURNING `+sqliteUserColumns, time.Now().UTC(), id))
+}
+
+func (s *sqliteUserStore) Purge(ctx context.Context, cutoff time.Time) (int, error) {
+	res, err := s.db.ExecContext(ctx, "DELETE FROM users WHERE deleted_at < ?", cutoff.UTC())
+	if err != nil {
+		return 0, err
+	}
+	n, err := res.RowsAffected()
+	return int(n), err
+}
+
+// missedUser explains why a versioned write matched no row: the user is
+// gone, or it is at another version.
+func (s *sqliteUserStore) missedUser(ctx context.Context, id int) error {
+	var exists bool
+	if err := s.db.QueryRowContext(ctx, "SELECT EXISTS (SELECT 1 FROM users WHERE id = ?)", id).Scan(&exists); err != nil {
+		return err
+	}
+	if exists {
+		return errVersionConflict
+	}
+	return errUserNotFound
+}
@@ -0,0 +1,71 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"regexp"
+	"strings"
+	"unicode/utf8"
+)
+
+// FieldError is one failed rule on one input field.
+type FieldError struct {
+	Field   string `json:"field"`
+	Rule    string `json:"rule"`
+	Message string `json:"message"`
+}
+
+// ValidationError is the 422 body listing every rule an input broke, so
+// clients can show all problems at once instead of one per attempt.
+type ValidationError struct {
+	Message string       `json:"message"`
+	Errors  []FieldError `json:"errors"`
+}
+
+func writeValidationError(w http.ResponseWriter, message string, errs []FieldError) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusUnprocessableEntity)
+	json.NewEncoder(w).Encode(ValidationError{Message: message, Errors: errs})
+}
+
+// Limits on user profile fields. Usernames appear in URLs, tokens and logs,
+// so they are restricted to a small ASCII set.
+const (
+	maxNameLength     = 100
+	minUsernameLength = 3
+	maxUsernameLength = 32
+)
+
+var usernamePattern = regexp.MustCompile(`^[A-Za-z0-9._-]+$`)
+
+// validateUserFields checks the profile fields every stored user must have.
+func validateUserFields(name, username string) []FieldError {
+	var errs []FieldError
+	if strings.TrimSpace(name) == "" {
+		errs = append(errs, FieldError{Field: "name", Rule: "required", Message: "is required"})
+	} else if utf8.RuneCountInString(name) > maxNameLength {
+		errs = append(errs, FieldError{Field: "name", Rule: "max_length", Message: fmt.Sprintf("must be at most %d characters", maxNameLength)})
+	}
+
+	switch n := len(username); {
+	case strings.TrimSpace(username) == "":
+		errs = append(errs, FieldError{Field: "username", Rule: "required", Message: "is required"})
+	case !usernamePattern.MatchString(username):
+		errs = append(errs, FieldError{Field: "username", Rule: "charset", Message: "may only contain letters, digits, '.', '_' and '-'"})
+	case n < minUsernameLength:
+		errs = append(errs, FieldError{Field: "username", Rule: "min_length", Message: fmt.Sprintf("must be at least %d characters", minUsernameLength)})
+	case n > maxUsernameLength:
+		errs = append(errs, FieldError{Field: "username", Rule: "max_length", Message: fmt.Sprintf("must be at most %d characters", maxUsernameLength)})
+	}
+	return errs
+}
+
+// validate returns every rule cu breaks, including the password policy.
+func (cu CreateUser) validate() []FieldError {
+	errs := validateUserFields(cu.Name, cu.Username)
+	if cu.Password == "" {
+		return append(errs, FieldError{Field: "password", Rule: "required", Message: "is required"})
+	}
+	return append(errs, passwordRules.check(cu.Username, cu.Password)...)
+}
@@ -0,0 +1,348 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+// Password reset and email verification links carry purpose tokens (see
+// generatePurposeToken). Each token's jti is recorded in used_tokens when it
+// is spent, so a link works once:
+//
+//	jti (primary key), purpose, expires_at, used_at
+//
+// Whether an address has been confirmed is kept in users.email_verified.
+const (
+	passwordResetAudience = "password-reset"
+	passwordResetTTL      = 30 * time.Minute
+	verifyEmailAudience   = "verify-email"
+	verifyEmailTTL        = 24 * time.Hour
+)
+
+const (
+	auditPasswordReset = "password.reset"
+	auditEmailVerified = "email.verified"
+)
+
+var (
+	errTokenInvalid = errors.New("token is invalid or expired")
+	errTokenUsed    = errors.New("token has already been used")
+)
+
+type PasswordResetRequest struct {
+	Username string `json:"username"`
+}
+
+type PasswordReset struct {
+	Token    string `json:"token"`
+	Password string `json:"password"`
+}
+
+// appBaseURL is where links in outgoing mail point, from APP_BASE_URL.
+func appBaseURL() string {
+	if v := os.Getenv("APP_BASE_URL"); v != "" {
+		return strings.TrimRight(v, "/")
+	}
+	return "http://localhost:8080"
+}
+
+// purposeToken is a checked password reset or verification token.
+type purposeToken struct {
+	Username string
+	Audience string
+	JTI      string
+	Expires  time.Time
+}
+
+// readPurposeToken checks a purpose token without spending it.
+func readPurposeToken(tokenString, audience string) (purposeToken, error) {
+	claims, err := parsePurposeToken(tokenString, audience)
+	if err != nil {
+		return purposeToken{}, fmt.Errorf("%w: %v", errTokenInvalid, err)
+	}
+	username, _ := claims.GetSubject()
+	jti, _ := claims["jti"].(string)
+	exp, _ := claims.GetExpirationTime()
+	if username == "" || jti == "" || exp == nil {
+		return purposeToken{}, errTokenInvalid
+	}
+	return purposeToken{Username: username, Audience: audience, JTI: jti, Expires: exp.Time}, nil
+}
+
+// spendToken marks t used, returning errTokenUsed when it already was.
+func spendToken(ctx context.Context, t purposeToken) error {
+	tag, err := db.Exec(ctx, "INSERT INTO used_tokens (jti, purpose, expires_at) VALUES ($1, $2, $3) ON CONFLICT (jti) DO NOTHING",
+		t.JTI, t.Audience, t.Expires)
+	if err != nil {
+		return err
+	}
+	if tag.RowsAffected() == 0 {
+		return errTokenUsed
+	}
+	return nil
+}
+
+// userEmail returns a user's decrypted email, or "" if none is stored.
+func userEmail(ctx context.Context, username string) (email string, verified bool, err error) {
+	u, err := userStore.FindByUsername(ctx, username)
+	if err != nil {
+		return "", false, err
+	}
+	if strings.TrimSpace(u.Email) == "" {
+		return "", u.EmailVerified, nil
+	}
+	email, err = decryptEmail(u)
+	return email, u.EmailVerified, err
+}
+
+func sendVerificationEmail(ctx context.Context, username, email string) error {
+	token, err := generatePurposeToken(username, verifyEmailAudience, verifyEmailTTL)
+	if err != nil {
+		return err
+	}
+	link := appBaseURL() + "/verifyEmail?token=" + url.QueryEscape(token)
+	return mailer.Send(ctx, Message{
+		To:      email,
+		Subject: "Confirm your email address",
+		Body: fmt.Sprintf("Hi %s,\n\nConfirm this is your email address by opening the link below:\n\n%s\n\nThe link expires in %s.\n",
+			username, link, verifyEmailTTL),
+	})
+}
+
+// requestPasswordResetHandler godoc
+// @Summary Request a password reset
+// @Description Emails a single-use password reset link to the user's address. The response is the same whether or not the user exists.
+// @Tags account
+// @Accept json
+// @Param request body PasswordResetRequest true "Account to reset"
+// @Success 202 {string} string "If the account exists, a reset link has been sent"
+// @Failure 400 {string} string "Username required"
+// @Failure 429 {string} string "Too many reset requests, try again later"
+// @Failure 504 {string} string "Database timed out"
+// @Router /requestPasswordReset [post]
+func requestPasswordResetHandler(w http.ResponseWriter, r *http.Request) {
+	var pr PasswordResetRequest
+	if err := json.NewDecoder(r.Body).Decode(&pr); err != nil {
+		http.Error(w, "Invalid input", http.StatusBadRequest)
+		return
+	}
+	if strings.TrimSpace(pr.Username) == "" {
+		http.Error(w, "Username required", http.StatusBadRequest)
+		return
+	}
+	// Every request counts, whether or not the user exists, so the limit
+	// reveals nothing either.
+	counters := resetRequestCounters(r, pr.Username)
+	if !checkCounters(w, r, counters, "Too many reset requests, try again later") {
+		return
+	}
+	recordAttempt(r, pr.Username, counters)
+
+	// Failures are only logged: telling the caller would reveal which
+	// usernames exist.
+	ctx, cancel := writeContext(r)
+	defer cancel()
+	if err := sendPasswordReset(ctx, pr.Username); err != nil {
+		fmt.Println("password reset for", pr.Username, "not sent:", err)
+	}
+	w.WriteHeader(http.StatusAccepted)
+	fmt.Fprintln(w, "If the account exists, a reset link has been sent")
+}
+
+func sendPasswordReset(ctx context.Context, username string) error {
+	email, _, err := userEmail(ctx, username)
+	if err != nil {
+		return err
+	}
+	if email == "" {
+		return errors.New("user has no email address")
+	}
+
+	token, err := generatePurposeToken(username, passwordResetAudience, passwordResetTTL)
+	if err != nil {
+		return err
+	}
+	link := appBaseURL() + "/resetPassword?token=" + url.QueryEscape(token)
+	return mailer.Send(ctx, Message{
+		To:      email,
+		Subject: "Reset your password",
+		Body: fmt.Sprintf("Hi %s,\n\nSomeone asked to reset your password. If it was you, use the link below:\n\n%s\n\nThe link expires in %s and works once. If you did not ask for this, ignore this email.\n",
+			username, link, passwordResetTTL),
+	})
+}
+
+// resetPasswordHandler godoc
+// @Summary Reset a password
+// @Description Sets a new password using the token from a password reset email. Each token works once. The user's sessions are ended and the access tokens issued to it so far stop working.
+// @Tags account
+// @Accept json
+// @Param reset body PasswordReset true "Reset token and new password"
+// @Success 204
+// @Failure 400 {string} string "Invalid input" or "Password required"
+// @Failure 401 {string} string "Invalid or expired token"
+// @Failure 422 {object} ValidationError
+// @Failure 500 {string} string "DB error"
+// @Failure 504 {string} string "Database timed out"
+// @Router /resetPassword [post]
+func resetPasswordHandler(w http.ResponseWriter, r *http.Request) {
+	var pr PasswordReset
+	if err := json.NewDecoder(r.Body).Decode(&pr); err != nil {
+		http.Error(w, "Invalid input", http.StatusBadRequest)
+		return
+	}
+	if strings.TrimSpace(pr.Password) == "" {
+		http.Error(w, "Password required", http.StatusBadRequest)
+		return
+	}
+
+	token, err := readPurposeToken(pr.Token, passwordResetAudience)
+	if err != nil {
+		writeTokenError(w, r, err)
+		return
+	}
+	username := token.Username
+	// The password is checked before the token is spent, so a rejected
+	// password can be retried with the same link.
+	if errs := passwordRules.check(username, pr.Password); errs != nil {
+		writeValidationError(w, "Password does not meet the password policy", errs)
+		return
+	}
+	hashedPw, err := bcrypt.GenerateFromPassword([]byte(pr.Password), bcrypt.DefaultCost)
+	if err != nil {
+		http.Error(w, "Failed to hash password", http.StatusInternalServerError)
+		return
+	}
+
+	ctx, cancel := writeContext(r)
+	defer cancel()
+
+	if err := spendToken(ctx, token); err != nil {
+		writeTokenError(w, r, err)
+		return
+	}
+	err = userStore.SetPassword(ctx, username, string(hashedPw))
+	if errors.Is(err, errUserNotFound) {
+		http.Error(w, "Invalid or expired token", http.StatusUnauthorized)
+		return
+	}
+	if err != nil {
+		writeDBError(w, r, err, "DB error")
+		return
+	}
+	// SetPassword revoked the user's access tokens; its sessions go too.
+	if err := sessions.DeleteUser(ctx, username); err != nil {
+		fmt.Println("ending sessions after password reset failed:", err)
+	}
+
+	// Proving control of the mailbox is as good as a correct password, so
+	// the account's lockout is lifted too.
+	recordLoginSuccess(r, username)
+	recordAudit(ctx, auditEvent{Event: auditPasswordReset, Actor: username, Subject: userAttemptKey(username), IP: clientIP(r)})
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// requestEmailVerificationHandler godoc
+// @Summary Send an email verification link
+// @Description Emails a link that confirms the caller's address
+// @Tags account
+// @Success 202 {string} string "Verification email sent"
+// @Failure 400 {string} string "No email address on file"
+// @Failure 409 {string} string "Email already verified"
+// @Failure 500 {string} string "DB error" or "Failed to send email"
+// @Failure 504 {string} string "Database timed out"
+// @Router /requestEmailVerification [post]
+func requestEmailVerificationHandler(w http.ResponseWriter, r *http.Request) {
+	principal, ok := principalFromContext(r.Context())
+	if !ok || principal.Username == "" {
+		writeUnauthorized(w, "")
+		return
+	}
+
+	ctx, cancel := writeContext(r)
+	defer cancel()
+
+	email, verified, err := userEmail(ctx, principal.Username)
+	if errors.Is(err, errUserNotFound) {
+		http.Error(w, "User not found", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		writeDBError(w, r, err, "DB error")
+		return
+	}
+	if email == "" {
+		http.Error(w, "No email address on file", http.StatusBadRequest)
+		return
+	}
+	if verified {
+		http.Error(w, "Email already verified", http.StatusConflict)
+		return
+	}
+
+	if err := sendVerificationEmail(ctx, principal.Username, email); err != nil {
+		fmt.Println("sending verification email failed:", err)
+		http.Error(w, "Failed to send email", http.StatusInternalServerError)
+		return
+	}
+	w.WriteHeader(http.StatusAccepted)
+	fmt.Fprintln(w, "Verification email sent")
+}
+
+// verifyEmailHandler godoc
+// @Summary Verify an email address
+// @Description Confirms the address using the token from a verification email. Each token works once.
+// @Tags account
+// @Param token query string true "Verification token"
+// @Success 200 {string} string "Email verified"
+// @Failure 401 {string} string "Invalid or expired token"
+// @Failure 500 {string} string "DB error"
+// @Failure 504 {string} string "Database timed out"
+// @Router /verifyEmail [get]
+func verifyEmailHandler(w http.ResponseWriter, r *http.Request) {
+	token, err := readPurposeToken(r.URL.Query().Get("token"), verifyEmailAudience)
+	if err != nil {
+		writeTokenError(w, r, err)
+		return
+	}
+	username := token.Username
+
+	ctx, cancel := writeContext(r)
+	defer cancel()
+
+	if err := spendToken(ctx, token); err != nil {
+		writeTokenError(w, r, err)
+		return
+	}
+	err = userStore.SetEmailVerified(ctx, username)
+	if errors.Is(err, errUserNotFound) {
+		http.Error(w, "Invalid or expired token", http.StatusUnauthorized)
+		return
+	}
+	if err != nil {
+		writeDBError(w, r, err, "DB error")
+		return
+	}
+
+	recordAudit(ctx, auditEvent{Event: auditEmailVerified, Actor: username, Subject: username, IP: clientIP(r)})
+	fmt.Fprintln(w, "Email verified")
+}
+
+// writeTokenError maps a readPurposeToken or spendToken failure to a
+// response.
+func writeTokenError(w http.ResponseWriter, r *http.Request, err error) {
+	if errors.Is(err, errTokenInvalid) || errors.Is(err, errTokenUsed) {
+		http.Error(w, "Invalid or expired token", http.StatusUnauthorized)
+		return
+	}
+	fmt.Println("redeeming token failed:", err)
+	writeDBError(w, r, err, "DB error")
+}
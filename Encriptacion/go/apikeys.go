@@ -0,0 +1,302 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+)
+
+// API keys look like moa_<prefix>_<secret>. The prefix is stored in clear so
+// a key can be identified in listings and logs; only the SHA-256 of the whole
+// key is stored. Keys live in the api_keys table:
+//
+//	id, name, prefix (unique), key_hash, scopes (space-delimited), created_by,
+//	created_at, expires_at, last_used_at, revoked_at
+const apiKeyTag = "moa"
+
+var (
+	errAPIKeyInvalid = errors.New("API key is invalid")
+	errAPIKeyExpired = errors.New("API key is expired")
+	errAPIKeyRevoked = errors.New("API key has been revoked")
+)
+
+type APIKey struct {
+	ID         int        `json:"id"`
+	Name       string     `json:"name"`
+	Prefix     string     `json:"prefix"`
+	Scopes     []string   `json:"scopes"`
+	CreatedBy  string     `json:"createdBy"`
+	CreatedAt  time.Time  `json:"createdAt"`
+	ExpiresAt  *time.Time `json:"expiresAt,omitempty"`
+	LastUsedAt *time.Time `json:"lastUsedAt,omitempty"`
+	RevokedAt  *time.Time `json:"revokedAt,omitempty"`
+	// Key is only returned once, when the key is created.
+	Key string `json:"key,omitempty"`
+}
+
+type CreateAPIKey struct {
+	Name   string   `json:"name"`
+	Scopes []string `json:"scopes"`
+	// ExpiresIn is a Go duration such as "720h". Empty means no expiry.
+	ExpiresIn string `json:"expiresIn"`
+}
+
+func (p *Principal) isAPIKey() bool {
+	return strings.HasPrefix(p.Subject, "apikey:")
+}
+
+// apiKeyFromRequest returns the key sent in X-API-Key or as
+// "Authorization: ApiKey <key>", or "" when neither is present.
+func apiKeyFromRequest(r *http.Request) string {
+	if key := strings.TrimSpace(r.Header.Get("X-API-Key")); key != "" {
+		return key
+	}
+	if auth := r.Header.Get("Authorization"); strings.HasPrefix(auth, "ApiKey ") {
+		return strings.TrimSpace(strings.TrimPrefix(auth, "ApiKey "))
+	}
+	return ""
+}
+
+func newAPIKey() (key, prefix string, err error) {
+	p := make([]byte, 4)
+	if _, err := rand.Read(p); err != nil {
+		return "", "", err
+	}
+	secret := make([]byte, 32)
+	if _, err := rand.Read(secret); err != nil {
+		return "", "", err
+	}
+	prefix = hex.EncodeToString(p)
+	key = fmt.Sprintf("%s_%s_%s", apiKeyTag, prefix, base64.RawURLEncoding.EncodeToString(secret))
+	return key, prefix, nil
+}
+
+func hashAPIKey(key string) string {
+	sum := sha256.Sum256([]byte(key))
+	return hex.EncodeToString(sum[:])
+}
+
+func apiKeyPrefix(key string) (string, bool) {
+	parts := strings.SplitN(key, "_", 3)
+	if len(parts) != 3 || parts[0] != apiKeyTag || len(parts[1]) != 8 || parts[2] == "" {
+		return "", false
+	}
+	return parts[1], true
+}
+
+// authenticateAPIKey checks a presented key and records its use. Errors other
+// than the errAPIKey* values mean the key could not be checked at all.
+func authenticateAPIKey(ctx context.Context, key string) (*Principal, error) {
+	if db == nil {
+		return nil, errDatabaseURLNotSet
+	}
+	prefix, ok := apiKeyPrefix(key)
+	if !ok {
+		return nil, errAPIKeyInvalid
+	}
+
+	var (
+		id        int
+		name      string
+		keyHash   string
+		scopes    string
+		expiresAt *time.Time
+		revokedAt *time.Time
+	)
+	err := db.QueryRow(ctx, "SELECT id, name, key_hash, scopes, expires_at, revoked_at FROM api_keys WHERE prefix = $1", prefix).
+		Scan(&id, &name, &keyHash, &scopes, &expiresAt, &revokedAt)
+	if errors.Is(err, pgx.ErrNoRows) {
+		return nil, errAPIKeyInvalid
+	}
+	if err != nil {
+		return nil, err
+	}
+	if subtle.ConstantTimeCompare([]byte(hashAPIKey(key)), []byte(keyHash)) != 1 {
+		return nil, errAPIKeyInvalid
+	}
+	if revokedAt != nil {
+		return nil, errAPIKeyRevoked
+	}
+	if expiresAt != nil && time.Now().After(*expiresAt) {
+		return nil, errAPIKeyExpired
+	}
+
+	if _, err := db.Exec(ctx, "UPDATE api_keys SET last_used_at = now() WHERE id = $1", id); err != nil {
+		fmt.Println("recording API key use failed:", err)
+	}
+
+	return &Principal{
+		Subject: "apikey:" + prefix,
+		Scopes:  strings.Fields(scopes),
+		TokenID: prefix,
+	}, nil
+}
+
+// writeAPIKeyError maps an authenticateAPIKey failure to a response.
+func writeAPIKeyError(w http.ResponseWriter, r *http.Request, err error) {
+	if errors.Is(err, errAPIKeyInvalid) || errors.Is(err, errAPIKeyExpired) || errors.Is(err, errAPIKeyRevoked) {
+		w.Header().Set("WWW-Authenticate", fmt.Sprintf("ApiKey realm=%q, error=\"invalid_key\", error_description=%q", authRealm, err.Error()))
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+	fmt.Println("API key check failed:", err)
+	writeDBError(w, r, err, "Failed to verify API key")
+}
+
+// createAPIKeyHandler godoc
+// @Summary Issue an API key
+// @Description Creates an API key for service-to-service calls. The key is only shown in this response. Scopes must be a subset of the caller's.
+// @Tags apikeys
+// @Accept json
+// @Produce json
+// @Param key body CreateAPIKey true "New API key"
+// @Success 201 {object} APIKey
+// @Failure 400 {string} string "Invalid input"
+// @Failure 403 {string} string "Cannot grant scopes you do not hold"
+// @Failure 500 {string} string "DB error"
+// @Failure 504 {string} string "Database timed out"
+// @Router /createApiKey [post]
+func createAPIKeyHandler(w http.ResponseWriter, r *http.Request) {
+	principal, ok := principalFromContext(r.Context())
+	if !ok {
+		writeUnauthorized(w, "")
+		return
+	}
+
+	var ck CreateAPIKey
+	if err := json.NewDecoder(r.Body).Decode(&ck); err != nil {
+		http.Error(w, "Invalid input", http.StatusBadRequest)
+		return
+	}
+	if strings.TrimSpace(ck.Name) == "" {
+		http.Error(w, "Name required", http.StatusBadRequest)
+		return
+	}
+	if len(ck.Scopes) == 0 {
+		http.Error(w, "At least one scope required", http.StatusBadRequest)
+		return
+	}
+	for _, scope := range ck.Scopes {
+		if !principal.HasScope(scope) {
+			http.Error(w, "Cannot grant scopes you do not hold: "+scope, http.StatusForbidden)
+			return
+		}
+	}
+
+	var expiresAt *time.Time
+	if ck.ExpiresIn != "" {
+		d, err := time.ParseDuration(ck.ExpiresIn)
+		if err != nil || d <= 0 {
+			http.Error(w, "expiresIn must be a positive duration such as 720h", http.StatusBadRequest)
+			return
+		}
+		t := time.Now().Add(d).UTC()
+		expiresAt = &t
+	}
+
+	key, prefix, err := newAPIKey()
+	if err != nil {
+		http.Error(w, "Could not generate key", http.StatusInternalServerError)
+		return
+	}
+
+	ctx, cancel := writeContext(r)
+	defer cancel()
+
+	ak := APIKey{Name: ck.Name, Prefix: prefix, Scopes: ck.Scopes, CreatedBy: principal.actorName(), ExpiresAt: expiresAt, Key: key}
+	err = db.QueryRow(ctx, "INSERT INTO api_keys (name, prefix, key_hash, scopes, created_by, expires_at) VALUES ($1, $2, $3, $4, $5, $6) RETURNING id, created_at",
+		ak.Name, prefix, hashAPIKey(key), strings.Join(ak.Scopes, " "), ak.CreatedBy, expiresAt).Scan(&ak.ID, &ak.CreatedAt)
+	if err != nil {
+		writeDBError(w, r, err, "DB error")
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(ak)
+}
+
+// apiKeysHandler godoc
+// @Summary List API keys
+// @Description Returns every API key without its secret, including expired and revoked ones
+// @Tags apikeys
+// @Produce json
+// @Success 200 {array} APIKey
+// @Failure 500 {string} string "DB error"
+// @Failure 504 {string} string "Database timed out"
+// @Router /getApiKeys [get]
+func apiKeysHandler(w http.ResponseWriter, r *http.Request) {
+	ctx, cancel := readContext(r)
+	defer cancel()
+
+	rows, err := db.Query(ctx, "SELECT id, name, prefix, scopes, created_by, created_at, expires_at, last_used_at, revoked_at FROM api_keys ORDER BY id")
+	if err != nil {
+		writeDBError(w, r, err, "DB error")
+		return
+	}
+	defer rows.Close()
+
+	keys := []APIKey{}
+	for rows.Next() {
+		var ak APIKey
+		var scopes string
+		if err := rows.Scan(&ak.ID, &ak.Name, &ak.Prefix, &scopes, &ak.CreatedBy, &ak.CreatedAt, &ak.ExpiresAt, &ak.LastUsedAt, &ak.RevokedAt); err != nil {
+			writeDBError(w, r, err, "Row scan failed")
+			return
+		}
+		ak.Scopes = strings.Fields(scopes)
+		keys = append(keys, ak)
+	}
+	if err := rows.Err(); err != nil {
+		writeDBError(w, r, err, "DB error")
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(keys)
+}
+
+// revokeAPIKeyHandler godoc
+// @Summary Revoke an API key
+// @Description Revokes the API key with the given id. Revoking twice is a no-op.
+// @Tags apikeys
+// @Param id query int true "API key id"
+// @Success 204
+// @Failure 400 {string} string "Invalid id"
+// @Failure 404 {string} string "API key not found"
+// @Failure 500 {string} string "DB error"
+// @Failure 504 {string} string "Database timed out"
+// @Router /revokeApiKey [post]
+func revokeAPIKeyHandler(w http.ResponseWriter, r *http.Request) {
+	id, err := strconv.Atoi(r.URL.Query().Get("id"))
+	if err != nil {
+		http.Error(w, "Invalid id", http.StatusBadRequest)
+		return
+	}
+
+	ctx, cancel := writeContext(r)
+	defer cancel()
+
+	tag, err := db.Exec(ctx, "UPDATE api_keys SET revoked_at = COALESCE(revoked_at, now()) WHERE id = $1", id)
+	if err != nil {
+		writeDBError(w, r, err, "DB error")
+		return
+	}
+	if tag.RowsAffected() == 0 {
+		http.Error(w, "API key not found", http.StatusNotFound)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
@@ -0,0 +1,55 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"time"
+)
+
+// Security-relevant events are appended to the audit_events table:
+//
+//	id, occurred_at, event, actor, subject, ip, detail (JSON)
+//
+// Writing the trail must never fail the request that triggered it, so errors
+// are only logged.
+const (
+	auditLockout = "account.lockout"
+	auditUnlock  = "account.unlock"
+)
+
+type auditEvent struct {
+	Event   string
+	Actor   string
+	Subject string
+	IP      string
+	Detail  map[string]interface{}
+}
+
+func recordAudit(ctx context.Context, e auditEvent) {
+	detail, err := json.Marshal(e.Detail)
+	if err != nil {
+		detail = []byte("{}")
+	}
+	fmt.Printf("audit %s %s actor=%q subject=%q ip=%s %s\n", time.Now().UTC().Format(time.RFC3339), e.Event, e.Actor, e.Subject, e.IP, detail)
+
+	if db == nil {
+		return
+	}
+	_, err = db.Exec(ctx, "INSERT INTO audit_events (event, actor, subject, ip, detail) VALUES ($1, $2, $3, $4, $5)",
+		e.Event, e.Actor, e.Subject, e.IP, string(detail))
+	if err != nil {
+		fmt.Println("audit: insert failed:", err)
+	}
+}
+
+// clientIP is the address of the peer that sent the request.
+func clientIP(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
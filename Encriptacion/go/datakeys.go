@@ -0,0 +1,44 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/base64"
+)
+
+// Each user's email is encrypted with a data key of its own instead of
+// EMAIL_ENC_KEY. The data key is stored wrapped with EMAIL_ENC_KEY in
+// user_keys, apart from the users row. Purging a user deletes its data key,
+// which crypto-shreds the email: copies of the ciphertext that outlive the
+// row, in backups, replicas or exports, can no longer be decrypted. For that
+// to hold, backups of user_keys must be kept for less time than those of
+// users.
+//
+// Users created before data keys existed have no DataKey and their email is
+// encrypted with EMAIL_ENC_KEY directly; purging them only deletes the row.
+const dataKeySize = 32
+
+// newDataKey returns a fresh AES-256 data key and its wrapped form, for
+// UserRecord.DataKey.
+func newDataKey() (key []byte, wrapped string, err error) {
+	key = make([]byte, dataKeySize)
+	if _, err := rand.Read(key); err != nil {
+		return nil, "", err
+	}
+	wrapped, err = sealString(emailKey, base64.StdEncoding.EncodeToString(key))
+	if err != nil {
+		return nil, "", err
+	}
+	return key, wrapped, nil
+}
+
+// userDataKey returns the key u's personal data is encrypted with.
+func userDataKey(u UserRecord) ([]byte, error) {
+	if u.DataKey == "" {
+		return emailKey, nil
+	}
+	b64, err := openString(emailKey, u.DataKey)
+	if err != nil {
+		return nil, err
+	}
+	return base64.StdEncoding.DecodeString(b64)
+}
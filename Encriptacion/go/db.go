@@ -0,0 +1,220 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"strconv"
+	"time"
+
+	"github.com/jackc/pgx/v5/pgconn"
+	"github.com/jackc/pgx/v5/pgxpool"
+)
+
+// Handlers share one connection pool, opened at startup from DATABASE_URL.
+// It is sized and tuned with DB_MIN_CONNS, DB_MAX_CONNS,
+// DB_MAX_CONN_IDLE_TIME, DB_MAX_CONN_LIFETIME and DB_HEALTH_CHECK_PERIOD;
+// the pool_* parameters pgxpool accepts in DATABASE_URL also work, but the
+// environment variables take precedence. Without DATABASE_URL db stays nil
+// and routes that need Postgres answer 503 through requireDB.
+//
+// DB_STATEMENT_TIMEOUT (default 30s, 0 to disable) becomes the Postgres
+// statement_timeout of every pooled session, a server-side limit for work
+// that outlives the context of the request that started it.
+var db *pgxpool.Pool
+
+var errDatabaseURLNotSet = errors.New("DATABASE_URL not set")
+
+type DBStats struct {
+	MaxConns                int32  `json:"maxConns"`
+	TotalConns              int32  `json:"totalConns"`
+	IdleConns               int32  `json:"idleConns"`
+	AcquiredConns           int32  `json:"acquiredConns"`
+	ConstructingConns       int32  `json:"constructingConns"`
+	AcquireCount            int64  `json:"acquireCount"`
+	AcquireDuration         string `json:"acquireDuration"`
+	EmptyAcquireCount       int64  `json:"emptyAcquireCount"`
+	CanceledAcquireCount    int64  `json:"canceledAcquireCount"`
+	NewConnsCount           int64  `json:"newConnsCount"`
+	MaxLifetimeDestroyCount int64  `json:"maxLifetimeDestroyCount"`
+	MaxIdleDestroyCount     int64  `json:"maxIdleDestroyCount"`
+}
+
+// openDB creates the pool, or returns nil when DATABASE_URL is not set.
+// Connections are made lazily, so a database that is down at startup does
+// not stop the server; the caller pings to report it.
+func openDB(ctx context.Context) (*pgxpool.Pool, error) {
+	dbURL := os.Getenv("DATABASE_URL")
+	if dbURL == "" {
+		return nil, nil
+	}
+	cfg, err := pgxpool.ParseConfig(dbURL)
+	if err != nil {
+		return nil, fmt.Errorf("DATABASE_URL: %w", err)
+	}
+
+	for _, v := range []struct {
+		name string
+		dst  *int32
+	}{
+		{"DB_MIN_CONNS", &cfg.MinConns},
+		{"DB_MAX_CONNS", &cfg.MaxConns},
+	} {
+		s := os.Getenv(v.name)
+		if s == "" {
+			continue
+		}
+		n, err := strconv.ParseInt(s, 10, 32)
+		if err != nil || n < 0 {
+			return nil, fmt.Errorf("%s must be a non-negative integer", v.name)
+		}
+		*v.dst = int32(n)
+	}
+	if cfg.MaxConns < 1 {
+		return nil, fmt.Errorf("DB_MAX_CONNS must be at least 1")
+	}
+	if cfg.MinConns > cfg.MaxConns {
+		return nil, fmt.Errorf("DB_MIN_CONNS (%d) cannot exceed DB_MAX_CONNS (%d)", cfg.MinConns, cfg.MaxConns)
+	}
+
+	for _, v := range []struct {
+		name string
+		dst  *time.Duration
+	}{
+		{"DB_MAX_CONN_IDLE_TIME", &cfg.MaxConnIdleTime},
+		{"DB_MAX_CONN_LIFETIME", &cfg.MaxConnLifetime},
+		{"DB_HEALTH_CHECK_PERIOD", &cfg.HealthCheckPeriod},
+	} {
+		s := os.Getenv(v.name)
+		if s == "" {
+			continue
+		}
+		d, err := time.ParseDuration(s)
+		if err != nil || d <= 0 {
+			return nil, fmt.Errorf("%s must be a positive duration such as 30m", v.name)
+		}
+		*v.dst = d
+	}
+
+	if _, ok := cfg.ConnConfig.RuntimeParams["statement_timeout"]; !ok || os.Getenv("DB_STATEMENT_TIMEOUT") != "" {
+		timeout := 30 * time.Second
+		if s := os.Getenv("DB_STATEMENT_TIMEOUT"); s != "" {
+			timeout, err = time.ParseDuration(s)
+			if err != nil || timeout < 0 {
+				return nil, fmt.Errorf("DB_STATEMENT_TIMEOUT must be a duration such as 30s, or 0 to disable it")
+			}
+		}
+		cfg.ConnConfig.RuntimeParams["statement_timeout"] = strconv.FormatInt(timeout.Milliseconds(), 10)
+	}
+
+	return pgxpool.NewWithConfig(ctx, cfg)
+}
+
+// Handlers bound their database work with a context derived from the
+// request, so a client that hangs up cancels its queries instead of leaving
+// them running. Lookups get DB_READ_TIMEOUT (default 5s) and changes
+// DB_WRITE_TIMEOUT (default 10s); both apply to every user store.
+type QueryTimeouts struct {
+	Read  time.Duration
+	Write time.Duration
+}
+
+var queryTimeouts = QueryTimeouts{Read: 5 * time.Second, Write: 10 * time.Second}
+
+// statusClientClosedRequest is nginx's non-standard status for a client that
+// disconnected before the response. Nobody receives it; it is for the logs.
+const statusClientClosedRequest = 499
+
+func loadQueryTimeouts() (QueryTimeouts, error) {
+	t := queryTimeouts
+	for _, v := range []struct {
+		name string
+		dst  *time.Duration
+	}{
+		{"DB_READ_TIMEOUT", &t.Read},
+		{"DB_WRITE_TIMEOUT", &t.Write},
+	} {
+		s := os.Getenv(v.name)
+		if s == "" {
+			continue
+		}
+		d, err := time.ParseDuration(s)
+		if err != nil || d <= 0 {
+			return t, fmt.Errorf("%s must be a positive duration such as 5s", v.name)
+		}
+		*v.dst = d
+	}
+	return t, nil
+}
+
+// readContext and writeContext derive the context for a handler's database
+// calls from its request.
+func readContext(r *http.Request) (context.Context, context.CancelFunc) {
+	return context.WithTimeout(r.Context(), queryTimeouts.Read)
+}
+
+func writeContext(r *http.Request) (context.Context, context.CancelFunc) {
+	return context.WithTimeout(r.Context(), queryTimeouts.Write)
+}
+
+// isPostgresQueryCanceled reports whether Postgres canceled the statement,
+// which is how statement_timeout fires (SQLSTATE 57014 query_canceled).
+func isPostgresQueryCanceled(err error) bool {
+	var pgErr *pgconn.PgError
+	return errors.As(err, &pgErr) && pgErr.Code == "57014"
+}
+
+// writeDBError answers a failed database call. A client that went away is
+// logged as 499, a query that ran out of time is 504 and anything else is a
+// 500 with message.
+func writeDBError(w http.ResponseWriter, r *http.Request, err error, message string) {
+	switch {
+	case errors.Is(r.Context().Err(), context.Canceled):
+		fmt.Printf("%s %s: %d client closed request\n", r.Method, r.URL.Path, statusClientClosedRequest)
+		w.WriteHeader(statusClientClosedRequest)
+	case errors.Is(err, context.DeadlineExceeded) || isPostgresQueryCanceled(err):
+		fmt.Printf("%s %s: database timed out: %v\n", r.Method, r.URL.Path, err)
+		http.Error(w, "Database timed out", http.StatusGatewayTimeout)
+	default:
+		http.Error(w, message, http.StatusInternalServerError)
+	}
+}
+
+func requireDB(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if db == nil {
+			http.Error(w, "This endpoint needs DATABASE_URL to be set", http.StatusServiceUnavailable)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// dbStatsHandler godoc
+// @Summary Database pool statistics
+// @Description Returns the connection pool's current size and cumulative counters, for capacity planning
+// @Tags ops
+// @Produce json
+// @Success 200 {object} DBStats
+// @Router /dbStats [get]
+func dbStatsHandler(w http.ResponseWriter, r *http.Request) {
+	s := db.Stat()
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(DBStats{
+		MaxConns:                s.MaxConns(),
+		TotalConns:              s.TotalConns(),
+		IdleConns:               s.IdleConns(),
+		AcquiredConns:           s.AcquiredConns(),
+		ConstructingConns:       s.ConstructingConns(),
+		AcquireCount:            s.AcquireCount(),
+		AcquireDuration:         s.AcquireDuration().String(),
+		EmptyAcquireCount:       s.EmptyAcquireCount(),
+		CanceledAcquireCount:    s.CanceledAcquireCount(),
+		NewConnsCount:           s.NewConnsCount(),
+		MaxLifetimeDestroyCount: s.MaxLifetimeDestroyCount(),
+		MaxIdleDestroyCount:     s.MaxIdleDestroyCount(),
+	})
+}
@@ -0,0 +1,195 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"strconv"
+	"time"
+)
+
+// Deleted users are only marked as deleted: they cannot log in, their
+// sessions are ended and they are hidden from every route, but an admin can
+// restore them. A background job purges them for good once they have been
+// deleted for longer than USER_RETENTION (default 720h, 30 days; 0 keeps
+// them forever), checking every USER_PURGE_INTERVAL (default 1h). Purging
+// also deletes the user's data key, crypto-shredding its email (see
+// newDataKey).
+const (
+	auditUserDelete  = "user.delete"
+	auditUserRestore = "user.restore"
+	auditUserPurge   = "user.purge"
+)
+
+type PurgeSettings struct {
+	Retention time.Duration
+	Interval  time.Duration
+}
+
+var purgeSettings = PurgeSettings{Retention: 30 * 24 * time.Hour, Interval: time.Hour}
+
+func loadPurgeSettings() (PurgeSettings, error) {
+	s := purgeSettings
+	if v := os.Getenv("USER_RETENTION"); v != "" {
+		d, err := time.ParseDuration(v)
+		if err != nil || d < 0 {
+			return s, fmt.Errorf("USER_RETENTION must be a duration such as 720h, or 0 to keep deleted users")
+		}
+		s.Retention = d
+	}
+	if v := os.Getenv("USER_PURGE_INTERVAL"); v != "" {
+		d, err := time.ParseDuration(v)
+		if err != nil || d <= 0 {
+			return s, fmt.Errorf("USER_PURGE_INTERVAL must be a positive duration such as 1h")
+		}
+		s.Interval = d
+	}
+	return s, nil
+}
+
+// canSeeDeleted reports whether the caller may see soft-deleted users,
+// answering 403 when not.
+func canSeeDeleted(w http.ResponseWriter, r *http.Request) bool {
+	principal, ok := principalFromContext(r.Context())
+	if ok && principal.HasScope(scopeUsersAdmin) {
+		return true
+	}
+	http.Error(w, "Forbidden: includeDeleted requires scope "+scopeUsersAdmin, http.StatusForbidden)
+	return false
+}
+
+// deleteUserHandler godoc
+// @Summary Delete a user
+// @Description Soft-deletes the user with the given id and ends its sessions. The user can be restored with /restoreUser until it is purged, USER_RETENTION after deletion; purging crypto-shreds its email.
+// @Tags users
+// @Param id query int true "User ID"
+// @Success 204
+// @Failure 400 {string} string "Invalid id"
+// @Failure 404 {string} string "User not found"
+// @Failure 500 {string} string "DB error"
+// @Failure 504 {string} string "Database timed out"
+// @Router /deleteUser [post]
+func deleteUserHandler(w http.ResponseWriter, r *http.Request) {
+	principal, ok := principalFromContext(r.Context())
+	if !ok {
+		writeUnauthorized(w, "")
+		return
+	}
+	id, err := strconv.Atoi(r.URL.Query().Get("id"))
+	if err != nil {
+		http.Error(w, "Invalid id", http.StatusBadRequest)
+		return
+	}
+
+	ctx, cancel := writeContext(r)
+	defer cancel()
+
+	u, err := userStore.Get(ctx, id)
+	if err == nil && u.DeletedAt != nil {
+		err = errUserNotFound
+	}
+	if err == nil {
+		err = userStore.Delete(ctx, id)
+	}
+	if errors.Is(err, errUserNotFound) {
+		http.Error(w, "User not found", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		writeDBError(w, r, err, "DB error")
+		return
+	}
+	if err := sessions.DeleteUser(ctx, u.Username); err != nil {
+		fmt.Println("ending sessions of deleted user failed:", err)
+	}
+	recordAudit(ctx, auditEvent{Event: auditUserDelete, Actor: principal.actorName(), Subject: u.Username, IP: clientIP(r)})
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// restoreUserHandler godoc
+// @Summary Restore a deleted user
+// @Description Brings back a soft-deleted user that has not been purged yet
+// @Tags users
+// @Produce json
+// @Param id query int true "User ID"
+// @Success 200 {object} User
+// @Failure 400 {string} string "Invalid id"
+// @Failure 404 {string} string "User not found"
+// @Failure 409 {string} string "User is not deleted"
+// @Failure 500 {string} string "DB error"
+// @Failure 504 {string} string "Database timed out"
+// @Router /restoreUser [post]
+func restoreUserHandler(w http.ResponseWriter, r *http.Request) {
+	principal, ok := principalFromContext(r.Context())
+	if !ok {
+		writeUnauthorized(w, "")
+		return
+	}
+	id, err := strconv.Atoi(r.URL.Query().Get("id"))
+	if err != nil {
+		http.Error(w, "Invalid id", http.StatusBadRequest)
+		return
+	}
+
+	ctx, cancel := writeContext(r)
+	defer cancel()
+
+	u, err := userStore.Get(ctx, id)
+	if err == nil && u.DeletedAt == nil {
+		http.Error(w, "User is not deleted", http.StatusConflict)
+		return
+	}
+	if err == nil {
+		u, err = userStore.Restore(ctx, id)
+	}
+	if errors.Is(err, errUserNotFound) {
+		http.Error(w, "User not found", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		writeDBError(w, r, err, "DB error")
+		return
+	}
+	recordAudit(ctx, auditEvent{Event: auditUserRestore, Actor: principal.actorName(), Subject: u.Username, IP: clientIP(r)})
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(User{ID: u.ID, Name: u.Name, Username: u.Username})
+}
+
+// runUserPurge purges expired users now and then every s.Interval until ctx
+// is done. Running it on several instances at once is harmless.
+func runUserPurge(ctx context.Context, s PurgeSettings) {
+	if s.Retention == 0 {
+		return
+	}
+	ticker := time.NewTicker(s.Interval)
+	defer ticker.Stop()
+	for {
+		purgeDeletedUsers(ctx, s.Retention)
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+func purgeDeletedUsers(ctx context.Context, retention time.Duration) {
+	ctx, cancel := context.WithTimeout(ctx, queryTimeouts.Write)
+	defer cancel()
+	usernames, err := userStore.Purge(ctx, time.Now().Add(-retention))
+	if err != nil {
+		fmt.Println("Purging deleted users failed:", err)
+		return
+	}
+	for _, username := range usernames {
+		recordAudit(ctx, auditEvent{
+			Event:   auditUserPurge,
+			Subject: username,
+			Detail:  map[string]interface{}{"retention": retention.String()},
+		})
+	}
+}
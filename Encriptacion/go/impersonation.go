@@ -0,0 +1,215 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+)
+
+// Support staff holding users:impersonate can mint a token that acts as
+// another user. Following RFC 8693, the token's sub is the user being
+// impersonated and its act claim names the real caller:
+//
+//	{"sub": "marcela", "act": {"sub": "aminespinoza"}, "scope": "users:read", ...}
+//
+// Impersonation tokens are short-lived, carry only scopes the target holds
+// that are also in IMPERSONATION_SCOPES, may only call ReadOnly routes, and
+// every request made with one is written to the audit trail.
+const (
+	tokenTypeAccessToken = "urn:ietf:params:oauth:token-type:access_token"
+
+	auditImpersonationStart   = "impersonation.start"
+	auditImpersonationRequest = "impersonation.request"
+)
+
+type impersonationSettings struct {
+	TTL    time.Duration
+	Scopes []string
+}
+
+var impersonation = impersonationSettings{
+	TTL:    15 * time.Minute,
+	Scopes: []string{scopeUsersRead},
+}
+
+type ImpersonationRequest struct {
+	Username string `json:"username"`
+	// Scopes narrows the token further. Empty means every allowed scope.
+	Scopes []string `json:"scopes"`
+	// Reason is recorded in the audit trail, e.g. a support ticket number.
+	Reason string `json:"reason"`
+}
+
+// ImpersonationResponse follows the RFC 8693 token exchange response.
+type ImpersonationResponse struct {
+	AccessToken     string `json:"access_token"`
+	IssuedTokenType string `json:"issued_token_type"`
+	TokenType       string `json:"token_type"`
+	ExpiresIn       int    `json:"expires_in"`
+	Scope           string `json:"scope"`
+}
+
+func loadImpersonationSettings() (impersonationSettings, error) {
+	s := impersonation
+	if v := os.Getenv("IMPERSONATION_TTL"); v != "" {
+		d, err := time.ParseDuration(v)
+		if err != nil || d <= 0 {
+			return s, fmt.Errorf("IMPERSONATION_TTL must be a positive duration such as 15m")
+		}
+		s.TTL = d
+	}
+	if v, ok := os.LookupEnv("IMPERSONATION_SCOPES"); ok {
+		s.Scopes = strings.FieldsFunc(v, func(r rune) bool { return r == ',' || r == ' ' })
+	}
+	return s, nil
+}
+
+// impersonationScopes returns the scopes an impersonation token for roles
+// may carry, narrowed to requested when it is not empty.
+func impersonationScopes(roles, requested []string) []string {
+	scopes := []string{}
+	for _, scope := range scopesFor(roles) {
+		if !containsString(impersonation.Scopes, scope) {
+			continue
+		}
+		if len(requested) > 0 && !containsString(requested, scope) {
+			continue
+		}
+		scopes = append(scopes, scope)
+	}
+	return scopes
+}
+
+func generateImpersonationToken(actor, username string, scopes []string) (string, error) {
+	jti, err := newTokenID()
+	if err != nil {
+		return "", err
+	}
+	now := time.Now()
+	token := jwt.NewWithClaims(jwt.GetSigningMethod(jwtOptions.Algorithms[0]), jwt.MapClaims{
+		"sub":      username,
+		"username": username,
+		"roles":    rolesFor(username),
+		"scope":    strings.Join(scopes, " "),
+		"act":      map[string]interface{}{"sub": actor},
+		"jti":      jti,
+		"iss":      jwtOptions.Issuer,
+		"aud":      jwtOptions.Audience,
+		"iat":      now.Unix(),
+		"nbf":      now.Unix(),
+		"exp":      now.Add(impersonation.TTL).Unix(),
+	})
+	return token.SignedString(jwtSecret)
+}
+
+// auditImpersonatedRequest records a request made with an impersonation
+// token, whatever its outcome.
+func auditImpersonatedRequest(r *http.Request, principal *Principal) {
+	ctx, cancel := writeContext(r)
+	defer cancel()
+	recordAudit(ctx, auditEvent{
+		Event:   auditImpersonationRequest,
+		Actor:   principal.Actor,
+		Subject: principal.Username,
+		IP:      clientIP(r),
+		Detail: map[string]interface{}{
+			"method": r.Method,
+			"path":   r.URL.Path,
+			"query":  r.URL.RawQuery,
+			"jti":    principal.TokenID,
+		},
+	})
+}
+
+// impersonateHandler godoc
+// @Summary Impersonate a user
+// @Description Issues a short-lived, read-only token that acts as another user. The token's act claim names the caller and every request made with it is audited.
+// @Tags auth
+// @Accept json
+// @Produce json
+// @Param request body ImpersonationRequest true "User to impersonate"
+// @Success 200 {object} ImpersonationResponse
+// @Failure 400 {string} string "Username required"
+// @Failure 403 {string} string "Cannot impersonate while impersonating, or with an API key"
+// @Failure 404 {string} string "User not found"
+// @Failure 500 {string} string "Could not generate token"
+// @Failure 504 {string} string "Database timed out"
+// @Router /impersonate [post]
+func impersonateHandler(w http.ResponseWriter, r *http.Request) {
+	principal, ok := principalFromContext(r.Context())
+	if !ok {
+		writeUnauthorized(w, "")
+		return
+	}
+	if principal.Actor != "" {
+		http.Error(w, "Cannot impersonate while impersonating", http.StatusForbidden)
+		return
+	}
+	if principal.isAPIKey() {
+		http.Error(w, "API keys cannot impersonate users", http.StatusForbidden)
+		return
+	}
+
+	var ir ImpersonationRequest
+	if err := json.NewDecoder(r.Body).Decode(&ir); err != nil {
+		http.Error(w, "Invalid input", http.StatusBadRequest)
+		return
+	}
+	ir.Username = strings.TrimSpace(ir.Username)
+	if ir.Username == "" {
+		http.Error(w, "Username required", http.StatusBadRequest)
+		return
+	}
+	if ir.Username == principal.Username {
+		http.Error(w, "Cannot impersonate yourself", http.StatusBadRequest)
+		return
+	}
+
+	ctx, cancel := writeContext(r)
+	defer cancel()
+
+	_, err := userStore.FindByUsername(ctx, ir.Username)
+	if errors.Is(err, errUserNotFound) {
+		http.Error(w, "User not found", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		writeDBError(w, r, err, "DB error")
+		return
+	}
+
+	scopes := impersonationScopes(rolesFor(ir.Username), ir.Scopes)
+	token, err := generateImpersonationToken(principal.Username, ir.Username, scopes)
+	if err != nil {
+		http.Error(w, "Could not generate token", http.StatusInternalServerError)
+		return
+	}
+
+	recordAudit(ctx, auditEvent{
+		Event:   auditImpersonationStart,
+		Actor:   principal.Username,
+		Subject: ir.Username,
+		IP:      clientIP(r),
+		Detail: map[string]interface{}{
+			"scope":     strings.Join(scopes, " "),
+			"reason":    ir.Reason,
+			"expiresIn": impersonation.TTL.String(),
+		},
+	})
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	json.NewEncoder(w).Encode(ImpersonationResponse{
+		AccessToken:     token,
+		IssuedTokenType: tokenTypeAccessToken,
+		TokenType:       "Bearer",
+		ExpiresIn:       int(impersonation.TTL.Seconds()),
+		Scope:           strings.Join(scopes, " "),
+	})
+}
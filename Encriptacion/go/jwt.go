@@ -0,0 +1,317 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+)
+
+const authRealm = "master-of-apis"
+
+var jwtSecret []byte
+var jwtOptions jwtValidationOptions
+
+// jwtValidationOptions controls how incoming tokens are checked and which
+// registered claims generateJWT stamps on the tokens it issues.
+type jwtValidationOptions struct {
+	Algorithms []string
+	Issuer     string
+	Audience   string
+	Leeway     time.Duration
+	MaxAge     time.Duration
+	TTL        time.Duration
+}
+
+// loadJWTOptions reads the validation options from the environment, falling
+// back to defaults that match the tokens issued by loginHandler.
+func loadJWTOptions() (jwtValidationOptions, error) {
+	opts := jwtValidationOptions{
+		Algorithms: []string{"HS256"},
+		Issuer:     "master-of-apis",
+		Audience:   "master-of-apis",
+		Leeway:     30 * time.Second,
+		MaxAge:     24 * time.Hour,
+		TTL:        time.Hour,
+	}
+
+	if v := os.Getenv("JWT_ALGORITHMS"); v != "" {
+		opts.Algorithms = nil
+		for _, alg := range strings.Split(v, ",") {
+			alg = strings.TrimSpace(alg)
+			switch alg {
+			case "HS256", "HS384", "HS512":
+				opts.Algorithms = append(opts.Algorithms, alg)
+			case "":
+			default:
+				return opts, fmt.Errorf("JWT_ALGORITHMS: unsupported algorithm %q (only HS256, HS384 and HS512 work with JWT_SECRET)", alg)
+			}
+		}
+		if len(opts.Algorithms) == 0 {
+			return opts, fmt.Errorf("JWT_ALGORITHMS must list at least one algorithm")
+		}
+	}
+	if v := os.Getenv("JWT_ISSUER"); v != "" {
+		opts.Issuer = v
+	}
+	if v := os.Getenv("JWT_AUDIENCE"); v != "" {
+		opts.Audience = v
+	}
+
+	durations := []struct {
+		name string
+		dst  *time.Duration
+	}{
+		{"JWT_LEEWAY", &opts.Leeway},
+		{"JWT_MAX_AGE", &opts.MaxAge},
+		{"JWT_TTL", &opts.TTL},
+	}
+	for _, d := range durations {
+		v := os.Getenv(d.name)
+		if v == "" {
+			continue
+		}
+		parsed, err := time.ParseDuration(v)
+		if err != nil || parsed < 0 {
+			return opts, fmt.Errorf("%s must be a non-negative duration such as 30s or 1h", d.name)
+		}
+		*d.dst = parsed
+	}
+	if opts.TTL == 0 {
+		return opts, fmt.Errorf("JWT_TTL must be greater than zero")
+	}
+	return opts, nil
+}
+
+// parseJWT verifies the signature, algorithm and registered claims of a
+// token. The returned error is suitable for describeJWTError.
+func parseJWT(tokenString string) (*jwt.Token, jwt.MapClaims, error) {
+	claims := jwt.MapClaims{}
+	token, err := jwt.ParseWithClaims(tokenString, claims, func(token *jwt.Token) (interface{}, error) {
+		if _, ok := token.Method.(*jwt.SigningMethodHMAC); !ok {
+			return nil, fmt.Errorf("unexpected signing method %v", token.Header["alg"])
+		}
+		return jwtSecret, nil
+	},
+		jwt.WithValidMethods(jwtOptions.Algorithms),
+		jwt.WithIssuer(jwtOptions.Issuer),
+		jwt.WithAudience(jwtOptions.Audience),
+		jwt.WithLeeway(jwtOptions.Leeway),
+		jwt.WithIssuedAt(),
+		jwt.WithExpirationRequired(),
+	)
+	if err != nil {
+		return nil, nil, err
+	}
+	if !token.Valid {
+		return nil, nil, jwt.ErrTokenUnverifiable
+	}
+
+	iat, err := claims.GetIssuedAt()
+	if err != nil || iat == nil {
+		return nil, nil, fmt.Errorf("%w: iat", jwt.ErrTokenRequiredClaimMissing)
+	}
+	if jwtOptions.MaxAge > 0 && time.Since(iat.Time) > jwtOptions.MaxAge+jwtOptions.Leeway {
+		return nil, nil, errTokenTooOld
+	}
+	return token, claims, nil
+}
+
+var (
+	errTokenTooOld  = errors.New("token exceeds maximum age")
+	errTokenRevoked = errors.New("token has been revoked")
+)
+
+// checkTokenRevoked returns errTokenRevoked when the user named by the
+// username claim no longer exists, which includes soft-deleted users, or when
+// the token was issued no later than its TokensValidAfter. iat has whole
+// seconds, so a token from the same second as a password reset counts as
+// revoked. Tokens without a username claim, such as client credentials
+// grants, are left alone.
+func checkTokenRevoked(ctx context.Context, claims jwt.MapClaims) error {
+	username, _ := claims["username"].(string)
+	if username == "" {
+		return nil
+	}
+	u, err := userStore.FindByUsername(ctx, username)
+	if errors.Is(err, errUserNotFound) {
+		return errTokenRevoked
+	}
+	if err != nil {
+		return err
+	}
+	iat, _ := claims.GetIssuedAt()
+	if u.TokensValidAfter != nil && iat != nil && iat.Unix() <= u.TokensValidAfter.Unix() {
+		return errTokenRevoked
+	}
+	return nil
+}
+
+// describeJWTError turns a validation failure into the error_description
+// sent back in the WWW-Authenticate header.
+func describeJWTError(err error) string {
+	switch {
+	case errors.Is(err, errTokenTooOld):
+		return "The token was issued too long ago"
+	case errors.Is(err, jwt.ErrTokenMalformed):
+		return "The token is malformed"
+	case errors.Is(err, jwt.ErrTokenSignatureInvalid):
+		return "The token signature or algorithm is not accepted"
+	case errors.Is(err, jwt.ErrTokenExpired):
+		return "The token is expired"
+	case errors.Is(err, jwt.ErrTokenNotValidYet):
+		return "The token is not valid yet"
+	case errors.Is(err, jwt.ErrTokenUsedBeforeIssued):
+		return "The token was issued in the future"
+	case errors.Is(err, jwt.ErrTokenInvalidIssuer):
+		return "The token issuer is not trusted"
+	case errors.Is(err, jwt.ErrTokenInvalidAudience):
+		return "The token audience does not include this service"
+	case errors.Is(err, jwt.ErrTokenRequiredClaimMissing):
+		return "The token is missing a required claim"
+	default:
+		return "The token could not be validated"
+	}
+}
+
+// writeUnauthorized sends a 401 with an RFC 6750 challenge. An empty
+// description means no credentials were presented, so no error is reported.
+func writeUnauthorized(w http.ResponseWriter, description string) {
+	challenge := fmt.Sprintf("Bearer realm=%q", authRealm)
+	if description != "" {
+		challenge += fmt.Sprintf(", error=\"invalid_token\", error_description=%q", description)
+	}
+	w.Header().Set("WWW-Authenticate", challenge)
+	http.Error(w, "Unauthorized", http.StatusUnauthorized)
+}
+
+// jwtMiddleware authenticates a request with a Bearer JWT, a session cookie
+// or, for service-to-service calls, an API key, and stores the resulting
+// Principal in the request context. An Authorization header wins over the
+// cookie.
+func jwtMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if key := apiKeyFromRequest(r); key != "" {
+			ctx, cancel := writeContext(r)
+			principal, err := authenticateAPIKey(ctx, key)
+			cancel()
+			if err != nil {
+				writeAPIKeyError(w, r, err)
+				return
+			}
+			next.ServeHTTP(w, r.WithContext(contextWithPrincipal(r.Context(), principal)))
+			return
+		}
+
+		authHeader := r.Header.Get("Authorization")
+		if authHeader == "" {
+			if cookie, err := r.Cookie(sessionConfig.CookieName); err == nil && cookie.Value != "" {
+				ctx, cancel := writeContext(r)
+				principal, err := authenticateSession(ctx, cookie.Value)
+				cancel()
+				if errors.Is(err, errSessionInvalid) {
+					clearSessionCookie(w)
+					writeUnauthorized(w, "")
+					return
+				}
+				if err != nil {
+					fmt.Println("session lookup failed:", err)
+					writeDBError(w, r, err, "Failed to verify session")
+					return
+				}
+				next.ServeHTTP(w, r.WithContext(contextWithPrincipal(r.Context(), principal)))
+				return
+			}
+		}
+		if !strings.HasPrefix(authHeader, "Bearer ") {
+			writeUnauthorized(w, "")
+			return
+		}
+		tokenString := strings.TrimPrefix(authHeader, "Bearer ")
+		_, claims, err := parseJWT(tokenString)
+		if err != nil {
+			writeUnauthorized(w, describeJWTError(err))
+			return
+		}
+		principal := principalFromClaims(claims)
+		ctx, cancel := readContext(r)
+		err = checkTokenRevoked(ctx, claims)
+		cancel()
+		if errors.Is(err, errTokenRevoked) {
+			writeUnauthorized(w, "token has been revoked")
+			return
+		}
+		if err != nil {
+			writeDBError(w, r, err, "Failed to verify token")
+			return
+		}
+		if principal.Actor != "" {
+			auditImpersonatedRequest(r, principal)
+		}
+		next.ServeHTTP(w, r.WithContext(contextWithPrincipal(r.Context(), principal)))
+	})
+}
+
+func generateJWT(username string) (string, error) {
+	jti, err := newTokenID()
+	if err != nil {
+		return "", err
+	}
+	roles := rolesFor(username)
+	now := time.Now()
+	token := jwt.NewWithClaims(jwt.GetSigningMethod(jwtOptions.Algorithms[0]), jwt.MapClaims{
+		"sub":      username,
+		"username": username,
+		"roles":    roles,
+		"scope":    strings.Join(scopesFor(roles), " "),
+		"jti":      jti,
+		"iss":      jwtOptions.Issuer,
+		"aud":      jwtOptions.Audience,
+		"iat":      now.Unix(),
+		"nbf":      now.Unix(),
+		"exp":      now.Add(jwtOptions.TTL).Unix(),
+	})
+	return token.SignedString(jwtSecret)
+}
+
+// generatePurposeToken signs a short-lived token for a single flow, such as
+// an MFA challenge or a password reset link. The audience names the flow, so
+// these tokens are never accepted as access tokens or by another flow.
+func generatePurposeToken(username, audience string, ttl time.Duration) (string, error) {
+	jti, err := newTokenID()
+	if err != nil {
+		return "", err
+	}
+	now := time.Now()
+	token := jwt.NewWithClaims(jwt.GetSigningMethod(jwtOptions.Algorithms[0]), jwt.MapClaims{
+		"sub": username,
+		"jti": jti,
+		"iss": jwtOptions.Issuer,
+		"aud": audience,
+		"iat": now.Unix(),
+		"exp": now.Add(ttl).Unix(),
+	})
+	return token.SignedString(jwtSecret)
+}
+
+func parsePurposeToken(tokenString, audience string) (jwt.MapClaims, error) {
+	claims := jwt.MapClaims{}
+	_, err := jwt.ParseWithClaims(tokenString, claims, func(token *jwt.Token) (interface{}, error) {
+		return jwtSecret, nil
+	},
+		jwt.WithValidMethods(jwtOptions.Algorithms),
+		jwt.WithIssuer(jwtOptions.Issuer),
+		jwt.WithAudience(audience),
+		jwt.WithLeeway(jwtOptions.Leeway),
+		jwt.WithExpirationRequired(),
+	)
+	if err != nil {
+		return nil, err
+	}
+	return claims, nil
+}
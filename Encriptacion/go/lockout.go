@@ -0,0 +1,356 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+)
+
+// attemptState is the failed login history for one key, such as
+// "user:marcela" or "ip:10.0.0.7".
+type attemptState struct {
+	Failures    int
+	LastFailure time.Time
+}
+
+// attemptStore counts failed logins. Failures older than window no longer
+// count, so RecordFailure starts over from one after a quiet period.
+type attemptStore interface {
+	Get(ctx context.Context, key string) (attemptState, error)
+	RecordFailure(ctx context.Context, key string, now time.Time, window time.Duration) (attemptState, error)
+	Reset(ctx context.Context, key string) error
+}
+
+// lockoutPolicy decides how long a key is locked out. Failures below
+// Threshold are free; the failure that reaches it locks the key for
+// BaseDelay, and each one after that doubles the lockout, up to MaxDelay.
+// Window must be longer than MaxDelay, so the count survives a lockout and
+// the next failure locks the key again instead of starting over.
+type lockoutPolicy struct {
+	UserThreshold int
+	IPThreshold   int
+	BaseDelay     time.Duration
+	MaxDelay      time.Duration
+	Window        time.Duration
+}
+
+var lockout = lockoutPolicy{
+	UserThreshold: 5,
+	IPThreshold:   20,
+	BaseDelay:     30 * time.Second,
+	MaxDelay:      15 * time.Minute,
+	Window:        time.Hour,
+}
+
+var loginAttempts attemptStore = newMemoryAttemptStore()
+
+func loadLockoutPolicy() (lockoutPolicy, error) {
+	p := lockout
+	ints := []struct {
+		name string
+		dst  *int
+	}{
+		{"LOCKOUT_USER_THRESHOLD", &p.UserThreshold},
+		{"LOCKOUT_IP_THRESHOLD", &p.IPThreshold},
+	}
+	for _, i := range ints {
+		if v := os.Getenv(i.name); v != "" {
+			n, err := strconv.Atoi(v)
+			if err != nil || n < 1 {
+				return p, fmt.Errorf("%s must be a positive integer", i.name)
+			}
+			*i.dst = n
+		}
+	}
+	durations := []struct {
+		name string
+		dst  *time.Duration
+	}{
+		{"LOCKOUT_BASE_DELAY", &p.BaseDelay},
+		{"LOCKOUT_MAX_DELAY", &p.MaxDelay},
+		{"LOCKOUT_WINDOW", &p.Window},
+	}
+	for _, d := range durations {
+		if v := os.Getenv(d.name); v != "" {
+			parsed, err := time.ParseDuration(v)
+			if err != nil || parsed <= 0 {
+				return p, fmt.Errorf("%s must be a positive duration such as 30s or 15m", d.name)
+			}
+			*d.dst = parsed
+		}
+	}
+	if p.Window <= p.MaxDelay {
+		return p, fmt.Errorf("LOCKOUT_WINDOW (%s) must be longer than LOCKOUT_MAX_DELAY (%s)", p.Window, p.MaxDelay)
+	}
+	return p, nil
+}
+
+// loadAttemptStore picks the counter backend from LOGIN_ATTEMPT_STORE:
+// "memory" (the default, per process) or "postgres" (shared by every
+// instance, in the login_attempts table).
+func loadAttemptStore() (attemptStore, error) {
+	switch v := os.Getenv("LOGIN_ATTEMPT_STORE"); v {
+	case "", "memory":
+		return newMemoryAttemptStore(), nil
+	case "postgres":
+		if db == nil {
+			return nil, fmt.Errorf("LOGIN_ATTEMPT_STORE=postgres needs DATABASE_URL")
+		}
+		return postgresAttemptStore{}, nil
+	default:
+		return nil, fmt.Errorf("LOGIN_ATTEMPT_STORE must be memory or postgres, got %q", v)
+	}
+}
+
+// lockedUntil reports when a key with the given history may try again.
+func (p lockoutPolicy) lockedUntil(s attemptState, threshold int) time.Time {
+	over := s.Failures - threshold
+	if over < 0 {
+		return time.Time{}
+	}
+	delay := time.Duration(float64(p.BaseDelay) * math.Pow(2, float64(over)))
+	if delay > p.MaxDelay || delay <= 0 {
+		delay = p.MaxDelay
+	}
+	return s.LastFailure.Add(delay)
+}
+
+func userAttemptKey(username string) string {
+	return "user:" + strings.ToLower(username)
+}
+
+func ipAttemptKey(ip string) string {
+	return "ip:" + ip
+}
+
+// attemptCounter is a key to count attempts under and how many it gets for
+// free.
+type attemptCounter struct {
+	key       string
+	threshold int
+}
+
+// loginCounters are the counters failed logins go to: one for the username
+// and one for the client address.
+func loginCounters(r *http.Request, username string) []attemptCounter {
+	return []attemptCounter{
+		{userAttemptKey(username), lockout.UserThreshold},
+		{ipAttemptKey(clientIP(r)), lockout.IPThreshold},
+	}
+}
+
+// resetRequestCounters count password reset requests apart from failed
+// logins, so asking for reset links cannot lock an account out of logging
+// in.
+func resetRequestCounters(r *http.Request, username string) []attemptCounter {
+	return []attemptCounter{
+		{"reset:" + userAttemptKey(username), lockout.UserThreshold},
+		{"reset:" + ipAttemptKey(clientIP(r)), lockout.IPThreshold},
+	}
+}
+
+// checkLockout writes a 429 and returns false when either the username or
+// the client address is locked out.
+func checkLockout(w http.ResponseWriter, r *http.Request, username string) bool {
+	return checkCounters(w, r, loginCounters(r, username), "Too many failed attempts, try again later")
+}
+
+// checkCounters writes a 429 with message and returns false when any of
+// counters is locked out.
+func checkCounters(w http.ResponseWriter, r *http.Request, counters []attemptCounter, message string) bool {
+	ctx, cancel := readContext(r)
+	defer cancel()
+	now := time.Now()
+	var until time.Time
+	for _, c := range counters {
+		s, err := loginAttempts.Get(ctx, c.key)
+		if err != nil {
+			// Failing open keeps logins working when the counter store is
+			// down; the failure is visible in the logs.
+			fmt.Println("lockout check failed:", err)
+			continue
+		}
+		if u := lockout.lockedUntil(s, c.threshold); u.After(until) {
+			until = u
+		}
+	}
+	if !until.After(now) {
+		return true
+	}
+	retryAfter := int(math.Ceil(until.Sub(now).Seconds()))
+	w.Header().Set("Retry-After", strconv.Itoa(retryAfter))
+	http.Error(w, message, http.StatusTooManyRequests)
+	return false
+}
+
+// recordLoginFailure counts a failed attempt against the username and the
+// client address, and audits any lockout it starts.
+func recordLoginFailure(r *http.Request, username string) {
+	recordAttempt(r, username, loginCounters(r, username))
+}
+
+// recordAttempt counts an attempt by username against counters and audits
+// any lockout it starts.
+func recordAttempt(r *http.Request, username string, counters []attemptCounter) {
+	ctx, cancel := writeContext(r)
+	defer cancel()
+	now := time.Now()
+	ip := clientIP(r)
+	for _, c := range counters {
+		s, err := loginAttempts.RecordFailure(ctx, c.key, now, lockout.Window)
+		if err != nil {
+			fmt.Println("recording failed login failed:", err)
+			continue
+		}
+		if until := lockout.lockedUntil(s, c.threshold); until.After(now) {
+			recordAudit(ctx, auditEvent{
+				Event:   auditLockout,
+				Subject: c.key,
+				IP:      ip,
+				Detail: map[string]interface{}{
+					"username":    username,
+					"failures":    s.Failures,
+					"lockedUntil": until.UTC().Format(time.RFC3339),
+				},
+			})
+		}
+	}
+}
+
+// recordLoginSuccess clears the username's counter. The address counter is
+// left alone so one valid account cannot be used to reset it.
+func recordLoginSuccess(r *http.Request, username string) {
+	ctx, cancel := writeContext(r)
+	defer cancel()
+	if err := loginAttempts.Reset(ctx, userAttemptKey(username)); err != nil {
+		fmt.Println("resetting login failures failed:", err)
+	}
+}
+
+// unlockAccountHandler godoc
+// @Summary Unlock an account
+// @Description Clears failed login counters for a username and/or client IP address
+// @Tags auth
+// @Param username query string false "Username to unlock"
+// @Param ip query string false "Client IP address to unlock"
+// @Success 204
+// @Failure 400 {string} string "username or ip required"
+// @Failure 500 {string} string "Failed to unlock"
+// @Failure 504 {string} string "Database timed out"
+// @Router /unlockAccount [post]
+func unlockAccountHandler(w http.ResponseWriter, r *http.Request) {
+	principal, ok := principalFromContext(r.Context())
+	if !ok {
+		writeUnauthorized(w, "")
+		return
+	}
+	username := strings.TrimSpace(r.URL.Query().Get("username"))
+	ip := strings.TrimSpace(r.URL.Query().Get("ip"))
+	if username == "" && ip == "" {
+		http.Error(w, "username or ip required", http.StatusBadRequest)
+		return
+	}
+
+	var keys []string
+	if username != "" {
+		keys = append(keys, userAttemptKey(username))
+	}
+	if ip != "" {
+		keys = append(keys, ipAttemptKey(ip))
+	}
+	ctx, cancel := writeContext(r)
+	defer cancel()
+	for _, key := range keys {
+		if err := loginAttempts.Reset(ctx, key); err != nil {
+			fmt.Println("unlock failed:", err)
+			writeDBError(w, r, err, "Failed to unlock")
+			return
+		}
+		recordAudit(ctx, auditEvent{
+			Event:   auditUnlock,
+			Actor:   principal.actorName(),
+			Subject: key,
+			IP:      clientIP(r),
+		})
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+type memoryAttemptStore struct {
+	mu       sync.Mutex
+	attempts map[string]attemptState
+}
+
+func newMemoryAttemptStore() *memoryAttemptStore {
+	return &memoryAttemptStore{attempts: map[string]attemptState{}}
+}
+
+func (m *memoryAttemptStore) Get(ctx context.Context, key string) (attemptState, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.attempts[key], nil
+}
+
+func (m *memoryAttemptStore) RecordFailure(ctx context.Context, key string, now time.Time, window time.Duration) (attemptState, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	s := m.attempts[key]
+	if now.Sub(s.LastFailure) > window {
+		s.Failures = 0
+	}
+	s.Failures++
+	s.LastFailure = now
+	m.attempts[key] = s
+
+	// Drop stale entries so the map cannot grow without bound.
+	for k, v := range m.attempts {
+		if now.Sub(v.LastFailure) > window+lockout.MaxDelay {
+			delete(m.attempts, k)
+		}
+	}
+	return s, nil
+}
+
+func (m *memoryAttemptStore) Reset(ctx context.Context, key string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	delete(m.attempts, key)
+	return nil
+}
+
+// postgresAttemptStore keeps counters in login_attempts (key primary key,
+// failures, last_failure) so every instance sees the same lockouts.
+type postgresAttemptStore struct{}
+
+func (postgresAttemptStore) Get(ctx context.Context, key string) (attemptState, error) {
+	var s attemptState
+	err := db.QueryRow(ctx, "SELECT failures, last_failure FROM login_attempts WHERE key = $1", key).Scan(&s.Failures, &s.LastFailure)
+	if errors.Is(err, pgx.ErrNoRows) {
+		return attemptState{}, nil
+	}
+	return s, err
+}
+
+func (postgresAttemptStore) RecordFailure(ctx context.Context, key string, now time.Time, window time.Duration) (attemptState, error) {
+	var s attemptState
+	err := db.QueryRow(ctx, `INSERT INTO login_attempts (key, failures, last_failure) VALUES ($1, 1, $2)
+		ON CONFLICT (key) DO UPDATE SET
+			failures = CASE WHEN login_attempts.last_failure < $3 THEN 1 ELSE login_attempts.failures + 1 END,
+			last_failure = EXCLUDED.last_failure
+		RETURNING failures, last_failure`, key, now, now.Add(-window)).Scan(&s.Failures, &s.LastFailure)
+	return s, err
+}
+
+func (postgresAttemptStore) Reset(ctx context.Context, key string) error {
+	_, err := db.Exec(ctx, "DELETE FROM login_attempts WHERE key = $1", key)
+	return err
+}
@@ -0,0 +1,161 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"mime"
+	"net"
+	"net/smtp"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+type Message struct {
+	To      string
+	Subject string
+	Body    string
+}
+
+// Mailer delivers plain-text messages. Pick one with MAILER: "smtp" for a
+// real server, "file" (the default) to drop .eml files in MAIL_DROP_DIR, or
+// "memory" to keep them in the process and print them.
+type Mailer interface {
+	Send(ctx context.Context, m Message) error
+}
+
+var mailer Mailer = newMemoryMailer()
+
+func loadMailer() (Mailer, error) {
+	from := os.Getenv("MAIL_FROM")
+	if from == "" {
+		from = "no-reply@localhost"
+	}
+	switch v := os.Getenv("MAILER"); v {
+	case "", "file":
+		dir := os.Getenv("MAIL_DROP_DIR")
+		if dir == "" {
+			dir = "mail"
+		}
+		return fileMailer{Dir: dir, From: from}, nil
+	case "smtp":
+		addr := os.Getenv("SMTP_ADDR")
+		if addr == "" {
+			return nil, fmt.Errorf("SMTP_ADDR environment variable not set!")
+		}
+		return smtpMailer{Addr: addr, Username: os.Getenv("SMTP_USERNAME"), Password: os.Getenv("SMTP_PASSWORD"), From: from}, nil
+	case "memory":
+		return newMemoryMailer(), nil
+	default:
+		return nil, fmt.Errorf("MAILER must be smtp, file or memory, got %q", v)
+	}
+}
+
+// formatMessage renders m as an RFC 5322 message.
+func formatMessage(from string, m Message) ([]byte, error) {
+	for _, v := range []string{from, m.To, m.Subject} {
+		if strings.ContainsAny(v, "\r\n") {
+			return nil, fmt.Errorf("mail header contains a line break")
+		}
+	}
+	id := make([]byte, 12)
+	if _, err := rand.Read(id); err != nil {
+		return nil, err
+	}
+	domain := "localhost"
+	if at := strings.LastIndex(from, "@"); at >= 0 {
+		domain = from[at+1:]
+	}
+
+	var b bytes.Buffer
+	fmt.Fprintf(&b, "From: %s\r\n", from)
+	fmt.Fprintf(&b, "To: %s\r\n", m.To)
+	fmt.Fprintf(&b, "Subject: %s\r\n", mime.QEncoding.Encode("utf-8", m.Subject))
+	fmt.Fprintf(&b, "Date: %s\r\n", time.Now().Format(time.RFC1123Z))
+	fmt.Fprintf(&b, "Message-ID: <%s@%s>\r\n", hex.EncodeToString(id), domain)
+	b.WriteString("MIME-Version: 1.0\r\n")
+	b.WriteString("Content-Type: text/plain; charset=utf-8\r\n")
+	b.WriteString("\r\n")
+	b.WriteString(strings.ReplaceAll(m.Body, "\n", "\r\n"))
+	return b.Bytes(), nil
+}
+
+type smtpMailer struct {
+	Addr     string
+	Username string
+	Password string
+	From     string
+}
+
+func (s smtpMailer) Send(ctx context.Context, m Message) error {
+	msg, err := formatMessage(s.From, m)
+	if err != nil {
+		return err
+	}
+	var auth smtp.Auth
+	if s.Username != "" {
+		host, _, err := net.SplitHostPort(s.Addr)
+		if err != nil {
+			return err
+		}
+		auth = smtp.PlainAuth("", s.Username, s.Password, host)
+	}
+	return smtp.SendMail(s.Addr, auth, s.From, []string{m.To}, msg)
+}
+
+// fileMailer writes each message to its own .eml file, which most mail
+// clients can open, so flows can be followed locally without a server.
+type fileMailer struct {
+	Dir  string
+	From string
+}
+
+func (f fileMailer) Send(ctx context.Context, m Message) error {
+	msg, err := formatMessage(f.From, m)
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(f.Dir, 0o700); err != nil {
+		return err
+	}
+	suffix := make([]byte, 4)
+	if _, err := rand.Read(suffix); err != nil {
+		return err
+	}
+	name := fmt.Sprintf("%s-%s.eml", time.Now().UTC().Format("20060102T150405.000000000"), hex.EncodeToString(suffix))
+	path := filepath.Join(f.Dir, name)
+	if err := os.WriteFile(path, msg, 0o600); err != nil {
+		return err
+	}
+	fmt.Println("mail to", m.To, "written to", path)
+	return nil
+}
+
+type memoryMailer struct {
+	mu   sync.Mutex
+	sent []Message
+}
+
+func newMemoryMailer() *memoryMailer {
+	return &memoryMailer{}
+}
+
+func (mm *memoryMailer) Send(ctx context.Context, m Message) error {
+	mm.mu.Lock()
+	defer mm.mu.Unlock()
+	mm.sent = append(mm.sent, m)
+	fmt.Printf("mail to %s: %s\n%s\n", m.To, m.Subject, m.Body)
+	return nil
+}
+
+// Sent returns a copy of every message sent so far.
+func (mm *memoryMailer) Sent() []Message {
+	mm.mu.Lock()
+	defer mm.mu.Unlock()
+	return append([]Message(nil), mm.sent...)
+}
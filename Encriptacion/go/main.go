@@ -7,28 +7,34 @@ import (
 	"crypto/rand"
 	"encoding/base64"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
 	"net/http"
 	"os"
+	"strconv"
 	"strings"
 	_ "swagger/docs"
 	"time"
 
-	"github.com/golang-jwt/jwt/v5"
-	"github.com/jackc/pgx/v5"
 	"github.com/joho/godotenv"
 	httpSwagger "github.com/swaggo/http-swagger"
 	"golang.org/x/crypto/bcrypt"
 )
 
-var jwtSecret []byte
 var emailKey []byte
 
+// totpKey encrypts TOTP secrets. It comes from TOTP_ENC_KEY and falls back to
+// EMAIL_ENC_KEY.
+var totpKey []byte
+
+var dummyPasswordHash, _ = bcrypt.GenerateFromPassword([]byte("not a real password"), bcrypt.DefaultCost)
+
 type User struct {
-	ID       int    `json:"id"`
-	Name     string `json:"name"`
-	Username string `json:"username"`
+	ID        int        `json:"id"`
+	Name      string     `json:"name"`
+	Username  string     `json:"username"`
+	DeletedAt *time.Time `json:"deletedAt,omitempty"`
 }
 
 type CreateUser struct {
@@ -38,59 +44,98 @@ type CreateUser struct {
 	Email    string `json:"email"`
 }
 
-type EmailResponse struct {
+type LoginRequest struct {
 	Username string `json:"username"`
-	Email    string `json:"email"`
+	Password string `json:"password"`
+	// Session asks for a session cookie instead of a token in the body.
+	Session bool `json:"session"`
 }
 
-func jwtMiddleware(next http.Handler) http.Handler {
-	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		authHeader := r.Header.Get("Authorization")
-		if !strings.HasPrefix(authHeader, "Bearer ") {
-			http.Error(w, "Unauthorized", http.StatusUnauthorized)
-			return
-		}
-		tokenString := strings.TrimPrefix(authHeader, "Bearer ")
-		token, err := jwt.Parse(tokenString, func(token *jwt.Token) (interface{}, error) {
-			return jwtSecret, nil
-		})
-		if err != nil || !token.Valid {
-			http.Error(w, "Unauthorized", http.StatusUnauthorized)
-			return
-		}
-		next.ServeHTTP(w, r)
-	})
+// LoginResponse carries either an access token or, for users with TOTP
+// enabled, an MFA challenge to complete at /loginMfa.
+type LoginResponse struct {
+	Token       string `json:"token,omitempty"`
+	MFARequired bool   `json:"mfa_required,omitempty"`
+	MFAToken    string `json:"mfa_token,omitempty"`
+}
+
+type EmailResponse struct {
+	Username string `json:"username"`
+	Email    string `json:"email"`
 }
 
 // loginHandler godoc
-// @Summary Generate JWT token
-// @Description Returns a JWT token for a given username
+// @Summary Log in
+// @Description Checks the username and password. Returns a JWT, or an mfa_token challenge to complete at /loginMfa when the user has TOTP enabled. With "session": true a session cookie is set instead and the body carries its CSRF token (see SessionResponse).
 // @Tags auth
-// @Param username query string true "Username"
-// @Success 200 {string} string "JWT token"
-// @Failure 400 {string} string "Username required"
+// @Accept json
+// @Produce json
+// @Param credentials body LoginRequest true "Credentials"
+// @Success 200 {object} LoginResponse
+// @Failure 400 {string} string "Username and password required"
+// @Failure 401 {string} string "Invalid username or password"
+// @Failure 429 {string} string "Too many failed attempts, try again later"
 // @Failure 500 {string} string "Could not generate token"
-// @Router /login [get]
+// @Failure 504 {string} string "Database timed out"
+// @Router /login [post]
 func loginHandler(w http.ResponseWriter, r *http.Request) {
-	username := r.URL.Query().Get("username")
-	if username == "" {
-		http.Error(w, "Username required", http.StatusBadRequest)
+	var lr LoginRequest
+	if err := json.NewDecoder(r.Body).Decode(&lr); err != nil {
+		http.Error(w, "Invalid input", http.StatusBadRequest)
+		return
+	}
+	if strings.TrimSpace(lr.Username) == "" || lr.Password == "" {
+		http.Error(w, "Username and password required", http.StatusBadRequest)
+		return
+	}
+	if !checkLockout(w, r, lr.Username) {
+		return
+	}
+
+	ctx, cancel := writeContext(r)
+	defer cancel()
+
+	user, err := userStore.FindByUsername(ctx, lr.Username)
+	found := err == nil
+	hash, totpEnabled := user.PasswordHash, user.TOTPEnabled
+	if errors.Is(err, errUserNotFound) {
+		// Compare against a dummy hash anyway so unknown usernames take as
+		// long as wrong passwords.
+		hash = string(dummyPasswordHash)
+	} else if err != nil {
+		writeDBError(w, r, err, "DB error")
+		return
+	}
+	if bcrypt.CompareHashAndPassword([]byte(hash), []byte(lr.Password)) != nil || !found {
+		recordLoginFailure(r, lr.Username)
+		http.Error(w, "Invalid username or password", http.StatusUnauthorized)
 		return
 	}
-	token, err := generateJWT(username)
+	if !totpEnabled {
+		recordLoginSuccess(r, lr.Username)
+	}
+
+	if !totpEnabled && lr.Session {
+		if err := startSession(w, r, lr.Username); err != nil {
+			writeDBError(w, r, err, "Could not start session")
+		}
+		return
+	}
+
+	resp := LoginResponse{}
+	if totpEnabled {
+		resp.MFARequired = true
+		resp.MFAToken, err = generateMFAToken(lr.Username)
+	} else {
+		resp.Token, err = generateJWT(lr.Username)
+	}
 	if err != nil {
 		http.Error(w, "Could not generate token", http.StatusInternalServerError)
 		return
 	}
-	w.Write([]byte(token))
-}
-
-func generateJWT(username string) (string, error) {
-	token := jwt.NewWithClaims(jwt.SigningMethodHS256, jwt.MapClaims{
-		"username": username,
-		"exp":      time.Now().Add(time.Hour * 1).Unix(),
-	})
-	return token.SignedString(jwtSecret)
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	json.NewEncoder(w).Encode(resp)
 }
 
 // okCodeHandler godoc
@@ -106,41 +151,41 @@ func okCodeHandler(w http.ResponseWriter, r *http.Request) {
 
 // usersHandler godoc
 // @Summary Get all users
-// @Description Returns a list of users from the database
+// @Description Returns a list of users from the database. Soft-deleted users are left out unless includeDeleted is true.
 // @Tags users
+// @Param includeDeleted query bool false "List soft-deleted users too; requires users:admin"
 // @Success 200 {array} User
-// @Failure 500 {string} string "Failed to connect to database" or "Query failed" or "Row scan failed"
+// @Failure 400 {string} string "includeDeleted must be true or false"
+// @Failure 403 {string} string "includeDeleted requires users:admin"
+// @Failure 500 {string} string "Query failed"
+// @Failure 504 {string} string "Database timed out"
 // @Router /getUsers [get]
 func usersHandler(w http.ResponseWriter, r *http.Request) {
-	dbURL := os.Getenv("DATABASE_URL")
-	if dbURL == "" {
-		http.Error(w, "DATABASE_URL not set", http.StatusInternalServerError)
-		return
+	includeDeleted := false
+	if v := r.URL.Query().Get("includeDeleted"); v != "" {
+		var err error
+		includeDeleted, err = strconv.ParseBool(v)
+		if err != nil {
+			http.Error(w, "includeDeleted must be true or false", http.StatusBadRequest)
+			return
+		}
 	}
-
-	ctx := context.Background()
-	conn, err := pgx.Connect(ctx, dbURL)
-	if err != nil {
-		http.Error(w, "Failed to connect to database", http.StatusInternalServerError)
+	if includeDeleted && !canSeeDeleted(w, r) {
 		return
 	}
-	defer conn.Close(ctx)
 
-	rows, err := conn.Query(ctx, "SELECT id, name, username FROM users")
+	ctx, cancel := readContext(r)
+	defer cancel()
+
+	records, err := userStore.List(ctx, includeDeleted)
 	if err != nil {
-		http.Error(w, "Query failed", http.StatusInternalServerError)
+		writeDBError(w, r, err, "Query failed")
 		return
 	}
-	defer rows.Close()
 
-	users := []User{}
-	for rows.Next() {
-		var u User
-		if err := rows.Scan(&u.ID, &u.Name, &u.Username); err != nil {
-			http.Error(w, "Row scan failed", http.StatusInternalServerError)
-			return
-		}
-		users = append(users, u)
+	users := make([]User, 0, len(records))
+	for _, u := range records {
+		users = append(users, User{ID: u.ID, Name: u.Name, Username: u.Username, DeletedAt: u.DeletedAt})
 	}
 
 	w.Header().Set("Content-Type", "application/json")
@@ -149,48 +194,56 @@ func usersHandler(w http.ResponseWriter, r *http.Request) {
 
 // getEmailHandler godoc
 // @Summary Get decrypted email by username
-// @Description Returns the decrypted email for the given username
+// @Description Returns the decrypted email for the given username. Defaults to the caller; reading another user's email requires the pii:read scope.
 // @Tags users
-// @Param username query string true "Username"
+// @Param username query string false "Username (defaults to the authenticated user)"
 // @Success 200 {object} EmailResponse
 // @Failure 400 {string} string "Username required"
+// @Failure 403 {string} string "You can only read your own email"
 // @Failure 404 {string} string "User not found"
 // @Failure 500 {string} string "DB error" or "Decryption failed"
+// @Failure 504 {string} string "Database timed out"
 // @Router /getEmail [get]
 func getEmailHandler(w http.ResponseWriter, r *http.Request) {
+	principal, ok := principalFromContext(r.Context())
+	if !ok {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+
 	username := r.URL.Query().Get("username")
+	if strings.TrimSpace(username) == "" {
+		username = principal.Username
+	}
 	if strings.TrimSpace(username) == "" {
 		http.Error(w, "Username required", http.StatusBadRequest)
 		return
 	}
-
-	dbURL := os.Getenv("DATABASE_URL")
-	if dbURL == "" {
-		http.Error(w, "DATABASE_URL not set", http.StatusInternalServerError)
+	if username != principal.Username && !principal.HasScope(scopePIIRead) {
+		http.Error(w, "You can only read your own email", http.StatusForbidden)
 		return
 	}
 
-	ctx := context.Background()
-	conn, err := pgx.Connect(ctx, dbURL)
-	if err != nil {
-		http.Error(w, "Failed to connect to database", http.StatusInternalServerError)
-		return
-	}
-	defer conn.Close(ctx)
+	ctx, cancel := readContext(r)
+	defer cancel()
 
-	var encEmail string
-	row := conn.QueryRow(ctx, "SELECT email FROM users WHERE username = $1 LIMIT 1", username)
-	if err := row.Scan(&encEmail); err != nil {
+	user, err := userStore.FindByUsername(ctx, username)
+	if errors.Is(err, errUserNotFound) {
 		http.Error(w, "User not found", http.StatusNotFound)
 		return
 	}
+	if err != nil {
+		writeDBError(w, r, err, "DB error")
+		return
+	}
 
 	email := ""
-	if strings.TrimSpace(encEmail) != "" {
-		email, err = decryptEmail(encEmail)
+	if strings.TrimSpace(user.Email) != "" {
+		email, err = decryptEmail(user)
 		if err != nil {
 			fmt.Println("decryptEmail failed:", err)
 			http.Error(w, "Decryption failed", http.StatusInternalServerError)
+			return
 		}
 	}
 
@@ -200,14 +253,17 @@ func getEmailHandler(w http.ResponseWriter, r *http.Request) {
 
 // createUserHandler godoc
 // @Summary Create a new user
-// @Description Create a new user and return the created record
+// @Description Create a new user and return the created record. Name is required; username needs 3 to 32 letters, digits, '.', '_' or '-'; email is optional but must be a valid address. Every broken rule, including the password policy, is listed in the 422 response. A verification link is emailed when an email address is given.
 // @Tags users
 // @Accept json
 // @Produce json
 // @Param user body CreateUser true "New user"
 // @Success 201 {object} User
 // @Failure 400 {string} string "Invalid input"
+// @Failure 409 {string} string "Username already taken"
+// @Failure 422 {object} ValidationError
 // @Failure 500 {string} string "DB error"
+// @Failure 504 {string} string "Database timed out"
 // @Router /createUser [post]
 func createUserHandler(w http.ResponseWriter, r *http.Request) {
 	var cu CreateUser
@@ -216,8 +272,8 @@ func createUserHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	if strings.TrimSpace(cu.Password) == "" {
-		http.Error(w, "Password required", http.StatusBadRequest)
+	if errs := cu.validate(); errs != nil {
+		writeValidationError(w, "User is invalid", errs)
 		return
 	}
 
@@ -227,37 +283,41 @@ func createUserHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	dataKey, wrappedKey, err := newDataKey()
+	if err != nil {
+		http.Error(w, "Failed to encrypt email", http.StatusInternalServerError)
+		return
+	}
 	encEmail := ""
 	if strings.TrimSpace(cu.Email) != "" {
-		encEmail, err = encryptEmail(cu.Email)
+		encEmail, err = encryptEmail(dataKey, cu.Email)
 		if err != nil {
 			http.Error(w, "Failed to encrypt email", http.StatusInternalServerError)
 			return
 		}
 	}
 
-	dbURL := os.Getenv("DATABASE_URL")
-	if dbURL == "" {
-		http.Error(w, "DATABASE_URL not set", http.StatusInternalServerError)
+	ctx, cancel := writeContext(r)
+	defer cancel()
+
+	u, err := userStore.Create(ctx, UserRecord{Name: cu.Name, Username: cu.Username, PasswordHash: string(hashedPw), Email: encEmail, DataKey: wrappedKey})
+	if errors.Is(err, errUsernameTaken) {
+		http.Error(w, "Username already taken", http.StatusConflict)
 		return
 	}
-
-	ctx := context.Background()
-	conn, err := pgx.Connect(ctx, dbURL)
 	if err != nil {
-		http.Error(w, "Failed to connect to database", http.StatusInternalServerError)
+		writeDBError(w, r, err, "DB error")
 		return
 	}
-	defer conn.Close(ctx)
 
-	var id int
-	err = conn.QueryRow(ctx, "INSERT INTO users (name, username, password, email) VALUES ($1, $2, $3, $4) RETURNING id", cu.Name, cu.Username, string(hashedPw), encEmail).Scan(&id)
-	if err != nil {
-		http.Error(w, "DB error", http.StatusInternalServerError)
-		return
+	// Verifying needs the single-use token table in Postgres.
+	if encEmail != "" && db != nil {
+		if err := sendVerificationEmail(ctx, cu.Username, cu.Email); err != nil {
+			fmt.Println("sending verification email failed:", err)
+		}
 	}
 
-	user := User{ID: id, Name: cu.Name, Username: cu.Username}
+	user := User{ID: u.ID, Name: u.Name, Username: u.Username}
 	w.Header().Set("Content-Type", "application/json")
 	w.WriteHeader(http.StatusCreated)
 	json.NewEncoder(w).Encode(user)
@@ -268,6 +328,13 @@ func main() {
 	if err != nil {
 		fmt.Println(".env file not found or failed to load")
 	}
+	if len(os.Args) > 1 && os.Args[1] == "migrate" {
+		if err := runMigrate(os.Args[2:]); err != nil {
+			fmt.Println("migrate:", err)
+			os.Exit(1)
+		}
+		return
+	}
 	secret := os.Getenv("JWT_SECRET")
 	if secret == "" {
 		fmt.Println("JWT_SECRET environment variable not set!")
@@ -275,27 +342,126 @@ func main() {
 	}
 	jwtSecret = []byte(secret)
 
-	encKeyB64 := os.Getenv("EMAIL_ENC_KEY")
-	if encKeyB64 == "" {
-		fmt.Println("EMAIL_ENC_KEY environment variable not set!")
+	jwtOptions, err = loadJWTOptions()
+	if err != nil {
+		fmt.Println(err)
 		return
 	}
-	key, err := base64.StdEncoding.DecodeString(encKeyB64)
+	userRoles, err = loadUserRoles()
 	if err != nil {
-		fmt.Println("EMAIL_ENC_KEY must be base64-encoded:", err)
+		fmt.Println(err)
 		return
 	}
-	if l := len(key); l != 16 && l != 24 && l != 32 {
-		fmt.Println("EMAIL_ENC_KEY must decode to 16, 24, or 32 bytes (AES-128/192/256)")
+	roleScopes, err = loadRoleScopes()
+	if err != nil {
+		fmt.Println(err)
+		return
+	}
+	db, err = openDB(context.Background())
+	if err != nil {
+		fmt.Println(err)
+		return
+	}
+	if db != nil {
+		defer db.Close()
+		if err := db.Ping(context.Background()); err != nil {
+			fmt.Println("Database not reachable yet:", err)
+		}
+	}
+	if err := autoMigrate(context.Background()); err != nil {
+		fmt.Println(err)
+		return
+	}
+	userStore, err = loadUserStore()
+	if err != nil {
+		fmt.Println(err)
+		return
+	}
+	lockout, err = loadLockoutPolicy()
+	if err != nil {
+		fmt.Println(err)
+		return
+	}
+	loginAttempts, err = loadAttemptStore()
+	if err != nil {
+		fmt.Println(err)
+		return
+	}
+	mailer, err = loadMailer()
+	if err != nil {
+		fmt.Println(err)
+		return
+	}
+	passwordRules, err = loadPasswordPolicy()
+	if err != nil {
+		fmt.Println(err)
+		return
+	}
+	queryTimeouts, err = loadQueryTimeouts()
+	if err != nil {
+		fmt.Println(err)
+		return
+	}
+	sessionConfig, err = loadSessionSettings()
+	if err != nil {
+		fmt.Println(err)
+		return
+	}
+	sessions, err = loadSessionStore()
+	if err != nil {
+		fmt.Println(err)
+		return
+	}
+	impersonation, err = loadImpersonationSettings()
+	if err != nil {
+		fmt.Println(err)
+		return
+	}
+	purgeSettings, err = loadPurgeSettings()
+	if err != nil {
+		fmt.Println(err)
 		return
 	}
-	emailKey = key
+
+	emailKey, err = loadAESKey("EMAIL_ENC_KEY")
+	if err != nil {
+		fmt.Println(err)
+		return
+	}
+	totpKey = emailKey
+	if os.Getenv("TOTP_ENC_KEY") != "" {
+		totpKey, err = loadAESKey("TOTP_ENC_KEY")
+		if err != nil {
+			fmt.Println(err)
+			return
+		}
+	}
+	go runUserPurge(context.Background(), purgeSettings)
 
 	http.Handle("/login", http.HandlerFunc(loginHandler))
-	http.Handle("/okCode", jwtMiddleware(http.HandlerFunc(okCodeHandler)))
-	http.Handle("/getUsers", jwtMiddleware(http.HandlerFunc(usersHandler)))
-	http.Handle("/createUser", jwtMiddleware(http.HandlerFunc(createUserHandler)))
-	http.Handle("/getEmail", jwtMiddleware(http.HandlerFunc(getEmailHandler)))
+	http.Handle("/loginMfa", http.HandlerFunc(loginMFAHandler))
+	http.Handle("/okCode", jwtMiddleware(authorize("/okCode", http.HandlerFunc(okCodeHandler))))
+	http.Handle("/getUsers", jwtMiddleware(authorize("/getUsers", http.HandlerFunc(usersHandler))))
+	http.Handle("/createUser", jwtMiddleware(authorize("/createUser", http.HandlerFunc(createUserHandler))))
+	http.Handle("/deleteUser", jwtMiddleware(authorize("/deleteUser", http.HandlerFunc(deleteUserHandler))))
+	http.Handle("/restoreUser", jwtMiddleware(authorize("/restoreUser", http.HandlerFunc(restoreUserHandler))))
+	http.Handle("/getEmail", jwtMiddleware(authorize("/getEmail", http.HandlerFunc(getEmailHandler))))
+	http.Handle("/policy", jwtMiddleware(authorize("/policy", http.HandlerFunc(policyHandler))))
+	http.Handle("/dbStats", requireDB(jwtMiddleware(authorize("/dbStats", http.HandlerFunc(dbStatsHandler)))))
+	http.Handle("/createApiKey", requireDB(jwtMiddleware(authorize("/createApiKey", http.HandlerFunc(createAPIKeyHandler)))))
+	http.Handle("/getApiKeys", requireDB(jwtMiddleware(authorize("/getApiKeys", http.HandlerFunc(apiKeysHandler)))))
+	http.Handle("POST /revokeApiKey", requireDB(jwtMiddleware(authorize("/revokeApiKey", http.HandlerFunc(revokeAPIKeyHandler)))))
+	http.Handle("/enrollTotp", jwtMiddleware(authorize("/enrollTotp", http.HandlerFunc(enrollTOTPHandler))))
+	http.Handle("/totpQrCode", jwtMiddleware(authorize("/totpQrCode", http.HandlerFunc(totpQRCodeHandler))))
+	http.Handle("/confirmTotp", jwtMiddleware(authorize("/confirmTotp", http.HandlerFunc(confirmTOTPHandler))))
+	http.Handle("/requestPasswordReset", http.HandlerFunc(requestPasswordResetHandler))
+	http.Handle("/resetPassword", requireDB(http.HandlerFunc(resetPasswordHandler)))
+	http.Handle("/verifyEmail", requireDB(http.HandlerFunc(verifyEmailHandler)))
+	http.Handle("/requestEmailVerification", requireDB(jwtMiddleware(authorize("/requestEmailVerification", http.HandlerFunc(requestEmailVerificationHandler)))))
+	http.Handle("/csrfToken", jwtMiddleware(authorize("/csrfToken", http.HandlerFunc(csrfTokenHandler))))
+	http.Handle("/logout", jwtMiddleware(authorize("/logout", http.HandlerFunc(logoutHandler))))
+	http.Handle("/unlockAccount", jwtMiddleware(authorize("/unlockAccount", http.HandlerFunc(unlockAccountHandler))))
+	http.Handle("/impersonate", jwtMiddleware(authorize("/impersonate", http.HandlerFunc(impersonateHandler))))
 
 	http.HandleFunc("/swagger/", httpSwagger.WrapHandler)
 
@@ -305,8 +471,39 @@ func main() {
 	}
 }
 
-func encryptEmail(plain string) (string, error) {
-	block, err := aes.NewCipher(emailKey)
+// loadAESKey reads a base64-encoded AES-128/192/256 key from the environment.
+func loadAESKey(name string) ([]byte, error) {
+	encKeyB64 := os.Getenv(name)
+	if encKeyB64 == "" {
+		return nil, fmt.Errorf("%s environment variable not set!", name)
+	}
+	key, err := base64.StdEncoding.DecodeString(encKeyB64)
+	if err != nil {
+		return nil, fmt.Errorf("%s must be base64-encoded: %w", name, err)
+	}
+	if l := len(key); l != 16 && l != 24 && l != 32 {
+		return nil, fmt.Errorf("%s must decode to 16, 24, or 32 bytes (AES-128/192/256)", name)
+	}
+	return key, nil
+}
+
+// encryptEmail encrypts an email with the owner's data key.
+func encryptEmail(key []byte, plain string) (string, error) {
+	return sealString(key, plain)
+}
+
+// decryptEmail returns u's email in clear text.
+func decryptEmail(u UserRecord) (string, error) {
+	key, err := userDataKey(u)
+	if err != nil {
+		return "", err
+	}
+	return openString(key, u.Email)
+}
+
+// sealString encrypts with AES-GCM and returns base64(nonce || ciphertext).
+func sealString(key []byte, plain string) (string, error) {
+	block, err := aes.NewCipher(key)
 	if err != nil {
 		return "", err
 	}
@@ -323,12 +520,12 @@ func encryptEmail(plain string) (string, error) {
 	return base64.StdEncoding.EncodeToString(ciphertext), nil
 }
 
-func decryptEmail(b64 string) (string, error) {
+func openString(key []byte, b64 string) (string, error) {
 	data, err := base64.StdEncoding.DecodeString(b64)
 	if err != nil {
 		return "", err
 	}
-	block, err := aes.NewCipher(emailKey)
+	block, err := aes.NewCipher(key)
 	if err != nil {
 		return "", err
 	}
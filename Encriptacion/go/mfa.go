@@ -0,0 +1,389 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/base32"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/skip2/go-qrcode"
+	"golang.org/x/crypto/bcrypt"
+)
+
+// TOTP state is kept by the user store: the secret (AES-GCM encrypted,
+// base64), whether TOTP is enabled, the last time step used, and one-time
+// recovery codes, stored as bcrypt hashes.
+//
+// TOTP secrets are credentials rather than personal data, so they stay
+// under TOTP_ENC_KEY and simply go away with the user when it is purged.
+const (
+	mfaTokenTTL       = 5 * time.Minute
+	mfaAudience       = "mfa"
+	recoveryCodeCount = 10
+)
+
+var errTOTPCodeInvalid = errors.New("invalid or already used code")
+
+type TOTPEnrollment struct {
+	Secret          string `json:"secret"`
+	ProvisioningURI string `json:"provisioning_uri"`
+	QRCodeURL       string `json:"qr_code_url"`
+}
+
+type TOTPCode struct {
+	Code string `json:"code"`
+}
+
+type RecoveryCodes struct {
+	RecoveryCodes []string `json:"recovery_codes"`
+}
+
+type MFALogin struct {
+	MFAToken string `json:"mfa_token"`
+	// Code is a current TOTP code or one of the recovery codes.
+	Code string `json:"code"`
+	// Session asks for a session cookie instead of a token in the body.
+	Session bool `json:"session"`
+}
+
+// generateMFAToken issues the short-lived challenge returned by loginHandler
+// when the password was right but a second factor is still needed. Its
+// audience differs from access tokens, so jwtMiddleware rejects it.
+func generateMFAToken(username string) (string, error) {
+	return generatePurposeToken(username, mfaAudience, mfaTokenTTL)
+}
+
+func parseMFAToken(tokenString string) (string, error) {
+	claims, err := parsePurposeToken(tokenString, mfaAudience)
+	if err != nil {
+		return "", err
+	}
+	return claims.GetSubject()
+}
+
+func encryptTOTPSecret(secret []byte) (string, error) {
+	return sealString(totpKey, totpEncoding.EncodeToString(secret))
+}
+
+func decryptTOTPSecret(enc string) ([]byte, error) {
+	plain, err := openString(totpKey, enc)
+	if err != nil {
+		return nil, err
+	}
+	return totpEncoding.DecodeString(plain)
+}
+
+// userTOTP loads a user's TOTP secret. A nil secret means none is stored.
+func userTOTP(ctx context.Context, username string) (secret []byte, enabled bool, err error) {
+	u, err := userStore.FindByUsername(ctx, username)
+	if err != nil {
+		return nil, false, err
+	}
+	if u.TOTPSecret == "" {
+		return nil, u.TOTPEnabled, nil
+	}
+	secret, err = decryptTOTPSecret(u.TOTPSecret)
+	return secret, u.TOTPEnabled, err
+}
+
+// consumeTOTP verifies a code and records its time step, so each code works
+// at most once even within its validity window.
+func consumeTOTP(ctx context.Context, username string, secret []byte, code string) error {
+	step, ok := verifyTOTP(secret, code, time.Now())
+	if !ok {
+		return errTOTPCodeInvalid
+	}
+	return userStore.UseTOTPStep(ctx, username, step)
+}
+
+// consumeRecoveryCode marks a matching unused recovery code as used.
+func consumeRecoveryCode(ctx context.Context, username, code string) error {
+	code = normalizeRecoveryCode(code)
+	codes, err := userStore.RecoveryCodes(ctx, username)
+	if err != nil {
+		return err
+	}
+	for _, c := range codes {
+		if bcrypt.CompareHashAndPassword([]byte(c.Hash), []byte(code)) == nil {
+			return userStore.UseRecoveryCode(ctx, c.ID)
+		}
+	}
+	return errTOTPCodeInvalid
+}
+
+func normalizeRecoveryCode(code string) string {
+	return strings.ToLower(strings.ReplaceAll(strings.TrimSpace(code), "-", ""))
+}
+
+func newRecoveryCode() (string, error) {
+	b := make([]byte, 5)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	code := strings.ToLower(base32.StdEncoding.EncodeToString(b))
+	return code[:4] + "-" + code[4:], nil
+}
+
+// mfaUser returns the signed-in user for the enrollment endpoints, which
+// only make sense for people, not API keys.
+func mfaUser(w http.ResponseWriter, r *http.Request) (string, bool) {
+	principal, ok := principalFromContext(r.Context())
+	if !ok {
+		writeUnauthorized(w, "")
+		return "", false
+	}
+	if principal.isAPIKey() {
+		http.Error(w, "API keys cannot enroll in MFA", http.StatusForbidden)
+		return "", false
+	}
+	return principal.Username, true
+}
+
+// enrollTOTPHandler godoc
+// @Summary Start TOTP enrollment
+// @Description Generates a new TOTP secret for the caller. It is not enforced until confirmed with /confirmTotp.
+// @Tags mfa
+// @Produce json
+// @Success 200 {object} TOTPEnrollment
+// @Failure 404 {string} string "User not found"
+// @Failure 409 {string} string "TOTP is already enabled"
+// @Failure 500 {string} string "DB error"
+// @Failure 504 {string} string "Database timed out"
+// @Router /enrollTotp [post]
+func enrollTOTPHandler(w http.ResponseWriter, r *http.Request) {
+	username, ok := mfaUser(w, r)
+	if !ok {
+		return
+	}
+
+	ctx, cancel := writeContext(r)
+	defer cancel()
+
+	secret, err := newTOTPSecret()
+	if err != nil {
+		http.Error(w, "Could not generate secret", http.StatusInternalServerError)
+		return
+	}
+	enc, err := encryptTOTPSecret(secret)
+	if err != nil {
+		http.Error(w, "Failed to encrypt secret", http.StatusInternalServerError)
+		return
+	}
+
+	u, err := userStore.FindByUsername(ctx, username)
+	if errors.Is(err, errUserNotFound) {
+		http.Error(w, "User not found", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		writeDBError(w, r, err, "DB error")
+		return
+	}
+	if u.TOTPEnabled {
+		http.Error(w, "TOTP is already enabled", http.StatusConflict)
+		return
+	}
+	// StartTOTP only misses when TOTP was enabled in the meantime.
+	err = userStore.StartTOTP(ctx, username, enc)
+	if errors.Is(err, errUserNotFound) {
+		http.Error(w, "TOTP is already enabled", http.StatusConflict)
+		return
+	}
+	if err != nil {
+		writeDBError(w, r, err, "DB error")
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	json.NewEncoder(w).Encode(TOTPEnrollment{
+		Secret:          totpEncoding.EncodeToString(secret),
+		ProvisioningURI: totpProvisioningURI(secret, username),
+		QRCodeURL:       "/totpQrCode",
+	})
+}
+
+// totpQRCodeHandler godoc
+// @Summary TOTP enrollment QR code
+// @Description Returns the pending provisioning URI as a PNG QR code. Not available once TOTP is enabled.
+// @Tags mfa
+// @Produce png
+// @Success 200 {file} binary
+// @Failure 404 {string} string "No pending TOTP enrollment"
+// @Failure 504 {string} string "Database timed out"
+// @Router /totpQrCode [get]
+func totpQRCodeHandler(w http.ResponseWriter, r *http.Request) {
+	username, ok := mfaUser(w, r)
+	if !ok {
+		return
+	}
+
+	ctx, cancel := readContext(r)
+	defer cancel()
+
+	secret, enabled, err := userTOTP(ctx, username)
+	if err != nil && !errors.Is(err, errUserNotFound) {
+		writeDBError(w, r, err, "DB error")
+		return
+	}
+	if secret == nil || enabled {
+		http.Error(w, "No pending TOTP enrollment", http.StatusNotFound)
+		return
+	}
+
+	png, err := qrcode.Encode(totpProvisioningURI(secret, username), qrcode.Medium, 256)
+	if err != nil {
+		http.Error(w, "Could not render QR code", http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "image/png")
+	w.Header().Set("Cache-Control", "no-store")
+	w.Write(png)
+}
+
+// confirmTOTPHandler godoc
+// @Summary Confirm TOTP enrollment
+// @Description Enables TOTP once the first code from the authenticator app checks out, and returns one-time recovery codes. They are only shown here.
+// @Tags mfa
+// @Accept json
+// @Produce json
+// @Param code body TOTPCode true "Current TOTP code"
+// @Success 200 {object} RecoveryCodes
+// @Failure 400 {string} string "Invalid or already used code"
+// @Failure 404 {string} string "No pending TOTP enrollment"
+// @Failure 504 {string} string "Database timed out"
+// @Router /confirmTotp [post]
+func confirmTOTPHandler(w http.ResponseWriter, r *http.Request) {
+	username, ok := mfaUser(w, r)
+	if !ok {
+		return
+	}
+	var tc TOTPCode
+	if err := json.NewDecoder(r.Body).Decode(&tc); err != nil {
+		http.Error(w, "Invalid input", http.StatusBadRequest)
+		return
+	}
+
+	ctx, cancel := writeContext(r)
+	defer cancel()
+
+	secret, enabled, err := userTOTP(ctx, username)
+	if err != nil && !errors.Is(err, errUserNotFound) {
+		writeDBError(w, r, err, "DB error")
+		return
+	}
+	if secret == nil || enabled {
+		http.Error(w, "No pending TOTP enrollment", http.StatusNotFound)
+		return
+	}
+
+	if err := consumeTOTP(ctx, username, secret, tc.Code); err != nil {
+		if errors.Is(err, errTOTPCodeInvalid) {
+			http.Error(w, "Invalid or already used code", http.StatusBadRequest)
+			return
+		}
+		writeDBError(w, r, err, "DB error")
+		return
+	}
+
+	codes := make([]string, recoveryCodeCount)
+	hashes := make([]string, recoveryCodeCount)
+	for i := range codes {
+		code, err := newRecoveryCode()
+		if err != nil {
+			http.Error(w, "Could not generate recovery codes", http.StatusInternalServerError)
+			return
+		}
+		hash, err := bcrypt.GenerateFromPassword([]byte(normalizeRecoveryCode(code)), bcrypt.DefaultCost)
+		if err != nil {
+			http.Error(w, "Could not generate recovery codes", http.StatusInternalServerError)
+			return
+		}
+		codes[i], hashes[i] = code, string(hash)
+	}
+
+	if err := userStore.EnableTOTP(ctx, username, hashes); err != nil {
+		writeDBError(w, r, err, "DB error")
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	json.NewEncoder(w).Encode(RecoveryCodes{RecoveryCodes: codes})
+}
+
+// loginMFAHandler godoc
+// @Summary Complete an MFA login
+// @Description Exchanges the mfa_token from /login plus a TOTP or recovery code for an access token, or a session cookie with "session": true
+// @Tags auth
+// @Accept json
+// @Produce json
+// @Param login body MFALogin true "MFA challenge and code"
+// @Success 200 {object} LoginResponse
+// @Failure 400 {string} string "Invalid input"
+// @Failure 401 {string} string "Invalid or expired MFA token" or "Invalid code"
+// @Failure 429 {string} string "Too many failed attempts, try again later"
+// @Failure 504 {string} string "Database timed out"
+// @Router /loginMfa [post]
+func loginMFAHandler(w http.ResponseWriter, r *http.Request) {
+	var ml MFALogin
+	if err := json.NewDecoder(r.Body).Decode(&ml); err != nil {
+		http.Error(w, "Invalid input", http.StatusBadRequest)
+		return
+	}
+	username, err := parseMFAToken(ml.MFAToken)
+	if err != nil || username == "" {
+		http.Error(w, "Invalid or expired MFA token", http.StatusUnauthorized)
+		return
+	}
+	if !checkLockout(w, r, username) {
+		return
+	}
+
+	ctx, cancel := writeContext(r)
+	defer cancel()
+
+	secret, enabled, err := userTOTP(ctx, username)
+	if err != nil || !enabled || secret == nil {
+		http.Error(w, "Invalid or expired MFA token", http.StatusUnauthorized)
+		return
+	}
+
+	if strings.Contains(ml.Code, "-") || len(strings.TrimSpace(ml.Code)) > totpDigits {
+		err = consumeRecoveryCode(ctx, username, ml.Code)
+	} else {
+		err = consumeTOTP(ctx, username, secret, ml.Code)
+	}
+	if err != nil {
+		if !errors.Is(err, errTOTPCodeInvalid) {
+			fmt.Println("MFA verification failed:", err)
+			writeDBError(w, r, err, "DB error")
+			return
+		}
+		recordLoginFailure(r, username)
+		http.Error(w, "Invalid code", http.StatusUnauthorized)
+		return
+	}
+	recordLoginSuccess(r, username)
+
+	if ml.Session {
+		if err := startSession(w, r, username); err != nil {
+			writeDBError(w, r, err, "Could not start session")
+		}
+		return
+	}
+
+	token, err := generateJWT(username)
+	if err != nil {
+		http.Error(w, "Could not generate token", http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	json.NewEncoder(w).Encode(LoginResponse{Token: token})
+}
@@ -0,0 +1,21 @@
+-- Deployments from before migrations already have this table, with id,
+-- name, username, password and email, so this step only creates what is
+-- missing.
+CREATE TABLE IF NOT EXISTS users (
+    id       BIGINT GENERATED BY DEFAULT AS IDENTITY PRIMARY KEY,
+    name     TEXT NOT NULL,
+    username TEXT NOT NULL UNIQUE,
+    password TEXT NOT NULL
+);
+
+ALTER TABLE users
+    -- AES-GCM ciphertext, base64 encoded (see encryptEmail).
+    ADD COLUMN IF NOT EXISTS email              TEXT,
+    ADD COLUMN IF NOT EXISTS email_verified     BOOLEAN NOT NULL DEFAULT false,
+    -- AES-GCM ciphertext, base64 encoded (see encryptTOTPSecret).
+    ADD COLUMN IF NOT EXISTS totp_secret        TEXT,
+    ADD COLUMN IF NOT EXISTS totp_enabled       BOOLEAN NOT NULL DEFAULT false,
+    ADD COLUMN IF NOT EXISTS totp_last_step     BIGINT NOT NULL DEFAULT 0,
+    -- Access tokens issued before this are refused; a password reset moves
+    -- it to the time of the reset.
+    ADD COLUMN IF NOT EXISTS tokens_valid_after TIMESTAMPTZ;
@@ -0,0 +1 @@
+DROP TABLE used_tokens;
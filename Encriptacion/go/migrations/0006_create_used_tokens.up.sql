@@ -0,0 +1,6 @@
+CREATE TABLE IF NOT EXISTS used_tokens (
+    jti        TEXT PRIMARY KEY,
+    purpose    TEXT NOT NULL,
+    expires_at TIMESTAMPTZ NOT NULL,
+    used_at    TIMESTAMPTZ NOT NULL DEFAULT now()
+);
@@ -0,0 +1,4 @@
+-- Emails encrypted with a per-user data key cannot be read after this.
+DROP TABLE user_keys;
+DROP INDEX users_deleted_at_idx;
+ALTER TABLE users DROP COLUMN deleted_at;
@@ -0,0 +1,13 @@
+-- deleted_at marks a soft-deleted user; the purge job removes the row once
+-- USER_RETENTION has passed.
+ALTER TABLE users ADD COLUMN deleted_at TIMESTAMPTZ;
+
+CREATE INDEX users_deleted_at_idx ON users (deleted_at) WHERE deleted_at IS NOT NULL;
+
+-- Per-user data keys, AES-GCM wrapped with EMAIL_ENC_KEY and base64 encoded
+-- (see newDataKey). Deleting a key crypto-shreds everything encrypted with it.
+CREATE TABLE user_keys (
+    user_id     BIGINT PRIMARY KEY REFERENCES users (id) ON DELETE CASCADE,
+    wrapped_key TEXT NOT NULL,
+    created_at  TIMESTAMPTZ NOT NULL DEFAULT now()
+);
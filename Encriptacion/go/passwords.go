@@ -0,0 +1,229 @@
+package main
+
+import (
+	"bufio"
+	"crypto/sha1"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+)
+
+// Character classes a password policy can require.
+const (
+	classLower  = "lower"
+	classUpper  = "upper"
+	classDigit  = "digit"
+	classSymbol = "symbol"
+)
+
+// bcryptMaxPasswordLength is the longest password, in bytes, that
+// bcrypt.GenerateFromPassword accepts.
+const bcryptMaxPasswordLength = 72
+
+// passwordPolicy is configured with PASSWORD_MIN_LENGTH, PASSWORD_MAX_LENGTH,
+// PASSWORD_REQUIRED_CLASSES (comma-separated lower, upper, digit, symbol)
+// and PASSWORD_BREACHED_LIST.
+type passwordPolicy struct {
+	MinLength int
+	// MaxLength defaults to, and cannot exceed, bcryptMaxPasswordLength.
+	MaxLength       int
+	RequiredClasses []string
+	Breached        *breachedPasswords
+}
+
+var passwordRules = passwordPolicy{
+	MinLength:       10,
+	MaxLength:       bcryptMaxPasswordLength,
+	RequiredClasses: []string{classLower, classUpper, classDigit},
+}
+
+func loadPasswordPolicy() (passwordPolicy, error) {
+	p := passwordRules
+	lengths := []struct {
+		name string
+		dst  *int
+	}{
+		{"PASSWORD_MIN_LENGTH", &p.MinLength},
+		{"PASSWORD_MAX_LENGTH", &p.MaxLength},
+	}
+	for _, l := range lengths {
+		if v := os.Getenv(l.name); v != "" {
+			n, err := strconv.Atoi(v)
+			if err != nil || n < 1 {
+				return p, fmt.Errorf("%s must be a positive integer", l.name)
+			}
+			*l.dst = n
+		}
+	}
+	if p.MaxLength > bcryptMaxPasswordLength {
+		return p, fmt.Errorf("PASSWORD_MAX_LENGTH cannot exceed %d, the most bcrypt accepts", bcryptMaxPasswordLength)
+	}
+	if p.MinLength > p.MaxLength {
+		return p, fmt.Errorf("PASSWORD_MIN_LENGTH cannot exceed PASSWORD_MAX_LENGTH")
+	}
+
+	if v, ok := os.LookupEnv("PASSWORD_REQUIRED_CLASSES"); ok {
+		p.RequiredClasses = nil
+		for _, c := range strings.Split(v, ",") {
+			c = strings.TrimSpace(c)
+			switch c {
+			case "":
+			case classLower, classUpper, classDigit, classSymbol:
+				p.RequiredClasses = append(p.RequiredClasses, c)
+			default:
+				return p, fmt.Errorf("PASSWORD_REQUIRED_CLASSES: unknown class %q", c)
+			}
+		}
+	}
+
+	if path := os.Getenv("PASSWORD_BREACHED_LIST"); path != "" {
+		b, err := loadBreachedPasswords(path)
+		if err != nil {
+			return p, fmt.Errorf("PASSWORD_BREACHED_LIST: %w", err)
+		}
+		p.Breached = b
+	}
+	return p, nil
+}
+
+// check returns every rule password breaks, or nil if it is acceptable.
+func (p passwordPolicy) check(username, password string) []FieldError {
+	var errs []FieldError
+	add := func(rule, message string) {
+		errs = append(errs, FieldError{Field: "password", Rule: rule, Message: message})
+	}
+
+	n := utf8.RuneCountInString(password)
+	if n < p.MinLength {
+		add("min_length", fmt.Sprintf("must be at least %d characters", p.MinLength))
+	}
+	if len(password) > p.MaxLength {
+		add("max_length", fmt.Sprintf("must be at most %d bytes", p.MaxLength))
+	}
+
+	has := map[string]bool{}
+	for _, r := range password {
+		switch {
+		case unicode.IsLower(r):
+			has[classLower] = true
+		case unicode.IsUpper(r):
+			has[classUpper] = true
+		case unicode.IsDigit(r):
+			has[classDigit] = true
+		default:
+			has[classSymbol] = true
+		}
+	}
+	messages := map[string]string{
+		classLower:  "must contain a lowercase letter",
+		classUpper:  "must contain an uppercase letter",
+		classDigit:  "must contain a digit",
+		classSymbol: "must contain a symbol",
+	}
+	for _, c := range p.RequiredClasses {
+		if !has[c] {
+			add("require_"+c, messages[c])
+		}
+	}
+
+	if u := strings.ToLower(strings.TrimSpace(username)); len(u) >= 3 && strings.Contains(strings.ToLower(password), u) {
+		add("contains_username", "must not contain the username")
+	}
+
+	if p.Breached != nil {
+		breached, err := p.Breached.contains(password)
+		if err != nil {
+			// A missing or unreadable list should not block every signup,
+			// so the password is accepted without this check.
+			fmt.Println("breached password check failed, skipping it:", err)
+		} else if breached {
+			add("breached", "appears in a list of breached passwords; choose another")
+		}
+	}
+	return errs
+}
+
+// breachedPasswords checks SHA-1 hashes using the k-anonymity range layout of
+// the Pwned Passwords API: the first five hex digits select a range, which
+// lists the remaining 35 digits as SUFFIX:COUNT lines.
+//
+// PASSWORD_BREACHED_LIST may point to a directory of downloaded ranges, one
+// file per prefix (ABCDE or ABCDE.txt), read on demand; or to a single file
+// of full HASH or HASH:COUNT lines, loaded into memory at startup.
+type breachedPasswords struct {
+	dir    string
+	ranges map[string]map[string]bool
+}
+
+func loadBreachedPasswords(path string) (*breachedPasswords, error) {
+	info, err := os.Stat(path)
+	if err != nil {
+		return nil, err
+	}
+	if info.IsDir() {
+		return &breachedPasswords{dir: path}, nil
+	}
+
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	b := &breachedPasswords{ranges: map[string]map[string]bool{}}
+	scanner := bufio.NewScanner(f)
+	for line := 1; scanner.Scan(); line++ {
+		text := strings.TrimSpace(scanner.Text())
+		if text == "" || strings.HasPrefix(text, "#") {
+			continue
+		}
+		hash, _, _ := strings.Cut(text, ":")
+		hash = strings.ToUpper(hash)
+		if _, err := hex.DecodeString(hash); err != nil || len(hash) != 40 {
+			return nil, fmt.Errorf("line %d: expected a SHA-1 hex hash", line)
+		}
+		prefix, suffix := hash[:5], hash[5:]
+		if b.ranges[prefix] == nil {
+			b.ranges[prefix] = map[string]bool{}
+		}
+		b.ranges[prefix][suffix] = true
+	}
+	return b, scanner.Err()
+}
+
+func (b *breachedPasswords) contains(password string) (bool, error) {
+	sum := sha1.Sum([]byte(password))
+	hash := strings.ToUpper(hex.EncodeToString(sum[:]))
+	prefix, suffix := hash[:5], hash[5:]
+	if b.dir == "" {
+		return b.ranges[prefix][suffix], nil
+	}
+
+	f, err := os.Open(filepath.Join(b.dir, prefix+".txt"))
+	if errors.Is(err, fs.ErrNotExist) {
+		f, err = os.Open(filepath.Join(b.dir, prefix))
+	}
+	if errors.Is(err, fs.ErrNotExist) {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		s, _, _ := strings.Cut(strings.TrimSpace(scanner.Text()), ":")
+		if strings.EqualFold(s, suffix) {
+			return true, nil
+		}
+	}
+	return false, scanner.Err()
+}
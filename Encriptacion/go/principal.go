@@ -0,0 +1,142 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/golang-jwt/jwt/v5"
+)
+
+const roleAdmin = "admin"
+
+var defaultRoles = []string{"user"}
+
+// userRoles maps a username to the roles stamped into its tokens. Users
+// without an entry get defaultRoles.
+var userRoles map[string][]string
+
+// Principal is the authenticated identity behind a request, as established
+// by jwtMiddleware.
+type Principal struct {
+	Subject string
+	// Username is the user the request acts as. It is empty for API keys,
+	// which belong to no user, so ownership checks never match them.
+	Username string
+	Roles    []string
+	Scopes   []string
+	TokenID  string
+	// Actor is the real caller when the token impersonates Username (the
+	// RFC 8693 act claim), and empty otherwise.
+	Actor string
+	// Session is set when the request was authenticated by session cookie.
+	Session *Session
+}
+
+// actorName names the principal in audit records: its username, or its
+// subject for an API key.
+func (p *Principal) actorName() string {
+	if p.Username != "" {
+		return p.Username
+	}
+	return p.Subject
+}
+
+func (p *Principal) HasScope(scope string) bool {
+	for _, s := range p.Scopes {
+		if s == scope {
+			return true
+		}
+	}
+	return false
+}
+
+type principalContextKey struct{}
+
+func contextWithPrincipal(ctx context.Context, p *Principal) context.Context {
+	return context.WithValue(ctx, principalContextKey{}, p)
+}
+
+// principalFromContext returns the principal stored by jwtMiddleware. The
+// boolean is false on routes that are not behind the middleware.
+func principalFromContext(ctx context.Context) (*Principal, bool) {
+	p, ok := ctx.Value(principalContextKey{}).(*Principal)
+	return p, ok && p != nil
+}
+
+// principalFromClaims builds a Principal from validated token claims.
+// Roles are a JSON array and scopes a space-delimited string, as in RFC 9068.
+func principalFromClaims(claims jwt.MapClaims) *Principal {
+	p := &Principal{}
+	p.Subject, _ = claims.GetSubject()
+	p.Username, _ = claims["username"].(string)
+	if p.Username == "" {
+		p.Username = p.Subject
+	}
+	if p.Subject == "" {
+		p.Subject = p.Username
+	}
+	p.TokenID, _ = claims["jti"].(string)
+	if act, ok := claims["act"].(map[string]interface{}); ok {
+		p.Actor, _ = act["sub"].(string)
+	}
+
+	if roles, ok := claims["roles"].([]interface{}); ok {
+		for _, r := range roles {
+			if s, ok := r.(string); ok && s != "" {
+				p.Roles = append(p.Roles, s)
+			}
+		}
+	}
+	if scope, ok := claims["scope"].(string); ok {
+		p.Scopes = strings.Fields(scope)
+	}
+	return p
+}
+
+// loadUserRoles parses USER_ROLES, e.g. "aminespinoza=admin,user;marcela=user".
+func loadUserRoles() (map[string][]string, error) {
+	return parseAssignments("USER_ROLES", os.Getenv("USER_ROLES"))
+}
+
+// parseAssignments parses "key=a,b;other=c" lists used by the role and scope
+// settings.
+func parseAssignments(name, v string) (map[string][]string, error) {
+	assignments := map[string][]string{}
+	for _, entry := range strings.Split(v, ";") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+		key, list, ok := strings.Cut(entry, "=")
+		key = strings.TrimSpace(key)
+		if !ok || key == "" {
+			return nil, fmt.Errorf("%s: expected name=value[,value] but got %q", name, entry)
+		}
+		assignments[key] = []string{}
+		for _, item := range strings.Split(list, ",") {
+			if item = strings.TrimSpace(item); item != "" {
+				assignments[key] = append(assignments[key], item)
+			}
+		}
+	}
+	return assignments, nil
+}
+
+func rolesFor(username string) []string {
+	if roles, ok := userRoles[username]; ok {
+		return roles
+	}
+	return defaultRoles
+}
+
+func newTokenID() (string, error) {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(b), nil
+}
@@ -0,0 +1,338 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+)
+
+// Browser clients can log in with "session": true. Instead of a token in the
+// response body they get an HttpOnly session cookie plus a CSRF token that
+// must be echoed in the X-CSRF-Token header on every request to a route that
+// is not ReadOnly (the synchronizer token pattern). Sessions are kept
+// server-side, keyed by the SHA-256 of the cookie value, in a sessionStore
+// chosen with SESSION_STORE: "memory" (the default) or "postgres", using
+//
+//	sessions: id_hash (primary key), username, csrf_token, created_at, expires_at
+const csrfHeader = "X-CSRF-Token"
+
+var errSessionInvalid = errors.New("session is invalid or expired")
+
+type Session struct {
+	IDHash    string
+	Username  string
+	CSRFToken string
+	CreatedAt time.Time
+	ExpiresAt time.Time
+}
+
+type SessionResponse struct {
+	CSRFToken string    `json:"csrf_token"`
+	ExpiresAt time.Time `json:"expires_at"`
+}
+
+type sessionStore interface {
+	Create(ctx context.Context, s Session) error
+	// Get returns errSessionInvalid for unknown or expired sessions.
+	Get(ctx context.Context, idHash string) (Session, error)
+	Delete(ctx context.Context, idHash string) error
+	// DeleteUser ends every session of username.
+	DeleteUser(ctx context.Context, username string) error
+}
+
+// sessionSettings is configured with SESSION_COOKIE_NAME, SESSION_TTL,
+// SESSION_COOKIE_SECURE and SESSION_COOKIE_SAMESITE (strict or lax).
+type sessionSettings struct {
+	CookieName string
+	TTL        time.Duration
+	Secure     bool
+	SameSite   http.SameSite
+}
+
+var sessionConfig = sessionSettings{
+	CookieName: "moa_session",
+	TTL:        8 * time.Hour,
+	Secure:     true,
+	SameSite:   http.SameSiteStrictMode,
+}
+
+var sessions sessionStore = newMemorySessionStore()
+
+func loadSessionSettings() (sessionSettings, error) {
+	s := sessionConfig
+	if v := os.Getenv("SESSION_COOKIE_NAME"); v != "" {
+		s.CookieName = v
+	}
+	if v := os.Getenv("SESSION_TTL"); v != "" {
+		d, err := time.ParseDuration(v)
+		if err != nil || d <= 0 {
+			return s, fmt.Errorf("SESSION_TTL must be a positive duration such as 8h")
+		}
+		s.TTL = d
+	}
+	if v := os.Getenv("SESSION_COOKIE_SECURE"); v != "" {
+		b, err := strconv.ParseBool(v)
+		if err != nil {
+			return s, fmt.Errorf("SESSION_COOKIE_SECURE must be true or false")
+		}
+		s.Secure = b
+	}
+	switch v := strings.ToLower(os.Getenv("SESSION_COOKIE_SAMESITE")); v {
+	case "":
+	case "strict":
+		s.SameSite = http.SameSiteStrictMode
+	case "lax":
+		s.SameSite = http.SameSiteLaxMode
+	default:
+		return s, fmt.Errorf("SESSION_COOKIE_SAMESITE must be strict or lax, got %q", v)
+	}
+	return s, nil
+}
+
+func loadSessionStore() (sessionStore, error) {
+	switch v := os.Getenv("SESSION_STORE"); v {
+	case "", "memory":
+		return newMemorySessionStore(), nil
+	case "postgres":
+		if db == nil {
+			return nil, fmt.Errorf("SESSION_STORE=postgres needs DATABASE_URL")
+		}
+		return postgresSessionStore{}, nil
+	default:
+		return nil, fmt.Errorf("SESSION_STORE must be memory or postgres, got %q", v)
+	}
+}
+
+func randomURLToken() (string, error) {
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(b), nil
+}
+
+func hashSessionID(id string) string {
+	sum := sha256.Sum256([]byte(id))
+	return hex.EncodeToString(sum[:])
+}
+
+// startSession creates a session for username, sets its cookie and writes
+// the CSRF token the client must send back.
+func startSession(w http.ResponseWriter, r *http.Request, username string) error {
+	id, err := randomURLToken()
+	if err != nil {
+		return err
+	}
+	csrf, err := randomURLToken()
+	if err != nil {
+		return err
+	}
+	now := time.Now().UTC()
+	s := Session{
+		IDHash:    hashSessionID(id),
+		Username:  username,
+		CSRFToken: csrf,
+		CreatedAt: now,
+		ExpiresAt: now.Add(sessionConfig.TTL),
+	}
+	ctx, cancel := writeContext(r)
+	defer cancel()
+	if err := sessions.Create(ctx, s); err != nil {
+		return err
+	}
+
+	http.SetCookie(w, &http.Cookie{
+		Name:     sessionConfig.CookieName,
+		Value:    id,
+		Path:     "/",
+		Expires:  s.ExpiresAt,
+		MaxAge:   int(sessionConfig.TTL.Seconds()),
+		HttpOnly: true,
+		Secure:   sessionConfig.Secure,
+		SameSite: sessionConfig.SameSite,
+	})
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	json.NewEncoder(w).Encode(SessionResponse{CSRFToken: s.CSRFToken, ExpiresAt: s.ExpiresAt})
+	return nil
+}
+
+func clearSessionCookie(w http.ResponseWriter) {
+	http.SetCookie(w, &http.Cookie{
+		Name:     sessionConfig.CookieName,
+		Value:    "",
+		Path:     "/",
+		MaxAge:   -1,
+		HttpOnly: true,
+		Secure:   sessionConfig.Secure,
+		SameSite: sessionConfig.SameSite,
+	})
+}
+
+// authenticateSession looks up the session behind a cookie value. Roles and
+// scopes are resolved on every request, so changes apply immediately.
+func authenticateSession(ctx context.Context, id string) (*Principal, error) {
+	s, err := sessions.Get(ctx, hashSessionID(id))
+	if err != nil {
+		return nil, err
+	}
+	roles := rolesFor(s.Username)
+	return &Principal{
+		Subject:  s.Username,
+		Username: s.Username,
+		Roles:    roles,
+		Scopes:   scopesFor(roles),
+		Session:  &s,
+	}, nil
+}
+
+func validCSRF(r *http.Request, s *Session) bool {
+	token := r.Header.Get(csrfHeader)
+	return token != "" && subtle.ConstantTimeCompare([]byte(token), []byte(s.CSRFToken)) == 1
+}
+
+// csrfTokenHandler godoc
+// @Summary Get the session's CSRF token
+// @Description Returns the CSRF token for the current cookie session, for clients that lost it (for example after a page reload)
+// @Tags auth
+// @Produce json
+// @Success 200 {object} SessionResponse
+// @Failure 400 {string} string "Not a cookie session"
+// @Router /csrfToken [get]
+func csrfTokenHandler(w http.ResponseWriter, r *http.Request) {
+	principal, ok := principalFromContext(r.Context())
+	if !ok {
+		writeUnauthorized(w, "")
+		return
+	}
+	if principal.Session == nil {
+		http.Error(w, "Not a cookie session", http.StatusBadRequest)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	json.NewEncoder(w).Encode(SessionResponse{CSRFToken: principal.Session.CSRFToken, ExpiresAt: principal.Session.ExpiresAt})
+}
+
+// logoutHandler godoc
+// @Summary Log out
+// @Description Ends the current cookie session and clears the cookie
+// @Tags auth
+// @Param X-CSRF-Token header string true "CSRF token from login"
+// @Success 204
+// @Failure 400 {string} string "Not a cookie session"
+// @Failure 500 {string} string "Failed to end session"
+// @Failure 504 {string} string "Database timed out"
+// @Router /logout [post]
+func logoutHandler(w http.ResponseWriter, r *http.Request) {
+	principal, ok := principalFromContext(r.Context())
+	if !ok {
+		writeUnauthorized(w, "")
+		return
+	}
+	if principal.Session == nil {
+		http.Error(w, "Not a cookie session", http.StatusBadRequest)
+		return
+	}
+	ctx, cancel := writeContext(r)
+	defer cancel()
+	if err := sessions.Delete(ctx, principal.Session.IDHash); err != nil {
+		fmt.Println("ending session failed:", err)
+		writeDBError(w, r, err, "Failed to end session")
+		return
+	}
+	clearSessionCookie(w)
+	w.WriteHeader(http.StatusNoContent)
+}
+
+type memorySessionStore struct {
+	mu       sync.Mutex
+	sessions map[string]Session
+}
+
+func newMemorySessionStore() *memorySessionStore {
+	return &memorySessionStore{sessions: map[string]Session{}}
+}
+
+func (m *memorySessionStore) Create(ctx context.Context, s Session) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	now := time.Now()
+	for k, v := range m.sessions {
+		if now.After(v.ExpiresAt) {
+			delete(m.sessions, k)
+		}
+	}
+	m.sessions[s.IDHash] = s
+	return nil
+}
+
+func (m *memorySessionStore) Get(ctx context.Context, idHash string) (Session, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	s, ok := m.sessions[idHash]
+	if !ok || time.Now().After(s.ExpiresAt) {
+		return Session{}, errSessionInvalid
+	}
+	return s, nil
+}
+
+func (m *memorySessionStore) Delete(ctx context.Context, idHash string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	delete(m.sessions, idHash)
+	return nil
+}
+
+func (m *memorySessionStore) DeleteUser(ctx context.Context, username string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for k, v := range m.sessions {
+		if v.Username == username {
+			delete(m.sessions, k)
+		}
+	}
+	return nil
+}
+
+type postgresSessionStore struct{}
+
+func (postgresSessionStore) Create(ctx context.Context, s Session) error {
+	_, err := db.Exec(ctx, "INSERT INTO sessions (id_hash, username, csrf_token, created_at, expires_at) VALUES ($1, $2, $3, $4, $5)",
+		s.IDHash, s.Username, s.CSRFToken, s.CreatedAt, s.ExpiresAt)
+	return err
+}
+
+func (postgresSessionStore) Get(ctx context.Context, idHash string) (Session, error) {
+	s := Session{IDHash: idHash}
+	err := db.QueryRow(ctx, "SELECT username, csrf_token, created_at, expires_at FROM sessions WHERE id_hash = $1 AND expires_at > now()", idHash).
+		Scan(&s.Username, &s.CSRFToken, &s.CreatedAt, &s.ExpiresAt)
+	if errors.Is(err, pgx.ErrNoRows) {
+		return Session{}, errSessionInvalid
+	}
+	return s, err
+}
+
+func (postgresSessionStore) Delete(ctx context.Context, idHash string) error {
+	_, err := db.Exec(ctx, "DELETE FROM sessions WHERE id_hash = $1 OR expires_at < now()", idHash)
+	return err
+}
+
+func (postgresSessionStore) DeleteUser(ctx context.Context, username string) error {
+	_, err := db.Exec(ctx, "DELETE FROM sessions WHERE username = $1", username)
+	return err
+}
@@ -0,0 +1,568 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgconn"
+)
+
+// Users are kept in a UserStore chosen with USER_STORE:
+//
+//	postgres  the users table in DATABASE_URL (the default)
+//	sqlite    a local file at SQLITE_PATH (default users.db), created on first use
+//	memory    kept in the process and lost on restart, for tests and demos
+//
+// Only the postgres store needs a database server. API keys and single-use
+// tokens still live in Postgres, so without DATABASE_URL their routes answer
+// 503.
+//
+// Deleting a user only sets DeletedAt. Soft-deleted users keep their
+// username, cannot log in, are left out of lists unless asked for, and are
+// removed for good by Purge once the retention period has passed.
+type UserRecord struct {
+	ID           int
+	Name         string
+	Username     string
+	PasswordHash string
+	// Email is stored encrypted, as produced by encryptEmail.
+	Email         string
+	EmailVerified bool
+	// TOTPSecret (encrypted, see encryptTOTPSecret) and TOTPEnabled are
+	// managed by the MFA methods; Update leaves them alone.
+	TOTPSecret  string
+	TOTPEnabled bool
+	// DataKey is the user's wrapped data key (see newDataKey). It is set by
+	// Create and kept apart from the row, so Update leaves it alone.
+	DataKey string
+	// TokensValidAfter is when the password was last reset; access tokens
+	// issued to the user until then are refused.
+	TokensValidAfter *time.Time
+	DeletedAt        *time.Time
+}
+
+var (
+	errUserNotFound  = errors.New("user not found")
+	errUsernameTaken = errors.New("username already taken")
+)
+
+type UserStore interface {
+	// Create stores u and returns it with its new ID.
+	Create(ctx context.Context, u UserRecord) (UserRecord, error)
+	// Get and FindByUsername return errUserNotFound for unknown users. Get
+	// also returns soft-deleted users; FindByUsername does not.
+	Get(ctx context.Context, id int) (UserRecord, error)
+	FindByUsername(ctx context.Context, username string) (UserRecord, error)
+	// List returns every user ordered by ID, leaving out soft-deleted ones
+	// unless includeDeleted is set.
+	List(ctx context.Context, includeDeleted bool) ([]UserRecord, error)
+	// Update replaces the stored user with u.ID. Create and Update return
+	// errUsernameTaken when another user already has u.Username.
+	Update(ctx context.Context, u UserRecord) (UserRecord, error)
+	// SetPassword replaces the password of the live user username and
+	// sets its TokensValidAfter to now, revoking the tokens it holds.
+	// SetPassword and SetEmailVerified return errUserNotFound when there is
+	// no such user.
+	SetPassword(ctx context.Context, username, passwordHash string) error
+	// SetEmailVerified marks the email of the live user username verified.
+	SetEmailVerified(ctx context.Context, username string) error
+	// Delete soft-deletes the user with id, returning errUserNotFound when
+	// there is no such user or it is already deleted.
+	Delete(ctx context.Context, id int) error
+	// Restore undoes Delete and returns the restored user, or
+	// errUserNotFound when no soft-deleted user has id.
+	Restore(ctx context.Context, id int) (UserRecord, error)
+	// Purge removes the users soft-deleted before cutoff together with their
+	// data keys, and returns their usernames.
+	Purge(ctx context.Context, cutoff time.Time) ([]string, error)
+
+	// StartTOTP stores a new pending TOTP secret for username and forgets
+	// the last time step used. It returns errUserNotFound when there is no
+	// live user username without TOTP enabled.
+	StartTOTP(ctx context.Context, username, encSecret string) error
+	// UseTOTPStep records step as the last TOTP time step username used,
+	// returning errTOTPCodeInvalid unless it is later than the previous one.
+	UseTOTPStep(ctx context.Context, username string, step int64) error
+	// EnableTOTP turns TOTP on for username and replaces its recovery codes
+	// with codeHashes, all at once.
+	EnableTOTP(ctx context.Context, username string, codeHashes []string) error
+	// RecoveryCodes returns username's unused recovery codes.
+	RecoveryCodes(ctx context.Context, username string) ([]RecoveryCode, error)
+	// UseRecoveryCode marks the recovery code with id used, returning
+	// errTOTPCodeInvalid when it already was.
+	UseRecoveryCode(ctx context.Context, id int) error
+}
+
+// RecoveryCode is a stored one-time MFA recovery code.
+type RecoveryCode struct {
+	ID   int
+	Hash string
+}
+
+var userStore UserStore
+
+func loadUserStore() (UserStore, error) {
+	switch v := os.Getenv("USER_STORE"); v {
+	case "", "postgres":
+		if db == nil {
+			return nil, fmt.Errorf("USER_STORE=postgres needs DATABASE_URL")
+		}
+		return postgresUserStore{}, nil
+	case "sqlite":
+		path := os.Getenv("SQLITE_PATH")
+		if path == "" {
+			path = "users.db"
+		}
+		return openSQLiteUserStore(path)
+	case "memory":
+		return newMemoryUserStore(), nil
+	default:
+		return nil, fmt.Errorf("USER_STORE must be postgres, sqlite or memory, got %q", v)
+	}
+}
+
+type postgresUserStore struct{}
+
+// isPostgresUniqueViolation reports whether err is Postgres rejecting a
+// duplicate key (SQLSTATE 23505 unique_violation). username is the only
+// unique column a client can set.
+func isPostgresUniqueViolation(err error) bool {
+	var pgErr *pgconn.PgError
+	return errors.As(err, &pgErr) && pgErr.Code == "23505"
+}
+
+// Users are read joined with their data key, which lives in user_keys.
+const (
+	postgresUserColumns = "users.id, name, username, password, COALESCE(email, ''), email_verified, COALESCE(totp_secret, ''), totp_enabled, COALESCE(wrapped_key, ''), tokens_valid_after, deleted_at"
+	postgresUserTables  = "users LEFT JOIN user_keys ON user_keys.user_id = users.id"
+)
+
+func scanPostgresUser(row pgx.Row) (UserRecord, error) {
+	var u UserRecord
+	err := row.Scan(&u.ID, &u.Name, &u.Username, &u.PasswordHash, &u.Email, &u.EmailVerified, &u.TOTPSecret, &u.TOTPEnabled, &u.DataKey, &u.TokensValidAfter, &u.DeletedAt)
+	if errors.Is(err, pgx.ErrNoRows) {
+		return UserRecord{}, errUserNotFound
+	}
+	return u, err
+}
+
+func (postgresUserStore) Create(ctx context.Context, u UserRecord) (UserRecord, error) {
+	err := pgx.BeginFunc(ctx, db, func(tx pgx.Tx) error {
+		err := tx.QueryRow(ctx, "INSERT INTO users (name, username, password, email, email_verified) VALUES ($1, $2, $3, $4, $5) RETURNING id",
+			u.Name, u.Username, u.PasswordHash, u.Email, u.EmailVerified).Scan(&u.ID)
+		if err != nil || u.DataKey == "" {
+			return err
+		}
+		_, err = tx.Exec(ctx, "INSERT INTO user_keys (user_id, wrapped_key) VALUES ($1, $2)", u.ID, u.DataKey)
+		return err
+	})
+	if isPostgresUniqueViolation(err) {
+		return UserRecord{}, errUsernameTaken
+	}
+	return u, err
+}
+
+func (postgresUserStore) Get(ctx context.Context, id int) (UserRecord, error) {
+	return scanPostgresUser(db.QueryRow(ctx, "SELECT "+postgresUserColumns+" FROM "+postgresUserTables+" WHERE users.id = $1", id))
+}
+
+func (postgresUserStore) FindByUsername(ctx context.Context, username string) (UserRecord, error) {
+	return scanPostgresUser(db.QueryRow(ctx, "SELECT "+postgresUserColumns+" FROM "+postgresUserTables+" WHERE username = $1 AND deleted_at IS NULL", username))
+}
+
+func (postgresUserStore) List(ctx context.Context, includeDeleted bool) ([]UserRecord, error) {
+	rows, err := db.Query(ctx, "SELECT "+postgresUserColumns+" FROM "+postgresUserTables+" WHERE $1 OR deleted_at IS NULL ORDER BY users.id", includeDeleted)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	users := []UserRecord{}
+	for rows.Next() {
+		u, err := scanPostgresUser(rows)
+		if err != nil {
+			return nil, err
+		}
+		users = append(users, u)
+	}
+	return users, rows.Err()
+}
+
+func (postgresUserStore) Update(ctx context.Context, u UserRecord) (UserRecord, error) {
+	err := db.QueryRow(ctx, "UPDATE users SET name = $2, username = $3, password = $4, email = $5, email_verified = $6 WHERE id = $1 RETURNING totp_enabled",
+		u.ID, u.Name, u.Username, u.PasswordHash, u.Email, u.EmailVerified).Scan(&u.TOTPEnabled)
+	if errors.Is(err, pgx.ErrNoRows) {
+		return UserRecord{}, errUserNotFound
+	}
+	if isPostgresUniqueViolation(err) {
+		return UserRecord{}, errUsernameTaken
+	}
+	if err != nil {
+		return UserRecord{}, err
+	}
+	return u, nil
+}
+
+func (postgresUserStore) SetPassword(ctx context.Context, username, passwordHash string) error {
+	return postgresExpectOne(db.Exec(ctx, "UPDATE users SET password = $2, tokens_valid_after = now() WHERE username = $1 AND deleted_at IS NULL",
+		username, passwordHash))
+}
+
+func (postgresUserStore) SetEmailVerified(ctx context.Context, username string) error {
+	return postgresExpectOne(db.Exec(ctx, "UPDATE users SET email_verified = true WHERE username = $1 AND deleted_at IS NULL", username))
+}
+
+// postgresExpectOne turns an update that matched no row into
+// errUserNotFound.
+func postgresExpectOne(tag pgconn.CommandTag, err error) error {
+	if err != nil {
+		return err
+	}
+	if tag.RowsAffected() == 0 {
+		return errUserNotFound
+	}
+	return nil
+}
+
+func (postgresUserStore) Delete(ctx context.Context, id int) error {
+	tag, err := db.Exec(ctx, "UPDATE users SET deleted_at = now() WHERE id = $1 AND deleted_at IS NULL", id)
+	if err != nil {
+		return err
+	}
+	if tag.RowsAffected() == 0 {
+		return errUserNotFound
+	}
+	return nil
+}
+
+func (s postgresUserStore) Restore(ctx context.Context, id int) (UserRecord, error) {
+	tag, err := db.Exec(ctx, "UPDATE users SET deleted_at = NULL WHERE id = $1 AND deleted_at IS NOT NULL", id)
+	if err != nil {
+		return UserRecord{}, err
+	}
+	if tag.RowsAffected() == 0 {
+		return UserRecord{}, errUserNotFound
+	}
+	return s.Get(ctx, id)
+}
+
+// Purge relies on user_keys cascading, so a user's row and data key are
+// deleted together.
+func (postgresUserStore) Purge(ctx context.Context, cutoff time.Time) ([]string, error) {
+	rows, err := db.Query(ctx, "DELETE FROM users WHERE deleted_at < $1 RETURNING username", cutoff)
+	if err != nil {
+		return nil, err
+	}
+	return pgx.CollectRows(rows, pgx.RowTo[string])
+}
+
+func (postgresUserStore) StartTOTP(ctx context.Context, username, encSecret string) error {
+	return postgresExpectOne(db.Exec(ctx, "UPDATE users SET totp_secret = $2, totp_last_step = 0 WHERE username = $1 AND deleted_at IS NULL AND NOT totp_enabled",
+		username, encSecret))
+}
+
+func (postgresUserStore) UseTOTPStep(ctx context.Context, username string, step int64) error {
+	err := postgresExpectOne(db.Exec(ctx, "UPDATE users SET totp_last_step = $2 WHERE username = $1 AND deleted_at IS NULL AND totp_last_step < $2",
+		username, step))
+	if errors.Is(err, errUserNotFound) {
+		return errTOTPCodeInvalid
+	}
+	return err
+}
+
+func (postgresUserStore) EnableTOTP(ctx context.Context, username string, codeHashes []string) error {
+	return pgx.BeginFunc(ctx, db, func(tx pgx.Tx) error {
+		if _, err := tx.Exec(ctx, "DELETE FROM mfa_recovery_codes WHERE username = $1", username); err != nil {
+			return err
+		}
+		for _, hash := range codeHashes {
+			if _, err := tx.Exec(ctx, "INSERT INTO mfa_recovery_codes (username, code_hash) VALUES ($1, $2)", username, hash); err != nil {
+				return err
+			}
+		}
+		return postgresExpectOne(tx.Exec(ctx, "UPDATE users SET totp_enabled = true WHERE username = $1 AND deleted_at IS NULL", username))
+	})
+}
+
+func (postgresUserStore) RecoveryCodes(ctx context.Context, username string) ([]RecoveryCode, error) {
+	rows, err := db.Query(ctx, "SELECT id, code_hash FROM mfa_recovery_codes WHERE username = $1 AND used_at IS NULL", username)
+	if err != nil {
+		return nil, err
+	}
+	return pgx.CollectRows(rows, func(row pgx.CollectableRow) (RecoveryCode, error) {
+		var c RecoveryCode
+		err := row.Scan(&c.ID, &c.Hash)
+		return c, err
+	})
+}
+
+func (postgresUserStore) UseRecoveryCode(ctx context.Context, id int) error {
+	err := postgresExpectOne(db.Exec(ctx, "UPDATE mfa_recovery_codes SET used_at = now() WHERE id = $1 AND used_at IS NULL", id))
+	if errors.Is(err, errUserNotFound) {
+		return errTOTPCodeInvalid
+	}
+	return err
+}
+
+type memoryUserStore struct {
+	mu     sync.Mutex
+	nextID int
+	users  map[int]UserRecord
+	// totpSteps maps user IDs to the last TOTP time step they used.
+	totpSteps     map[int]int64
+	recoveryCodes map[int]memoryRecoveryCode
+	nextCodeID    int
+}
+
+type memoryRecoveryCode struct {
+	UserID int
+	Hash   string
+	Used   bool
+}
+
+func newMemoryUserStore() *memoryUserStore {
+	return &memoryUserStore{
+		nextID:        1,
+		users:         map[int]UserRecord{},
+		totpSteps:     map[int]int64{},
+		recoveryCodes: map[int]memoryRecoveryCode{},
+		nextCodeID:    1,
+	}
+}
+
+// usernameTaken reports whether another user than id has username. Callers
+// hold m.mu.
+func (m *memoryUserStore) usernameTaken(username string, id int) bool {
+	for _, u := range m.users {
+		if u.ID != id && u.Username == username {
+			return true
+		}
+	}
+	return false
+}
+
+func (m *memoryUserStore) Create(ctx context.Context, u UserRecord) (UserRecord, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.usernameTaken(u.Username, 0) {
+		return UserRecord{}, errUsernameTaken
+	}
+	u.ID = m.nextID
+	m.nextID++
+	m.users[u.ID] = u
+	return u, nil
+}
+
+func (m *memoryUserStore) Get(ctx context.Context, id int) (UserRecord, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	u, ok := m.users[id]
+	if !ok {
+		return UserRecord{}, errUserNotFound
+	}
+	return u, nil
+}
+
+func (m *memoryUserStore) FindByUsername(ctx context.Context, username string) (UserRecord, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for _, u := range m.users {
+		if u.Username == username && u.DeletedAt == nil {
+			return u, nil
+		}
+	}
+	return UserRecord{}, errUserNotFound
+}
+
+func (m *memoryUserStore) List(ctx context.Context, includeDeleted bool) ([]UserRecord, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	users := make([]UserRecord, 0, len(m.users))
+	for _, u := range m.users {
+		if includeDeleted || u.DeletedAt == nil {
+			users = append(users, u)
+		}
+	}
+	sort.Slice(users, func(i, j int) bool { return users[i].ID < users[j].ID })
+	return users, nil
+}
+
+func (m *memoryUserStore) Update(ctx context.Context, u UserRecord) (UserRecord, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	old, ok := m.users[u.ID]
+	if !ok {
+		return UserRecord{}, errUserNotFound
+	}
+	if m.usernameTaken(u.Username, u.ID) {
+		return UserRecord{}, errUsernameTaken
+	}
+	u.TOTPSecret, u.TOTPEnabled = old.TOTPSecret, old.TOTPEnabled
+	u.DataKey, u.TokensValidAfter, u.DeletedAt = old.DataKey, old.TokensValidAfter, old.DeletedAt
+	m.users[u.ID] = u
+	return u, nil
+}
+
+// liveUser returns the ID of the live user username. Callers hold m.mu.
+func (m *memoryUserStore) liveUser(username string) (int, bool) {
+	for id, u := range m.users {
+		if u.Username == username && u.DeletedAt == nil {
+			return id, true
+		}
+	}
+	return 0, false
+}
+
+func (m *memoryUserStore) SetPassword(ctx context.Context, username, passwordHash string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	id, ok := m.liveUser(username)
+	if !ok {
+		return errUserNotFound
+	}
+	u := m.users[id]
+	now := time.Now().UTC()
+	u.PasswordHash, u.TokensValidAfter = passwordHash, &now
+	m.users[id] = u
+	return nil
+}
+
+func (m *memoryUserStore) SetEmailVerified(ctx context.Context, username string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	id, ok := m.liveUser(username)
+	if !ok {
+		return errUserNotFound
+	}
+	u := m.users[id]
+	u.EmailVerified = true
+	m.users[id] = u
+	return nil
+}
+
+func (m *memoryUserStore) Delete(ctx context.Context, id int) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	u, ok := m.users[id]
+	if !ok || u.DeletedAt != nil {
+		return errUserNotFound
+	}
+	now := time.Now().UTC()
+	u.DeletedAt = &now
+	m.users[id] = u
+	return nil
+}
+
+func (m *memoryUserStore) Restore(ctx context.Context, id int) (UserRecord, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	u, ok := m.users[id]
+	if !ok || u.DeletedAt == nil {
+		return UserRecord{}, errUserNotFound
+	}
+	u.DeletedAt = nil
+	m.users[id] = u
+	return u, nil
+}
+
+func (m *memoryUserStore) Purge(ctx context.Context, cutoff time.Time) ([]string, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	usernames := []string{}
+	for id, u := range m.users {
+		if u.DeletedAt != nil && u.DeletedAt.Before(cutoff) {
+			delete(m.users, id)
+			delete(m.totpSteps, id)
+			m.deleteRecoveryCodes(id)
+			usernames = append(usernames, u.Username)
+		}
+	}
+	return usernames, nil
+}
+
+func (m *memoryUserStore) StartTOTP(ctx context.Context, username, encSecret string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	id, ok := m.liveUser(username)
+	if !ok || m.users[id].TOTPEnabled {
+		return errUserNotFound
+	}
+	u := m.users[id]
+	u.TOTPSecret = encSecret
+	m.users[id] = u
+	m.totpSteps[id] = 0
+	return nil
+}
+
+func (m *memoryUserStore) UseTOTPStep(ctx context.Context, username string, step int64) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	id, ok := m.liveUser(username)
+	if !ok || m.totpSteps[id] >= step {
+		return errTOTPCodeInvalid
+	}
+	m.totpSteps[id] = step
+	return nil
+}
+
+func (m *memoryUserStore) EnableTOTP(ctx context.Context, username string, codeHashes []string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	id, ok := m.liveUser(username)
+	if !ok {
+		return errUserNotFound
+	}
+	m.deleteRecoveryCodes(id)
+	for _, hash := range codeHashes {
+		m.recoveryCodes[m.nextCodeID] = memoryRecoveryCode{UserID: id, Hash: hash}
+		m.nextCodeID++
+	}
+	u := m.users[id]
+	u.TOTPEnabled = true
+	m.users[id] = u
+	return nil
+}
+
+// deleteRecoveryCodes drops every recovery code of the user with id.
+// Callers hold m.mu.
+func (m *memoryUserStore) deleteRecoveryCodes(id int) {
+	for codeID, c := range m.recoveryCodes {
+		if c.UserID == id {
+			delete(m.recoveryCodes, codeID)
+		}
+	}
+}
+
+func (m *memoryUserStore) RecoveryCodes(ctx context.Context, username string) ([]RecoveryCode, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	codes := []RecoveryCode{}
+	id, ok := m.liveUser(username)
+	if !ok {
+		return codes, nil
+	}
+	for codeID, c := range m.recoveryCodes {
+		if c.UserID == id && !c.Used {
+			codes = append(codes, RecoveryCode{ID: codeID, Hash: c.Hash})
+		}
+	}
+	return codes, nil
+}
+
+func (m *memoryUserStore) UseRecoveryCode(ctx context.Context, id int) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	c, ok := m.recoveryCodes[id]
+	if !ok || c.Used {
+		return errTOTPCodeInvalid
+	}
+	c.Used = true
+	m.recoveryCodes[id] = c
+	return nil
+}
@@ -0,0 +1,339 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"modernc.org/sqlite"
+	sqlite3 "modernc.org/sqlite/lib"
+)
+
+// sqliteUserStore keeps users in a local SQLite file through a pure-Go
+// driver, so the service runs without cgo or a database server.
+type sqliteUserStore struct {
+	db *sql.DB
+}
+
+func openSQLiteUserStore(path string) (*sqliteUserStore, error) {
+	conn, err := sql.Open("sqlite", path)
+	if err != nil {
+		return nil, fmt.Errorf("SQLITE_PATH: %w", err)
+	}
+	// SQLite allows a single writer; one connection avoids SQLITE_BUSY.
+	conn.SetMaxOpenConns(1)
+	_, err = conn.Exec(`CREATE TABLE IF NOT EXISTS users (
+		id                 INTEGER PRIMARY KEY AUTOINCREMENT,
+		name               TEXT NOT NULL,
+		username           TEXT NOT NULL UNIQUE,
+		password           TEXT NOT NULL,
+		email              TEXT NOT NULL DEFAULT '',
+		email_verified     BOOLEAN NOT NULL DEFAULT FALSE,
+		totp_secret        TEXT NOT NULL DEFAULT '',
+		totp_enabled       BOOLEAN NOT NULL DEFAULT FALSE,
+		totp_last_step     INTEGER NOT NULL DEFAULT 0,
+		tokens_valid_after DATETIME,
+		deleted_at         DATETIME
+	)`)
+	if err == nil {
+		_, err = conn.Exec(`CREATE TABLE IF NOT EXISTS user_keys (
+			user_id     INTEGER PRIMARY KEY,
+			wrapped_key TEXT NOT NULL
+		)`)
+	}
+	if err == nil {
+		// Recovery codes hang off the user ID, which unlike the username
+		// never changes.
+		_, err = conn.Exec(`CREATE TABLE IF NOT EXISTS mfa_recovery_codes (
+			id        INTEGER PRIMARY KEY AUTOINCREMENT,
+			user_id   INTEGER NOT NULL,
+			code_hash TEXT NOT NULL,
+			used_at   DATETIME
+		)`)
+	}
+	if err == nil {
+		err = upgradeSQLiteUsers(conn)
+	}
+	if err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("SQLITE_PATH: %w", err)
+	}
+	return &sqliteUserStore{db: conn}, nil
+}
+
+// upgradeSQLiteUsers adds the columns that came after the first release to
+// files created before them.
+func upgradeSQLiteUsers(conn *sql.DB) error {
+	columns := []string{
+		"deleted_at DATETIME",
+	}
+	for _, column := range columns {
+		name, _, _ := strings.Cut(column, " ")
+		var n int
+		err := conn.QueryRow("SELECT count(*) FROM pragma_table_info('users') WHERE name = ?", name).Scan(&n)
+		if err != nil {
+			return err
+		}
+		if n == 0 {
+			if _, err := conn.Exec("ALTER TABLE users ADD COLUMN " + column); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// isSQLiteUniqueViolation reports whether err is SQLite rejecting a
+// duplicate value in a UNIQUE column.
+func isSQLiteUniqueViolation(err error) bool {
+	var sqliteErr *sqlite.Error
+	return errors.As(err, &sqliteErr) && sqliteErr.Code() == sqlite3.SQLITE_CONSTRAINT_UNIQUE
+}
+
+const (
+	sqliteUserColumns = "users.id, name, username, password, email, email_verified, totp_secret, totp_enabled, COALESCE(wrapped_key, ''), tokens_valid_after, deleted_at"
+	sqliteUserTables  = "users LEFT JOIN user_keys ON user_keys.user_id = users.id"
+)
+
+type sqliteScanner interface {
+	Scan(dest ...any) error
+}
+
+func scanSQLiteUser(row sqliteScanner) (UserRecord, error) {
+	var u UserRecord
+	err := row.Scan(&u.ID, &u.Name, &u.Username, &u.PasswordHash, &u.Email, &u.EmailVerified, &u.TOTPSecret, &u.TOTPEnabled, &u.DataKey, &u.TokensValidAfter, &u.DeletedAt)
+	if errors.Is(err, sql.ErrNoRows) {
+		return UserRecord{}, errUserNotFound
+	}
+	return u, err
+}
+
+func (s *sqliteUserStore) Create(ctx context.Context, u UserRecord) (UserRecord, error) {
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return UserRecord{}, err
+	}
+	defer tx.Rollback()
+
+	res, err := tx.ExecContext(ctx, "INSERT INTO users (name, username, password, email, email_verified) VALUES (?, ?, ?, ?, ?)",
+		u.Name, u.Username, u.PasswordHash, u.Email, u.EmailVerified)
+	if isSQLiteUniqueViolation(err) {
+		return UserRecord{}, errUsernameTaken
+	}
+	if err != nil {
+		return UserRecord{}, err
+	}
+	id, err := res.LastInsertId()
+	if err != nil {
+		return UserRecord{}, err
+	}
+	u.ID = int(id)
+	if u.DataKey != "" {
+		if _, err := tx.ExecContext(ctx, "INSERT INTO user_keys (user_id, wrapped_key) VALUES (?, ?)", u.ID, u.DataKey); err != nil {
+			return UserRecord{}, err
+		}
+	}
+	return u, tx.Commit()
+}
+
+func (s *sqliteUserStore) Get(ctx context.Context, id int) (UserRecord, error) {
+	return scanSQLiteUser(s.db.QueryRowContext(ctx, "SELECT "+sqliteUserColumns+" FROM "+sqliteUserTables+" WHERE users.id = ?", id))
+}
+
+func (s *sqliteUserStore) FindByUsername(ctx context.Context, username string) (UserRecord, error) {
+	return scanSQLiteUser(s.db.QueryRowContext(ctx, "SELECT "+sqliteUserColumns+" FROM "+sqliteUserTables+" WHERE username = ? AND deleted_at IS NULL", username))
+}
+
+func (s *sqliteUserStore) List(ctx context.Context, includeDeleted bool) ([]UserRecord, error) {
+	rows, err := s.db.QueryContext(ctx, "SELECT "+sqliteUserColumns+" FROM "+sqliteUserTables+" WHERE ? OR deleted_at IS NULL ORDER BY users.id", includeDeleted)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	users := []UserRecord{}
+	for rows.Next() {
+		u, err := scanSQLiteUser(rows)
+		if err != nil {
+			return nil, err
+		}
+		users = append(users, u)
+	}
+	return users, rows.Err()
+}
+
+func (s *sqliteUserStore) Update(ctx context.Context, u UserRecord) (UserRecord, error) {
+	err := s.db.QueryRowContext(ctx, "UPDATE users SET name = ?, username = ?, password = ?, email = ?, email_verified = ? WHERE id = ? RETURNING totp_enabled",
+		u.Name, u.Username, u.PasswordHash, u.Email, u.EmailVerified, u.ID).Scan(&u.TOTPEnabled)
+	if errors.Is(err, sql.ErrNoRows) {
+		return UserRecord{}, errUserNotFound
+	}
+	if isSQLiteUniqueViolation(err) {
+		return UserRecord{}, errUsernameTaken
+	}
+	if err != nil {
+		return UserRecord{}, err
+	}
+	return u, nil
+}
+
+func (s *sqliteUserStore) SetPassword(ctx context.Context, username, passwordHash string) error {
+	return sqliteExpectOne(s.db.ExecContext(ctx, "UPDATE users SET password = ?, tokens_valid_after = ? WHERE username = ? AND deleted_at IS NULL",
+		passwordHash, time.Now().UTC(), username))
+}
+
+func (s *sqliteUserStore) SetEmailVerified(ctx context.Context, username string) error {
+	return sqliteExpectOne(s.db.ExecContext(ctx, "UPDATE users SET email_verified = TRUE WHERE username = ? AND deleted_at IS NULL", username))
+}
+
+// sqliteExpectOne turns an update that matched no row into errUserNotFound.
+func sqliteExpectOne(res sql.Result, err error) error {
+	if err != nil {
+		return err
+	}
+	n, err := res.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if n == 0 {
+		return errUserNotFound
+	}
+	return nil
+}
+
+func (s *sqliteUserStore) Delete(ctx context.Context, id int) error {
+	res, err := s.db.ExecContext(ctx, "UPDATE users SET deleted_at = ? WHERE id = ? AND deleted_at IS NULL", time.Now().UTC(), id)
+	if err != nil {
+		return err
+	}
+	n, err := res.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if n == 0 {
+		return errUserNotFound
+	}
+	return nil
+}
+
+func (s *sqliteUserStore) Restore(ctx context.Context, id int) (UserRecord, error) {
+	res, err := s.db.ExecContext(ctx, "UPDATE users SET deleted_at = NULL WHERE id = ? AND deleted_at IS NOT NULL", id)
+	if err != nil {
+		return UserRecord{}, err
+	}
+	n, err := res.RowsAffected()
+	if err != nil {
+		return UserRecord{}, err
+	}
+	if n == 0 {
+		return UserRecord{}, errUserNotFound
+	}
+	return s.Get(ctx, id)
+}
+
+// Purge deletes the data keys and recovery codes before the rows, in one
+// transaction.
+func (s *sqliteUserStore) Purge(ctx context.Context, cutoff time.Time) ([]string, error) {
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	cutoff = cutoff.UTC()
+	for _, table := range []string{"user_keys", "mfa_recovery_codes"} {
+		_, err = tx.ExecContext(ctx, "DELETE FROM "+table+" WHERE user_id IN (SELECT id FROM users WHERE deleted_at < ?)", cutoff)
+		if err != nil {
+			return nil, err
+		}
+	}
+	rows, err := tx.QueryContext(ctx, "DELETE FROM users WHERE deleted_at < ? RETURNING username", cutoff)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	usernames := []string{}
+	for rows.Next() {
+		var username string
+		if err := rows.Scan(&username); err != nil {
+			return nil, err
+		}
+		usernames = append(usernames, username)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	return usernames, tx.Commit()
+}
+
+func (s *sqliteUserStore) StartTOTP(ctx context.Context, username, encSecret string) error {
+	return sqliteExpectOne(s.db.ExecContext(ctx, "UPDATE users SET totp_secret = ?, totp_last_step = 0 WHERE username = ? AND deleted_at IS NULL AND NOT totp_enabled",
+		encSecret, username))
+}
+
+func (s *sqliteUserStore) UseTOTPStep(ctx context.Context, username string, step int64) error {
+	err := sqliteExpectOne(s.db.ExecContext(ctx, "UPDATE users SET totp_last_step = ? WHERE username = ? AND deleted_at IS NULL AND totp_last_step < ?",
+		step, username, step))
+	if errors.Is(err, errUserNotFound) {
+		return errTOTPCodeInvalid
+	}
+	return err
+}
+
+func (s *sqliteUserStore) EnableTOTP(ctx context.Context, username string, codeHashes []string) error {
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	var id int
+	err = tx.QueryRowContext(ctx, "SELECT id FROM users WHERE username = ? AND deleted_at IS NULL", username).Scan(&id)
+	if errors.Is(err, sql.ErrNoRows) {
+		return errUserNotFound
+	}
+	if err != nil {
+		return err
+	}
+	if _, err := tx.ExecContext(ctx, "DELETE FROM mfa_recovery_codes WHERE user_id = ?", id); err != nil {
+		return err
+	}
+	for _, hash := range codeHashes {
+		if _, err := tx.ExecContext(ctx, "INSERT INTO mfa_recovery_codes (user_id, code_hash) VALUES (?, ?)", id, hash); err != nil {
+			return err
+		}
+	}
+	if _, err := tx.ExecContext(ctx, "UPDATE users SET totp_enabled = TRUE WHERE id = ?", id); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+func (s *sqliteUserStore) RecoveryCodes(ctx context.Context, username string) ([]RecoveryCode, error) {
+	rows, err := s.db.QueryContext(ctx, `SELECT mfa_recovery_codes.id, code_hash FROM mfa_recovery_codes JOIN users ON users.id = user_id
+		WHERE username = ? AND deleted_at IS NULL AND used_at IS NULL`, username)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	codes := []RecoveryCode{}
+	for rows.Next() {
+		var c RecoveryCode
+		if err := rows.Scan(&c.ID, &c.Hash); err != nil {
+			return nil, err
+		}
+		codes = append(codes, c)
+	}
+	return codes, rows.Err()
+}
+
+func (s *sqliteUserStore) UseRecoveryCode(ctx context.Context, id int) error {
+	err := sqliteExpectOne(s.db.ExecContext(ctx, "UPDATE mfa_recovery_codes SET used_at = ? WHERE id = ? AND used_at IS NULL", time.Now().UTC(), id))
+	if errors.Is(err, errUserNotFound) {
+		return errTOTPCodeInvalid
+	}
+	return err
+}